@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+)
+
+// requestTimeout bounds each call list and status make to the server.
+const requestTimeout = 15 * time.Second
+
+// register claims every configured subdomain and prints where it will be
+// served, leaving it reserved for a later "agent run".
+func register(args []string) {
+	opts := parseFlags("register", args)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	failed := false
+	for _, client := range opts.clients() {
+		if err := client.Register(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", client.Subdomain(), err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s\t%s\n", client.Subdomain(), client.PublicURL())
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// tunnelInfo is an entry of the server's GET /tunnels.
+type tunnelInfo struct {
+	Subdomain  string    `json:"subdomain"`
+	Domain     string    `json:"custom_domain"`
+	Target     string    `json:"target"`
+	Connected  bool      `json:"connected"`
+	Streams    int       `json:"streams"`
+	Requests   int64     `json:"requests"`
+	LastActive time.Time `json:"last_active"`
+	Agent      *struct {
+		Version      string `json:"version"`
+		OS           string `json:"os"`
+		Arch         string `json:"arch"`
+		LocalHealthy bool   `json:"local_healthy"`
+		LocalError   string `json:"local_error"`
+	} `json:"agent"` // Nil until the agent has sent a heartbeat
+}
+
+// list prints every tunnel registered on the server.
+func list(args []string) {
+	opts := parseFlags("list", args)
+	tunnels, err := fetchTunnels(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to list tunnels:", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBDOMAIN\tCONNECTED\tSTREAMS\tREQUESTS\tTARGET\tDOMAIN")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%s\t%s\n", t.Subdomain, t.Connected, t.Streams, t.Requests, t.Target, t.Domain)
+	}
+	w.Flush()
+}
+
+// status reports whether the server is up and, if the key may list
+// tunnels, whether each configured tunnel has an agent connected.
+func status(args []string) {
+	opts := parseFlags("status", args)
+
+	base, err := serverURL(opts.cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid proxy URL:", err)
+		os.Exit(2)
+	}
+	if _, err := get(opts, base+"/readyz"); err != nil {
+		fmt.Printf("Server %s: not ready: %v\n", base, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Server %s: ready\n", base)
+
+	tunnels, err := fetchTunnels(opts)
+	if err != nil {
+		fmt.Println("Tunnels: unknown:", err)
+		return
+	}
+	byName := make(map[string]tunnelInfo, len(tunnels))
+	for _, t := range tunnels {
+		byName[t.Subdomain] = t
+	}
+	for _, t := range opts.cfg.Tunnels {
+		info, ok := byName[t.Subdomain]
+		switch {
+		case !ok:
+			fmt.Printf("%s: not registered\n", t.Subdomain)
+		case info.Connected:
+			fmt.Printf("%s: connected, %d open streams, last active %s\n", t.Subdomain, info.Streams, info.LastActive.Format(time.RFC3339))
+			if a := info.Agent; a != nil {
+				health := "up"
+				if !a.LocalHealthy {
+					health = "down: " + a.LocalError
+				}
+				fmt.Printf("  agent %s on %s/%s, local service %s\n", a.Version, a.OS, a.Arch, health)
+			}
+		default:
+			fmt.Printf("%s: registered, no agent connected\n", t.Subdomain)
+		}
+	}
+}
+
+// fetchTunnels calls the server's admin listing.
+func fetchTunnels(opts *options) ([]tunnelInfo, error) {
+	base, err := serverURL(opts.cfg)
+	if err != nil {
+		return nil, err
+	}
+	body, err := get(opts, base+"/tunnels")
+	if err != nil {
+		return nil, err
+	}
+	var tunnels []tunnelInfo
+	if err := json.Unmarshal(body, &tunnels); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return tunnels, nil
+}
+
+// get fetches url with the agent's key and TLS settings and fails on any
+// status other than 200.
+func get(opts *options, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", opts.cfg.APIKey)
+
+	client := http.DefaultClient
+	if opts.tls != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = opts.tls.Clone()
+		client = &http.Client{Transport: transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// serverURL is the HTTP base of the tunnel endpoint, derived from the
+// register URL if set and the proxy URL otherwise.
+func serverURL(cfg *config.Agent) (string, error) {
+	raw, suffix := cfg.Proxy, "/tunnel"
+	if cfg.Register != "" {
+		raw, suffix = cfg.Register, "/register"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, suffix)
+	u.RawQuery = ""
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
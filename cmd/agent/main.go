@@ -1,191 +1,513 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/gorilla/websocket"
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"github.com/rahulthapaofficial/expose-local/internal/logging"
+	"github.com/rahulthapaofficial/expose-local/internal/version"
+	"github.com/rahulthapaofficial/expose-local/pkg/tunnel"
 )
 
 func main() {
-	// Command-line flags
-	subdomainFlag := flag.String("subdomain", "test", "Subdomain for the tunnel")
-	targetPort := flag.String("port", "80", "Local port to expose (e.g., Apache on 80)")
-	proxyURL := flag.String("proxy", "wss://reverse-proxy-tunneling.onrender.com/tunnel", "Proxy WebSocket URL")
-	apiKey := flag.String("apikey", "test123", "Authentication key")
-	flag.Parse()
-
-	// Initial subdomain
-	subdomain := *subdomainFlag
-
-	// Register subdomain with proxy
-	for {
-		// registerURL := "https://exposelocal.dev:8080/register"
-		registerURL := "https://reverse-proxy-tunneling.onrender.com/register"
-		registerData := map[string]string{
-			"subdomain":   subdomain,
-			"target_port": *targetPort,
-			"api_key":     *apiKey,
-		}
-
-		jsonData, err := json.Marshal(registerData)
-		if err != nil {
-			log.Fatalf("JSON encoding failed: %v", err)
-		}
+	// "agent -flags" without a subcommand is "agent run -flags", as
+	// before subcommands existed.
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run":
+		run(args)
+	case "register":
+		register(args)
+	case "list":
+		list(args)
+	case "status":
+		status(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
 
-		log.Printf("Registering subdomain: %s", subdomain)
-		resp, err := http.Post(registerURL, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Printf("HTTP request failed: %v", err)
-			time.Sleep(5 * time.Second) // Retry after 5 seconds
-			continue
-		}
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: agent [command] [flags]
 
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		log.Printf("Registration response: %d - %s", resp.StatusCode, string(body))
+Commands:
+  run       Serve the configured tunnels (the default)
+  register  Register the tunnels and print their URLs without serving them
+  list      List every tunnel on the server (needs an admin key)
+  status    Show whether the server is up and the configured tunnels are connected
 
-		if resp.StatusCode == http.StatusCreated {
-			log.Println("Successfully Registered")
-			break // Successfully registered
-		}
+Every command takes the same flags; see "agent run -h".
+`)
+}
 
-		if resp.StatusCode == http.StatusConflict {
-			subdomain = fmt.Sprintf("%s-%d", *subdomainFlag, rand.Intn(1000))
-			log.Printf("Subdomain taken, retrying with: %s", subdomain)
-			continue
-		}
+// options is the agent configuration after flags have been applied to the
+// config file.
+type options struct {
+	cfg    *config.Agent
+	tls    *tls.Config
+	logger *slog.Logger
+	check  bool
+}
 
-		log.Fatalf("Registration failed: %s", string(body))
-	}
+// parseFlags parses a subcommand's flags, which every subcommand shares,
+// loads the config file and sets up logging. Invalid settings exit with 2.
+func parseFlags(name string, args []string) *options {
+	defaults := config.DefaultAgent()
+	fs := flag.NewFlagSet("agent "+name, flag.ExitOnError)
 
-	// Graceful shutdown handling
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+	// Command-line flags; any that are set override the config file.
+	configPath := fs.String("config", "", "Path to an agent YAML config")
+	var subdomains, targetPorts listFlag
+	fs.Var(&subdomains, "subdomain", "Subdomain for the tunnel; repeat together with -port for more tunnels (default test)")
+	fs.Var(&targetPorts, "port", "Local port to expose (e.g., Apache on 80); repeat together with -subdomain (default 80)")
+	target := fs.String("target", "", "Host running the local service, or host:port in place of -port (default localhost)")
+	var routes listFlag
+	fs.Var(&routes, "route", "Send requests under a path prefix to another local port, e.g. /api=8000; the longest prefix wins; repeatable")
+	tunnelType := fs.String("type", "http", "Tunnel type: http or tcp")
+	basicAuth := fs.String("basic-auth", "", "Require visitors to log in with user:pass")
+	domain := fs.String("domain", "", "Custom domain CNAMEd at the proxy, e.g. myapp.example.com")
+	hostHeader := fs.String("host-header", "", "Host header for the local app: preserve, target (the -target address) or a literal value")
+	var allowCIDRs, denyCIDRs listFlag
+	wildcard := fs.Bool("wildcard", false, "Also route every name below the subdomain, e.g. api.<subdomain>.<base domain>")
+	fallback := fs.String("fallback", "", "When the subdomain is taken: random (e.g. foo-x7k2p9, the default) or sequential (foo-2, foo-3, ...)")
+	fs.Var(&allowCIDRs, "allow-cidr", "Admit only visitors from this IP or CIDR; repeatable")
+	fs.Var(&denyCIDRs, "deny-cidr", "Refuse visitors from this IP or CIDR; repeatable")
+	var responseHeaders, removeHeaders listFlag
+	fs.Var(&responseHeaders, "response-header", `Header set on every response, e.g. "Access-Control-Allow-Origin: *"; repeatable`)
+	fs.Var(&removeHeaders, "remove-response-header", "Header removed from every response, e.g. Server; repeatable")
+	maxBandwidth := fs.Int64("max-bytes-per-sec", 0, "Throughput cap for the tunnel (0 takes the server's limit)")
+	maxInFlight := fs.Int("max-in-flight", 0, "HTTP requests sent to the local service at once (0 takes the server's limit)")
+	maxQueued := fs.Int("max-queued", 0, "Requests that may wait for -max-in-flight before getting 503 (0 takes the server's limit)")
+	cacheBytes := fs.Int64("cache-bytes", 0, "Let the server cache GET responses marked cacheable by Cache-Control or ETag, up to this many bytes (0 disables)")
+	proxyURL := fs.String("proxy", defaults.Proxy, "Proxy WebSocket URL")
+	registerURL := fs.String("register", "", "Registration URL (derived from -proxy when empty)")
+	baseDomain := fs.String("base-domain", defaults.BaseDomain, "Domain the server serves subdomains under, for the public URL logged by older servers")
+	apiKey := fs.String("apikey", defaults.APIKey, "Authentication key (prefer $TUNNEL_API_KEY or -apikey-file)")
+	apiKeyFile := fs.String("apikey-file", "", "File holding the authentication key")
+	bufferSize := fs.Int("buffer-size", defaults.BufferSize, "Bytes per copy buffer")
+	tlsCert := fs.String("tls-cert", "", "Client certificate for servers that use mutual TLS")
+	tlsKey := fs.String("tls-key", "", "Key for -tls-cert")
+	tlsCA := fs.String("tls-ca", "", "PEM roots for the server's certificate (system roots when empty)")
+	wsReadBuffer := fs.Int("ws-read-buffer", 0, "WebSocket read buffer in bytes (0 = 4096)")
+	wsWriteBuffer := fs.Int("ws-write-buffer", 0, "WebSocket write buffer in bytes (0 = 4096)")
+	maxMessage := fs.Int64("max-message-bytes", 0, "Largest WebSocket message accepted from the server (0 = 4MB)")
+	compress := fs.Bool("compress", false, "Offer WebSocket compression (permessage-deflate)")
+	keepalive := fs.Duration("keepalive", defaults.Keepalive, "Interval between WebSocket pings (0 disables)")
+	heartbeat := fs.Duration("heartbeat", defaults.Heartbeat, "Interval between version and health reports to the server (0 disables)")
+	dialTimeout := fs.Duration("dial-timeout", defaults.DialTimeout, "Limit on connecting to the local service")
+	idleTimeout := fs.Duration("idle-timeout", defaults.IdleTimeout, "Close local connections idle in both directions this long (0 disables)")
+	oneShot := fs.Bool("one-shot", false, "Exit when the server drains the tunnel instead of reconnecting")
+	waitForPort := fs.Duration("wait-for-port", 0, "Before registering, wait up to this long for the local service to accept connections (0 does not wait)")
+	retryDelay := fs.Duration("retry-delay", defaults.Backoff.Initial, "First reconnect or registration retry delay, doubled after each failure; each wait is a random share of it")
+	maxRetryDelay := fs.Duration("max-retry-delay", defaults.Backoff.Max, "Reconnect delay ceiling")
+	maxRegisterAttempts := fs.Int("max-register-attempts", 0, "Exit after this many failed registrations to an unreachable or failing server (0 retries forever)")
+	logLevel := fs.String("log-level", defaults.Log.Level, "Log level: debug, info, warn or error")
+	logFormat := fs.String("log-format", defaults.Log.Format, "Log format: text or json")
+	check := fs.Bool("check", false, "Verify the config, connectivity and registration, then exit")
+	showVersion := fs.Bool("version", false, "Print the version and exit")
+	fs.Parse(args)
 
-	headers := http.Header{}
-	headers.Set("X-API-Key", *apiKey)
-	headers.Set("X-Subdomain", subdomain)
-
-	retryDelay := 2 * time.Second
-	maxRetryDelay := 60 * time.Second
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Shutting down agent...")
-			return
-		default:
-			log.Printf("Connecting to WebSocket: %s", *proxyURL)
-			conn, _, err := websocket.DefaultDialer.Dial(*proxyURL, headers)
-			if err != nil {
-				log.Printf("WebSocket connection failed: %v. Retrying in %v...", err, retryDelay)
-				time.Sleep(retryDelay)
-				retryDelay = increaseDelay(retryDelay, maxRetryDelay)
-				continue
-			}
+	if *showVersion {
+		fmt.Println(version.String("expose-local agent"))
+		os.Exit(0)
+	}
 
-			log.Printf("Tunnel active: https://%s.exposelocal.dev → localhost:%s", subdomain, *targetPort)
-			retryDelay = 2 * time.Second // Reset retry delay
+	cfg := defaults
+	if *configPath != "" {
+		loaded, err := config.LoadAgent(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load config:", err)
+			os.Exit(2)
+		}
+		cfg = loaded
+	}
 
-			// Handle the connection
-			connectionCtx, cancel := context.WithCancel(ctx)
-			go handleConnection(connectionCtx, conn, *targetPort)
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
-			// Wait for connection to drop
-			<-connectionCtx.Done()
-			cancel()
-			conn.Close()
+	if set["proxy"] {
+		cfg.Proxy = *proxyURL
+	}
+	if set["register"] {
+		cfg.Register = *registerURL
+	}
+	if set["base-domain"] {
+		cfg.BaseDomain = *baseDomain
+	}
+	if set["apikey-file"] {
+		cfg.APIKeyFile = *apiKeyFile
+	}
+	if set["apikey"] {
+		cfg.APIKey = *apiKey
+		cfg.APIKeyFile = ""
+	} else {
+		key, err := config.ResolveAPIKey(cfg.APIKey, cfg.APIKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid API key:", err)
+			os.Exit(2)
+		}
+		cfg.APIKey = key
+		// The file is read again on every registration, so that tokens
+		// rotated by an identity provider are picked up; the environment
+		// wins over it, though.
+		if os.Getenv(config.APIKeyEnv) != "" {
+			cfg.APIKeyFile = ""
 		}
 	}
-}
+	if set["tls-cert"] {
+		cfg.TLS.Cert = *tlsCert
+	}
+	if set["tls-key"] {
+		cfg.TLS.Key = *tlsKey
+	}
+	if set["tls-ca"] {
+		cfg.TLS.CA = *tlsCA
+	}
+	if set["buffer-size"] {
+		cfg.BufferSize = *bufferSize
+	}
+	if set["ws-read-buffer"] {
+		cfg.WSReadBuffer = *wsReadBuffer
+	}
+	if set["ws-write-buffer"] {
+		cfg.WSWriteBuffer = *wsWriteBuffer
+	}
+	if set["max-message-bytes"] {
+		cfg.MaxMessageBytes = *maxMessage
+	}
+	if set["compress"] {
+		cfg.Compression = *compress
+	}
+	if set["keepalive"] {
+		cfg.Keepalive = *keepalive
+	}
+	if set["heartbeat"] {
+		cfg.Heartbeat = *heartbeat
+	}
+	if set["dial-timeout"] {
+		cfg.DialTimeout = *dialTimeout
+	}
+	if set["idle-timeout"] {
+		cfg.IdleTimeout = *idleTimeout
+	}
+	if set["wait-for-port"] {
+		cfg.WaitForPort = *waitForPort
+	}
+	if set["one-shot"] {
+		cfg.OneShot = *oneShot
+	}
+	if set["retry-delay"] {
+		cfg.Backoff.Initial = *retryDelay
+	}
+	if set["max-retry-delay"] {
+		cfg.Backoff.Max = *maxRetryDelay
+	}
+	if set["max-register-attempts"] {
+		cfg.Backoff.MaxRegisterAttempts = *maxRegisterAttempts
+	}
+	if set["log-level"] {
+		cfg.Log.Level = *logLevel
+	}
+	if set["log-format"] {
+		cfg.Log.Format = *logFormat
+	}
 
-func handleConnection(ctx context.Context, conn *websocket.Conn, targetPort string) {
-	defer conn.Close()
+	logger, err := logging.New(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid logging settings:", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
 
-	log.Printf("Starting local listener on port %s...", targetPort)
-	localListener, err := net.Listen("tcp", ":"+targetPort)
+	tlsConfig, err := clientTLS(cfg)
 	if err != nil {
-		log.Fatalf("Local listener error: %v", err)
-	}
-	defer localListener.Close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			localConn, err := localListener.Accept()
-			if err != nil {
-				log.Println("Local accept error:", err)
-				continue
-			}
+		fmt.Fprintln(os.Stderr, "Invalid TLS settings:", err)
+		os.Exit(2)
+	}
 
-			go forwardTraffic(ctx, localConn, conn)
+	// Tunnels given on the command line replace those in the file.
+	if set["subdomain"] || set["port"] {
+		if len(subdomains) == 0 {
+			subdomains = listFlag{"test"}
+		}
+		if len(targetPorts) == 0 {
+			targetPorts = listFlag{"80"}
+		}
+		if len(subdomains) != len(targetPorts) {
+			fmt.Fprintln(os.Stderr, "Each -subdomain needs a matching -port")
+			os.Exit(2)
+		}
+		cfg.Tunnels = nil
+		for i := range subdomains {
+			cfg.Tunnels = append(cfg.Tunnels, config.AgentTunnel{Subdomain: subdomains[i], Port: targetPorts[i]})
 		}
 	}
-}
+	if len(cfg.Tunnels) == 0 {
+		fmt.Fprintln(os.Stderr, "No tunnels configured")
+		os.Exit(2)
+	}
+	if len(cfg.Tunnels) > 1 && set["domain"] {
+		fmt.Fprintln(os.Stderr, "-domain can only be used with a single tunnel")
+		os.Exit(2)
+	}
+	if _, _, err := net.SplitHostPort(*target); err == nil && len(cfg.Tunnels) > 1 {
+		fmt.Fprintln(os.Stderr, "-target with a port can only be used with a single tunnel")
+		os.Exit(2)
+	}
 
-func forwardTraffic(ctx context.Context, localConn net.Conn, wsConn *websocket.Conn) {
-	defer localConn.Close()
-
-	// Local → WebSocket
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				n, err := localConn.Read(buf)
-				if err != nil {
-					log.Println("Local read error:", err)
-					return
+	// Per-tunnel flags apply to every tunnel.
+	for i := range cfg.Tunnels {
+		t := &cfg.Tunnels[i]
+		if set["type"] || t.Type == "" {
+			t.Type = *tunnelType
+		}
+		if set["basic-auth"] {
+			t.BasicAuth = *basicAuth
+		}
+		if set["domain"] {
+			t.Domain = *domain
+		}
+		if set["target"] {
+			t.Target = *target
+		}
+		if set["host-header"] {
+			t.HostHeader = *hostHeader
+		}
+		if set["max-bytes-per-sec"] {
+			t.MaxBytesPerSec = *maxBandwidth
+		}
+		if set["max-in-flight"] {
+			t.MaxInFlight = *maxInFlight
+		}
+		if set["max-queued"] {
+			t.MaxQueued = *maxQueued
+		}
+		if set["wildcard"] {
+			t.Wildcard = *wildcard
+		}
+		if set["cache-bytes"] {
+			t.CacheBytes = *cacheBytes
+		}
+		if set["fallback"] {
+			t.Fallback = *fallback
+		}
+		if set["allow-cidr"] {
+			t.AllowCIDRs = allowCIDRs
+		}
+		if set["deny-cidr"] {
+			t.DenyCIDRs = denyCIDRs
+		}
+		if set["response-header"] {
+			t.RespHeaders = make(map[string]string, len(responseHeaders))
+			for _, h := range responseHeaders {
+				name, value, ok := strings.Cut(h, ":")
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Invalid -response-header %q: want \"Name: value\"\n", h)
+					os.Exit(2)
 				}
-
-				if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					log.Println("WebSocket write error:", err)
-					return
+				t.RespHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+		}
+		if set["remove-response-header"] {
+			t.RemoveHeaders = removeHeaders
+		}
+		if set["route"] {
+			t.Routes = make(map[string]string, len(routes))
+			for _, r := range routes {
+				prefix, port, ok := strings.Cut(r, "=")
+				if !ok {
+					fmt.Fprintf(os.Stderr, "Invalid -route %q: want \"/prefix=port\"\n", r)
+					os.Exit(2)
 				}
+				t.Routes[prefix] = port
 			}
 		}
-	}()
-
-	// WebSocket → Local
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			_, msg, err := wsConn.ReadMessage()
-			if err != nil {
-				log.Println("WebSocket read error:", err)
-				return
+	}
+
+	// A bad port would only show up as every request failing with 502.
+	for _, t := range cfg.Tunnels {
+		if t.Fallback != "" && t.Fallback != "random" && t.Fallback != "sequential" {
+			fmt.Fprintf(os.Stderr, "Invalid fallback %q for tunnel %s: must be random or sequential\n", t.Fallback, t.Subdomain)
+			os.Exit(2)
+		}
+		port := t.Port
+		if _, p, err := net.SplitHostPort(t.Target); err == nil {
+			port = p
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			fmt.Fprintf(os.Stderr, "Invalid port %q for tunnel %s: must be a number between 1 and 65535\n", port, t.Subdomain)
+			os.Exit(2)
+		}
+		for prefix, port := range t.Routes {
+			if !strings.HasPrefix(prefix, "/") {
+				fmt.Fprintf(os.Stderr, "Invalid route %q for tunnel %s: the path prefix must start with /\n", prefix, t.Subdomain)
+				os.Exit(2)
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				fmt.Fprintf(os.Stderr, "Invalid port %q for route %s of tunnel %s: must be a number between 1 and 65535\n", port, prefix, t.Subdomain)
+				os.Exit(2)
 			}
+		}
+	}
+
+	return &options{cfg: cfg, tls: tlsConfig, logger: logger, check: *check}
+}
+
+// clients returns a client for every configured tunnel.
+func (o *options) clients() []*tunnel.Client {
+	cfg := o.cfg
+	var clients []*tunnel.Client
+	for _, t := range cfg.Tunnels {
+		// A target with a port takes precedence over the tunnel's port.
+		localHost, localPort := t.Target, t.Port
+		if host, port, err := net.SplitHostPort(t.Target); err == nil {
+			localHost, localPort = host, port
+		}
+
+		tunnelLogger := o.logger
+		if len(cfg.Tunnels) > 1 {
+			tunnelLogger = o.logger.With("tunnel", t.Subdomain)
+		}
+		clients = append(clients, tunnel.New(tunnel.Config{
+			TunnelURL:       cfg.Proxy,
+			RegisterURL:     cfg.Register,
+			BaseDomain:      cfg.BaseDomain,
+			APIKey:          cfg.APIKey,
+			APIKeyFile:      cfg.APIKeyFile,
+			Subdomain:       t.Subdomain,
+			LocalPort:       localPort,
+			LocalHost:       localHost,
+			Routes:          t.Routes,
+			Type:            t.Type,
+			BasicAuth:       t.BasicAuth,
+			Domain:          t.Domain,
+			MaxBytesPerSec:  t.MaxBytesPerSec,
+			MaxInFlight:     t.MaxInFlight,
+			MaxQueued:       t.MaxQueued,
+			AllowCIDRs:      t.AllowCIDRs,
+			Wildcard:        t.Wildcard,
+			CacheBytes:      t.CacheBytes,
+			Fallback:        t.Fallback,
+			DenyCIDRs:       t.DenyCIDRs,
+			RespHeaders:     t.RespHeaders,
+			RemoveHeaders:   t.RemoveHeaders,
+			BufferSize:      cfg.BufferSize,
+			Compression:     cfg.Compression,
+			WSReadBuffer:    cfg.WSReadBuffer,
+			WSWriteBuffer:   cfg.WSWriteBuffer,
+			MaxMessageBytes: cfg.MaxMessageBytes,
+			HostHeader:      t.HostHeader,
+			Keepalive:       cfg.Keepalive,
+			Heartbeat:       cfg.Heartbeat,
+			DialTimeout:     cfg.DialTimeout,
+			IdleTimeout:     cfg.IdleTimeout,
+			WaitForPort:     cfg.WaitForPort,
+			OneShot:         cfg.OneShot,
+			TLSConfig:       o.tls,
+			RetryDelay:      cfg.Backoff.Initial,
+			MaxRetryDelay:   cfg.Backoff.Max,
+			MaxAttempts:     cfg.Backoff.MaxRegisterAttempts,
+			Logger:          tunnelLogger,
+		}))
+	}
+	return clients
+}
 
-			if _, err := localConn.Write(msg); err != nil {
-				log.Println("Local write error:", err)
-				return
+// run serves every configured tunnel until interrupted, or with -check
+// only verifies that each could be established.
+func run(args []string) {
+	opts := parseFlags("run", args)
+	opts.logger.Info("expose-local agent", version.LogAttrs()...)
+
+	// Graceful shutdown handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Every mapping registers, connects and backs off on its own; one
+	// failing tunnel does not take the others down.
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, client := range opts.clients() {
+		if opts.check {
+			if err := client.Check(ctx); err != nil {
+				fmt.Printf("%s: FAILED: %v\n", client.Subdomain(), err)
+				failed.Store(true)
+			} else {
+				fmt.Printf("%s: OK, would serve %s\n", client.Subdomain(), client.PublicURL())
 			}
+			continue
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Start(ctx); err != nil {
+				opts.logger.Error("Agent stopped", "tunnel", client.Subdomain(), "err", err)
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		os.Exit(1)
 	}
 }
 
-func increaseDelay(currentDelay, max time.Duration) time.Duration {
-	next := currentDelay * 2
-	if next > max {
-		return max
+// clientTLS loads the client certificate and server roots, returning nil
+// when neither is configured.
+func clientTLS(cfg *config.Agent) (*tls.Config, error) {
+	if cfg.TLS.Cert == "" && cfg.TLS.Key == "" && cfg.TLS.CA == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.TLS.Cert != "" || cfg.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLS.CA != "" {
+		data, err := os.ReadFile(cfg.TLS.CA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.TLS.CA)
+		}
+		tlsConfig.RootCAs = roots
 	}
-	return next
+	return tlsConfig, nil
+}
+
+// listFlag collects every occurrence of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogger writes one line per proxied request.
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // Nil for stdout
+	json   bool
+}
+
+// newAccessLogger opens the destination named by path: "-" is stdout and
+// anything else a file that is appended to. format is "combined" or "json".
+func newAccessLogger(path, format string) (*accessLogger, error) {
+	l := &accessLogger{}
+	switch strings.ToLower(format) {
+	case "", "combined":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.w, l.closer = f, f
+	return l, nil
+}
+
+// Close releases the log file, if any.
+func (l *accessLogger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// accessEntry is everything recorded about one request.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Subdomain string    `json:"subdomain"`
+	Duration  float64   `json:"duration_ms"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func (l *accessLogger) write(e *accessEntry) {
+	var line []byte
+	if l.json {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// combined renders the entry in Apache Combined Log Format followed by the
+// subdomain, the duration in milliseconds and the request ID.
+func (e *accessEntry) combined() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %s %.3f %s\n",
+		e.ClientIP,
+		orDash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeQuotes(e.Path), e.Proto,
+		e.Status, bytes,
+		escapeQuotes(orDash(e.Referer)),
+		escapeQuotes(orDash(e.UserAgent)),
+		e.Subdomain, e.Duration, orDash(e.RequestID),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// logAccess records every request served by next. The user and client
+// address are captured first since the handler may strip Authorization.
+func (s *Server) logAccess(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		user, _, _ := r.BasicAuth()
+		e := &accessEntry{
+			Time:      start,
+			ClientIP:  s.clientIP(r),
+			User:      user,
+			Method:    r.Method,
+			Path:      r.RequestURI,
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			RequestID: r.Header.Get(requestIDHeader),
+		}
+		_, e.Subdomain, _, _ = s.route(r)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		e.Status = rec.Status()
+		e.Bytes = rec.Bytes()
+		e.Duration = float64(time.Since(start).Microseconds()) / 1000
+		s.accessLog.write(e)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+)
+
+// identify authenticates an agent or operator request. Depending on
+// auth.mode that is the verified client certificate, the API key, or the
+// certificate when one was presented and the key otherwise. Without a key
+// an "Authorization: Bearer" token, such as a JWT, stands in for it. On
+// failure it answers the request itself: 401 for bad credentials, 503 when
+// the auth backend cannot be reached.
+func (s *Server) identify(w http.ResponseWriter, r *http.Request, apiKey string) (*Identity, bool) {
+	id, err := s.authenticate(r, apiKey)
+	switch {
+	case errors.Is(err, errUnauthorized):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case err != nil:
+		http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+	}
+	return id, err == nil
+}
+
+// authenticate is identify without the answer: it fails with
+// errUnauthorized for bad credentials and with any other error when the
+// auth backend cannot be reached.
+func (s *Server) authenticate(r *http.Request, apiKey string) (*Identity, error) {
+	if apiKey == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			apiKey = strings.TrimSpace(token)
+		}
+	}
+	mode := s.cfg.Auth.Mode
+	if mode == config.AuthMTLS || mode == config.AuthEither {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if id, ok := s.certIdentity(r.TLS.VerifiedChains[0][0]); ok {
+				return id, nil
+			}
+			return nil, errUnauthorized
+		}
+		if mode == config.AuthMTLS {
+			return nil, errUnauthorized
+		}
+	}
+
+	id, err := s.auth.Authenticate(r.Context(), apiKey)
+	if err != nil && !errors.Is(err, errUnauthorized) {
+		slog.Error("Auth backend failed", "remote_addr", r.RemoteAddr, "err", err)
+	}
+	return id, err
+}
+
+// certIdentity maps a verified certificate to the first auth.clients entry
+// naming its common name or one of its DNS SANs.
+func (s *Server) certIdentity(cert *x509.Certificate) (*Identity, bool) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for i := range s.clients {
+		for _, name := range names {
+			if name != "" && name == s.clients[i].Name {
+				return &s.clients[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// loadClientCAs reads the PEM bundle that agent certificates must chain to.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// basicAuth protects a tunnel with a username and a salted password hash.
+type basicAuth struct {
+	user string
+	salt []byte
+	hash [sha256.Size]byte
+}
+
+func newBasicAuth(user, pass string) (*basicAuth, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &basicAuth{user: user, salt: salt, hash: hashPassword(salt, pass)}, nil
+}
+
+func hashPassword(salt []byte, pass string) [sha256.Size]byte {
+	return sha256.Sum256(append(append([]byte{}, salt...), pass...))
+}
+
+// check verifies the request's Basic credentials in constant time.
+func (a *basicAuth) check(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash := hashPassword(a.salt, pass)
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passOK := subtle.ConstantTimeCompare(hash[:], a.hash[:]) == 1
+	return userOK && passOK
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+)
+
+// errUnauthorized is returned by an Authenticator that does not know the key.
+var errUnauthorized = errors.New("unauthorized")
+
+// Identity is who an API key or client certificate belongs to and what it
+// may do.
+type Identity struct {
+	Owner      string   `json:"owner"`      // Stable ID; tunnels may only be reclaimed by the same owner
+	Name       string   `json:"name"`       // For logs
+	Subdomains []string `json:"subdomains"` // Glob patterns; empty allows any subdomain
+	Admin      bool     `json:"admin"`      // May use the operator endpoints
+}
+
+// Allows reports whether the identity may register the given subdomain.
+func (id *Identity) Allows(subdomain string) bool {
+	if len(id.Subdomains) == 0 {
+		return true
+	}
+	for _, pattern := range id.Subdomains {
+		if ok, _ := path.Match(pattern, subdomain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator resolves API keys. It returns errUnauthorized for keys it
+// rejects and any other error when it cannot decide, e.g. because a
+// remote service is down.
+type Authenticator interface {
+	Authenticate(ctx context.Context, apiKey string) (*Identity, error)
+}
+
+// newAuthenticator builds the backend selected by auth.backend.
+func newAuthenticator(cfg *config.Config) (Authenticator, error) {
+	switch cfg.Auth.Backend {
+	case "", "static":
+		return NewStaticAuthenticator(cfg.Auth.Keys), nil
+	case "webhook":
+		return NewWebhookAuthenticator(cfg.Auth.Webhook.URL, cfg.Auth.Webhook.Timeout, cfg.Auth.Webhook.CacheTTL), nil
+	case "jwt":
+		j := cfg.Auth.JWT
+		return NewJWTAuthenticator(JWTOptions{
+			PublicKey:       j.PublicKey,
+			JWKSURL:         j.JWKSURL,
+			Issuer:          j.Issuer,
+			Audience:        j.Audience,
+			SubdomainsClaim: j.SubdomainsClaim,
+			AdminClaim:      j.AdminClaim,
+			Leeway:          j.Leeway,
+		})
+	default:
+		return nil, fmt.Errorf("unknown auth.backend %q", cfg.Auth.Backend)
+	}
+}
+
+// StaticAuthenticator checks keys against a fixed list from the config.
+type StaticAuthenticator struct {
+	keys []config.KeyInfo
+}
+
+// NewStaticAuthenticator accepts exactly the given keys.
+func NewStaticAuthenticator(keys []config.KeyInfo) *StaticAuthenticator {
+	return &StaticAuthenticator{keys: keys}
+}
+
+// Authenticate looks up the key, comparing in constant time.
+func (a *StaticAuthenticator) Authenticate(_ context.Context, apiKey string) (*Identity, error) {
+	if apiKey == "" {
+		return nil, errUnauthorized
+	}
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(apiKey)) == 1 {
+			return &Identity{Owner: k.Key, Name: k.Name, Subdomains: k.Subdomains, Admin: k.Admin}, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// WebhookAuthenticator asks an external service about each key:
+//
+//	POST <url>  {"api_key": "..."}
+//
+// A 200 answer carries the identity as {"owner", "name", "subdomains",
+// "admin"}; 401 or 403 rejects the key. Both outcomes are cached for
+// cacheTTL so that every request does not cost a round trip.
+type WebhookAuthenticator struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]webhookResult
+}
+
+type webhookResult struct {
+	id      *Identity // Nil when the key was rejected
+	expires time.Time
+}
+
+// webhookCacheLimit bounds the cache. Expired entries are swept once it
+// fills, and new keys go uncached while it stays full.
+const webhookCacheLimit = 10000
+
+// NewWebhookAuthenticator checks keys against url. Zero timeout and
+// cacheTTL default to 5s and 1m.
+func NewWebhookAuthenticator(url string, timeout, cacheTTL time.Duration) *WebhookAuthenticator {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if cacheTTL <= 0 {
+		cacheTTL = time.Minute
+	}
+	return &WebhookAuthenticator{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    make(map[[sha256.Size]byte]webhookResult),
+	}
+}
+
+// Authenticate answers from the cache or asks the webhook.
+func (a *WebhookAuthenticator) Authenticate(ctx context.Context, apiKey string) (*Identity, error) {
+	if apiKey == "" {
+		return nil, errUnauthorized
+	}
+	// Keys are cached by hash so the map does not hold them in the clear.
+	sum := sha256.Sum256([]byte(apiKey))
+	now := time.Now()
+
+	a.mu.Lock()
+	res, ok := a.cache[sum]
+	a.mu.Unlock()
+	if ok && now.Before(res.expires) {
+		if res.id == nil {
+			return nil, errUnauthorized
+		}
+		return res.id, nil
+	}
+
+	id, err := a.ask(ctx, apiKey)
+	if err != nil && !errors.Is(err, errUnauthorized) {
+		return nil, err // Not cached; the next request tries again
+	}
+	if id != nil && id.Owner == "" {
+		id.Owner = "webhook:" + hex.EncodeToString(sum[:])
+	}
+
+	a.mu.Lock()
+	if len(a.cache) >= webhookCacheLimit {
+		for k, v := range a.cache {
+			if now.After(v.expires) {
+				delete(a.cache, k)
+			}
+		}
+	}
+	if _, cached := a.cache[sum]; cached || len(a.cache) < webhookCacheLimit {
+		a.cache[sum] = webhookResult{id: id, expires: now.Add(a.cacheTTL)}
+	}
+	a.mu.Unlock()
+	return id, err
+}
+
+func (a *WebhookAuthenticator) ask(ctx context.Context, apiKey string) (*Identity, error) {
+	body, _ := json.Marshal(map[string]string{"api_key": apiKey})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errUnauthorized
+	default:
+		return nil, fmt.Errorf("auth webhook: unexpected status %d", resp.StatusCode)
+	}
+
+	var id Identity
+	if err := json.NewDecoder(io.LimitReader(resp.Body, defaultMaxBodyBytes)).Decode(&id); err != nil {
+		return nil, fmt.Errorf("auth webhook: invalid response: %w", err)
+	}
+	return &id, nil
+}
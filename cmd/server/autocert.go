@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/tls"
+	"slices"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager returns a Let's Encrypt manager for the configured names.
+// Certificates are issued on the first TLS handshake for each name, using
+// TLS-ALPN-01 on the TLS listeners or HTTP-01 on tls.http_addr.
+func newCertManager(cfg *config.Config) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Server.TLS.Domains...),
+		Email:      cfg.Server.TLS.Email,
+	}
+	if cfg.Server.TLS.CacheDir != "" {
+		m.Cache = autocert.DirCache(cfg.Server.TLS.CacheDir)
+	}
+	return m
+}
+
+// withoutH2 drops h2 from the ALPN list for servers that have HTTP/2
+// turned off, so clients do not negotiate a protocol nobody speaks.
+func withoutH2(cfg *tls.Config) *tls.Config {
+	cfg.NextProtos = slices.DeleteFunc(slices.Clone(cfg.NextProtos), func(p string) bool { return p == "h2" })
+	return cfg
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// maxBackendRoutes bounds the path rules one registration may carry.
+const maxBackendRoutes = 32
+
+// backendRoute sends requests under a path prefix to another of the
+// agent's local ports, e.g. /api to the API while the tunnel's own port
+// serves the frontend.
+type backendRoute struct {
+	prefix string // "/api" matches /api and /api/..., not /apix
+	target *url.URL
+}
+
+// newBackendRoutes validates path prefix to port rules from a registration.
+// The ports are on targetHost, like the tunnel's own. The routes come back
+// longest prefix first, so the most specific one wins.
+func newBackendRoutes(rules map[string]string, targetHost string) ([]backendRoute, error) {
+	if len(rules) > maxBackendRoutes {
+		return nil, fmt.Errorf("at most %d routes", maxBackendRoutes)
+	}
+	routes := make([]backendRoute, 0, len(rules))
+	for prefix, port := range rules {
+		if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?# \t\r\n") {
+			return nil, fmt.Errorf("path prefix %q must start with / and not contain a query", prefix)
+		}
+		if err := validatePort(port); err != nil {
+			return nil, fmt.Errorf("%s: %w", prefix, err)
+		}
+		target, _ := url.Parse("http://" + net.JoinHostPort(targetHost, port))
+		routes = append(routes, backendRoute{prefix: strings.TrimSuffix(prefix, "/"), target: target})
+	}
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	for i := 1; i < len(routes); i++ {
+		if routes[i].prefix == routes[i-1].prefix {
+			return nil, errors.New("duplicate path prefix " + routes[i].prefix)
+		}
+	}
+	return routes, nil
+}
+
+// targetFor returns the backend for a request path: the route with the
+// longest matching prefix, else the tunnel's target.
+func (t *Tunnel) targetFor(path string) *url.URL {
+	for _, r := range t.routes {
+		if r.prefix == "" || path == r.prefix || strings.HasPrefix(path, r.prefix+"/") {
+			return r.target
+		}
+	}
+	return t.target
+}
+
+// routeMap turns the routes back into registration form, nil without any.
+func (t *Tunnel) routeMap() map[string]string {
+	if len(t.routes) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(t.routes))
+	for _, r := range t.routes {
+		prefix := r.prefix
+		if prefix == "" {
+			prefix = "/"
+		}
+		m[prefix] = r.target.Port()
+	}
+	return m
+}
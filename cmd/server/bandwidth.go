@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// minBandwidthBurst lets a throttled stream move at least one copy buffer
+// per wait, so low limits do not degrade into tiny reads and writes.
+const minBandwidthBurst = 32 * 1024
+
+// newBandwidthLimiter returns a limiter allowing bytesPerSec; 0 is unlimited.
+// A limiter is created either way so the cap can be changed later.
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	lim := rate.NewLimiter(rate.Inf, 0)
+	setBandwidth(lim, bytesPerSec)
+	return lim
+}
+
+// setBandwidth changes the limit; streams already open pick it up at once.
+func setBandwidth(lim *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		lim.SetLimit(rate.Inf)
+		return
+	}
+	lim.SetBurst(int(max(bytesPerSec, minBandwidthBurst)))
+	lim.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// bandwidthLimit reports the current limit in bytes per second, 0 if none.
+func bandwidthLimit(lim *rate.Limiter) int64 {
+	if lim == nil || lim.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(lim.Limit())
+}
+
+// throttle wraps a stream so it shares the tunnel's bandwidth cap.
+func (t *Tunnel) throttle(conn net.Conn) net.Conn {
+	if t.bandwidth == nil {
+		return conn
+	}
+	return throttledConn{Conn: conn, lim: t.bandwidth}
+}
+
+// throttledConn charges every byte read or written against a limiter.
+type throttledConn struct {
+	net.Conn
+	lim *rate.Limiter
+}
+
+func (c throttledConn) Read(b []byte) (int, error) {
+	if burst := c.lim.Burst(); burst > 0 && len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lim.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (c throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if burst := c.lim.Burst(); burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		c.lim.WaitN(context.Background(), len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// handleSetBandwidth lets an admin change a tunnel's cap without
+// re-registering it.
+func (s *Server) handleSetBandwidth(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.identify(w, r, r.Header.Get("X-API-Key"))
+	if !ok {
+		return
+	}
+	if !key.Admin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		MaxBytesPerSec int64 `json:"max_bytes_per_sec"`
+	}
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	if req.MaxBytesPerSec < 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	subdomain := mux.Vars(r)["subdomain"]
+	t, exists := s.registry.Get(subdomain)
+	if !exists || t.bandwidth == nil {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	setBandwidth(t.bandwidth, req.MaxBytesPerSec)
+	s.registry.Save()
+
+	slog.Info("Tunnel bandwidth changed", "subdomain", subdomain, "max_bytes_per_sec", req.MaxBytesPerSec)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dialErrorHeader marks responses the agent made up because it could not
+// reach the local service, as opposed to errors from the service itself.
+const dialErrorHeader = "X-Tunnel-Error"
+
+// breaker stops sending requests to a backend that keeps failing. After
+// threshold consecutive failures it opens and requests are refused at once
+// for cooldown; then a single probe is let through, which closes the
+// breaker again if it succeeds and reopens it if not.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // Zero while closed
+	probing   time.Time // When the current probe was let through; zero if none
+}
+
+// newBreaker returns the breaker for a new tunnel, or nil when
+// proxy.circuit_breaker is off.
+func (s *Server) newBreaker() *breaker {
+	cb := s.cfg.Proxy.CircuitBreaker
+	if cb.Failures <= 0 {
+		return nil
+	}
+	cooldown := cb.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &breaker{threshold: cb.Failures, cooldown: cooldown}
+}
+
+// allow reports whether a request may go ahead and, if not, how long until
+// the next probe.
+func (b *breaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true, 0
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false, b.openUntil.Sub(now)
+	}
+	// A probe that never reported back, e.g. because the visitor went
+	// away, must not keep the breaker half-open forever.
+	if !b.probing.IsZero() && now.Sub(b.probing) < b.cooldown {
+		return false, b.cooldown - now.Sub(b.probing)
+	}
+	b.probing = now
+	return true, 0
+}
+
+// success closes the breaker.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = time.Time{}
+}
+
+// failure counts a failed request and reports whether it opened the breaker.
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = time.Time{}
+	if b.failures < b.threshold {
+		return false
+	}
+	opened := b.openUntil.IsZero()
+	b.openUntil = time.Now().Add(b.cooldown)
+	return opened
+}
+
+// recordResponse feeds a backend response into the breaker and strips the
+// agent's marker so visitors never see it.
+func (t *Tunnel) recordResponse(resp *http.Response) {
+	failed := resp.Header.Get(dialErrorHeader) != ""
+	resp.Header.Del(dialErrorHeader)
+	if failed {
+		t.backendFailed()
+	} else if t.breaker != nil {
+		t.breaker.success()
+	}
+}
+
+// backendFailed counts a request the backend could not answer.
+func (t *Tunnel) backendFailed() {
+	if t.breaker != nil && t.breaker.failure() {
+		circuitBreakerTrips.Inc()
+		slog.Warn("Backend keeps failing, refusing requests for a while", "subdomain", t.Subdomain, "cooldown", t.breaker.cooldown)
+	}
+}
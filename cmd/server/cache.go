@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheHeader tells visitors whether a response came from the tunnel's
+// cache, HIT, or from the backend, MISS.
+const cacheHeader = "X-Cache"
+
+// responseCache keeps cacheable GET responses from a tunnel's backend in
+// memory, so repeat requests for static assets skip the round trip over the
+// tunnel. Only responses with a freshness lifetime or a validator are kept;
+// the least recently used go first once the cache holds max bytes.
+type responseCache struct {
+	max int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element // Of *cacheEntry, by cacheKey
+	lru     *list.List               // Most recently used at the front
+}
+
+// cacheEntry is one stored response.
+type cacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	vary    http.Header // Request headers the response varies on, as they were
+	stored  time.Time
+	expires time.Time // Served without asking the backend until then
+}
+
+// newResponseCache returns a cache of at most max bytes, or nil if max is
+// not positive.
+func newResponseCache(max int64) *responseCache {
+	if max <= 0 {
+		return nil
+	}
+	return &responseCache{max: max, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// limit returns the cache's size cap; 0 for no cache.
+func (c *responseCache) limit() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.max
+}
+
+// cacheKey identifies a response by method, host and path with query. The
+// host is part of it because wildcard and custom domain tunnels may serve
+// different content per name.
+func cacheKey(method string, r *http.Request) string {
+	return method + " " + r.Host + r.URL.RequestURI()
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, vs := range e.header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// validators returns the conditional request headers that ask the backend
+// whether e is still current; none if e has no validator.
+func (e *cacheEntry) validators() http.Header {
+	h := http.Header{}
+	if etag := e.header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lm := e.header.Get("Last-Modified"); lm != "" {
+		h.Set("If-Modified-Since", lm)
+	}
+	return h
+}
+
+// get returns the entry stored for r, fresh or not, if r matches the
+// request headers it varies on.
+func (c *responseCache) get(r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey(r.Method, r)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	for name, values := range e.vary {
+		if strings.Join(r.Header.Values(name), ", ") != strings.Join(values, ", ") {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// put stores e, replacing any entry under its key, and evicts the least
+// recently used entries until the cache fits.
+func (c *responseCache) put(e *cacheEntry) {
+	size := e.size()
+	if size > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(e.key)
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += size
+	for c.size > c.max {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops whatever is stored under key.
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *responseCache) removeLocked(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.size -= el.Value.(*cacheEntry).size()
+	}
+}
+
+// revalidated turns resp, a 304 confirming e, into the stored response
+// with the 304's updated headers, and stores those with e.
+func (c *responseCache) revalidated(e *cacheEntry, resp *http.Response) {
+	e = c.refresh(e, resp)
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Header = e.header.Clone()
+	resp.Header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	resp.Header.Set(cacheHeader, "HIT")
+	resp.Body = io.NopCloser(bytes.NewReader(e.body))
+	resp.ContentLength = int64(len(e.body))
+}
+
+// refresh updates e with the headers of a 304 that confirmed it, returning
+// the entry to serve. An entry the 304 makes uncacheable is dropped.
+func (c *responseCache) refresh(e *cacheEntry, resp *http.Response) *cacheEntry {
+	updated := *e
+	updated.header = e.header.Clone()
+	for _, h := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if v := resp.Header.Values(h); len(v) > 0 {
+			updated.header[h] = v
+		}
+	}
+	now := time.Now()
+	ttl, ok := freshnessLifetime(updated.header, now)
+	if !ok {
+		c.invalidate(e.key)
+		return &updated
+	}
+	updated.stored, updated.expires = now, now.Add(ttl)
+	c.put(&updated)
+	return &updated
+}
+
+// cacheableRequest reports whether r may be answered from the cache or its
+// response stored. Requests with credentials and upgrades never are.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// wantsRevalidation reports whether the visitor asked not to be served a
+// stored response without checking with the backend, as browsers do on
+// reload.
+func wantsRevalidation(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	_, noCache := cc["no-cache"]
+	return noCache || cc["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+}
+
+// cacheControl parses the Cache-Control directives in h, lower-cased, to
+// their unquoted values.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// freshnessLifetime returns how long a response with header h may be
+// served without revalidation, and whether a shared cache may store it at
+// all. Responses without an explicit lifetime are stored only if they
+// carry a validator, and are then revalidated on every use.
+func freshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	validated := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+
+	var ttl time.Duration
+	if _, ok := cc["no-cache"]; ok {
+		return 0, validated
+	}
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if exp := h.Get("Expires"); exp != "" {
+		// An invalid Expires, such as 0, means already expired.
+		if t, err := http.ParseTime(exp); err == nil {
+			date := now
+			if d, err := http.ParseTime(h.Get("Date")); err == nil {
+				date = d
+			}
+			ttl = t.Sub(date)
+		}
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, ttl > 0 || validated
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(min(n, int64(365*24*time.Hour/time.Second))) * time.Second
+}
+
+// newCacheEntry prepares resp, the answer to r, for storing, or returns nil
+// if it must not be stored. Only complete 200 responses qualify.
+func (c *responseCache) newCacheEntry(r *http.Request, resp *http.Response) *cacheEntry {
+	if resp.StatusCode != http.StatusOK || r.Header.Get("Range") != "" || resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	if resp.ContentLength > c.max {
+		return nil
+	}
+	now := time.Now()
+	ttl, ok := freshnessLifetime(resp.Header, now)
+	if !ok {
+		return nil
+	}
+	vary := http.Header{}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+			}
+		}
+	}
+	return &cacheEntry{
+		key:     cacheKey(r.Method, r),
+		header:  resp.Header.Clone(),
+		vary:    vary,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// capture stores the response to r once its body has been read to the
+// end by the visitor, unless it turns out larger than the cache.
+func (c *responseCache) capture(r *http.Request, resp *http.Response) {
+	e := c.newCacheEntry(r, resp)
+	if e == nil {
+		return
+	}
+	resp.Body = &captureBody{ReadCloser: resp.Body, limit: c.max, done: func(body []byte) {
+		if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+			return
+		}
+		e.body = body
+		c.put(e)
+	}}
+}
+
+// captureBody copies what is read through it, up to limit bytes, and hands
+// the copy to done on a clean EOF.
+type captureBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+	done  func([]byte)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+// serveCached answers r from e, with 304 when the visitor's own copy is
+// still current.
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	h.Set(cacheHeader, "HIT")
+	if notModified(r, e.header) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// notModified evaluates the visitor's If-None-Match, or failing that
+// If-Modified-Since, against a stored response's validators.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// unsafeMethod reports whether method may change the resource, so that
+// stored copies of it are stale.
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+)
+
+// headerForwardedBy marks a request one replica passed to another, naming
+// the sender. A replica never passes such a request on again, so replicas
+// that disagree about an owner cannot bounce it between them.
+const headerForwardedBy = "X-Tunnel-Forwarded-By"
+
+// ownerTTL is how long a replica's claim on a tunnel lasts unless renewed.
+// The janitor renews claims well within it; a replica that dies stops
+// receiving forwarded requests once its claims lapse.
+const ownerTTL = 3 * janitorInterval
+
+// TunnelDirectory records which replica holds the agent connection of each
+// tunnel, so that a replica without it can pass requests on. A server
+// running alone has none.
+type TunnelDirectory interface {
+	// Claim records node as the holder of name until ttl has passed.
+	Claim(ctx context.Context, name, node string, ttl time.Duration) error
+	// Owner returns the node holding name; ok is false if none does.
+	Owner(ctx context.Context, name string) (node string, ok bool, err error)
+	// Release drops node's claim on name. A claim since taken over by
+	// another node is left alone.
+	Release(ctx context.Context, name, node string) error
+}
+
+// storeDirectory is a TunnelDirectory kept in a TokenStore shared by every
+// replica, under "owner:<name>".
+type storeDirectory struct {
+	store TokenStore
+}
+
+func ownerKey(name string) string {
+	return "owner:" + name
+}
+
+func (d storeDirectory) Claim(ctx context.Context, name, node string, ttl time.Duration) error {
+	return d.store.Save(ctx, ownerKey(name), node, ttl)
+}
+
+func (d storeDirectory) Owner(ctx context.Context, name string) (string, bool, error) {
+	return d.store.Get(ctx, ownerKey(name))
+}
+
+// Release is not atomic: a claim another node makes between the check and
+// the delete is lost until that node renews it.
+func (d storeDirectory) Release(ctx context.Context, name, node string) error {
+	owner, ok, err := d.store.Get(ctx, ownerKey(name))
+	if err != nil || !ok || owner != node {
+		return err
+	}
+	return d.store.Delete(ctx, ownerKey(name))
+}
+
+// cluster is this replica's view of the others. A nil *cluster is a server
+// running alone.
+type cluster struct {
+	node      string // cluster.node_url, how the others reach us
+	directory TunnelDirectory
+	transport http.RoundTripper
+}
+
+// newCluster returns nil unless cluster.node_url is set.
+func newCluster(cfg *config.Config) (*cluster, error) {
+	if cfg.Cluster.NodeURL == "" {
+		return nil, nil
+	}
+	redisURL := cfg.Cluster.RedisURL
+	if redisURL == "" {
+		redisURL = cfg.Auth.TokenStore.RedisURL
+	}
+	store, err := newRedisTokenStore(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{
+		node:      strings.TrimSuffix(cfg.Cluster.NodeURL, "/"),
+		directory: storeDirectory{store: store},
+		transport: http.DefaultTransport,
+	}, nil
+}
+
+// tunnelNames returns the directory names t is found under: its subdomain
+// and any custom domain.
+func tunnelNames(t *Tunnel) []string {
+	names := []string{t.Subdomain}
+	if t.CustomDomain != "" {
+		names = append(names, t.CustomDomain)
+	}
+	return names
+}
+
+// claimTunnel records this replica as the holder of t.
+func (s *Server) claimTunnel(ctx context.Context, t *Tunnel) {
+	if s.cluster == nil {
+		return
+	}
+	for _, name := range tunnelNames(t) {
+		if err := s.cluster.directory.Claim(ctx, name, s.cluster.node, ownerTTL); err != nil {
+			slog.Warn("Failed to record tunnel owner", "name", name, "err", err)
+			return
+		}
+	}
+}
+
+// claimTunnels renews the claims on every tunnel registered here.
+func (s *Server) claimTunnels(ctx context.Context) {
+	if s.cluster == nil {
+		return
+	}
+	for _, t := range s.registry.List() {
+		s.claimTunnel(ctx, t)
+	}
+}
+
+// releaseTunnel drops this replica's claims on t once it is no longer
+// registered here. It runs in the background, as tunnelRemoved holds the
+// registry lock.
+func (s *Server) releaseTunnel(t *Tunnel) {
+	if s.cluster == nil {
+		return
+	}
+	go func() {
+		if cur, ok := s.registry.Get(t.Subdomain); ok && cur != t {
+			return // Registered again meanwhile
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		for _, name := range tunnelNames(t) {
+			if err := s.cluster.directory.Release(ctx, name, s.cluster.node); err != nil {
+				slog.Warn("Failed to release tunnel owner", "name", name, "err", err)
+			}
+		}
+	}()
+}
+
+// releaseTunnels drops the claims on every tunnel registered here, so the
+// other replicas stop sending their requests to a server going away.
+func (s *Server) releaseTunnels(ctx context.Context) {
+	if s.cluster == nil {
+		return
+	}
+	for _, t := range s.registry.List() {
+		for _, name := range tunnelNames(t) {
+			s.cluster.directory.Release(ctx, name, s.cluster.node)
+		}
+	}
+}
+
+// forwardToOwner passes r on to the replica holding the tunnel under one
+// of names, trying them in order, and reports whether it did. Requests a
+// replica forwarded are always handled locally.
+func (s *Server) forwardToOwner(w http.ResponseWriter, r *http.Request, names ...string) bool {
+	if s.cluster == nil || r.Header.Get(headerForwardedBy) != "" {
+		return false
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		node, ok, err := s.cluster.directory.Owner(r.Context(), name)
+		if err != nil {
+			slog.Warn("Failed to look up tunnel owner", "name", name, "err", err)
+			return false
+		}
+		if !ok {
+			continue
+		}
+		if node == s.cluster.node {
+			return false
+		}
+		target, err := url.Parse(node)
+		if err != nil {
+			slog.Warn("Invalid tunnel owner", "name", name, "node", node, "err", err)
+			return false
+		}
+		slog.Debug("Forwarding to tunnel owner", "name", name, "node", node, "path", r.URL.Path)
+		// The owner sets its own headers; ours would be duplicated.
+		clear(w.Header())
+		s.ownerProxy(target).ServeHTTP(w, r)
+		return true
+	}
+	return false
+}
+
+// ownerNames lists the directory names a request for a tunnel not
+// registered here may be held under elsewhere: the custom domain it was
+// sent to, then the subdomain route found in it.
+func (s *Server) ownerNames(r *http.Request, name string) []string {
+	var names []string
+	if host := hostOnly(r.Host); !strings.HasSuffix(host, "."+s.baseDomain()) {
+		names = append(names, host)
+	}
+	// Names below a wildcard tunnel are claimed by the tunnel itself.
+	if i := strings.LastIndexByte(name, '.'); i >= 0 && s.cfg.Proxy.Routing != routePath {
+		name = name[i+1:]
+	}
+	return append(names, name)
+}
+
+// ownerProxy returns a proxy to the replica at target that keeps the
+// original Host and tells it who the visitor is.
+func (s *Server) ownerProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			s.setForwardedHeaders(req, req) // Host, TLS and RemoteAddr are still the visitor's
+			req.Header.Set(headerForwardedBy, s.cluster.node)
+		},
+		Transport:     s.cluster.transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Forwarding to tunnel owner failed", "node", target.String(), "err", err)
+			http.Error(w, "Tunnel's server unreachable", http.StatusBadGateway)
+		},
+	}
+}
+
+// forwardRegistration passes a registration for a subdomain another
+// replica holds on to it, where the reconnect token and the name's current
+// owner can be checked. req has already consumed the body, so it is sent
+// on re-encoded.
+func (s *Server) forwardRegistration(w http.ResponseWriter, r *http.Request, req *RegistrationRequest) bool {
+	if s.cluster == nil || req.Subdomain == "" {
+		return false
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false
+	}
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.GetBody = nil
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return s.forwardToOwner(w, r, req.Subdomain)
+}
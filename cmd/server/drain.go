@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Defaults for POST /admin/drain when the query does not say.
+const (
+	defaultDrainReconnect = 5 * time.Second
+	defaultDrainTimeout   = 30 * time.Second
+)
+
+// drainGrace is how long past its drain timeout an agent gets to hang up
+// before the server closes the session itself.
+const drainGrace = 2 * time.Second
+
+// drainMessage asks an agent to let its streams finish, disconnect, and
+// reconnect after a delay. Agents that predate it ignore it.
+type drainMessage struct {
+	Type           string `json:"type"`            // Always "drain"
+	ReconnectAfter int    `json:"reconnect_after"` // Seconds to wait before reconnecting
+	Timeout        int    `json:"timeout"`         // Seconds in-flight streams get to finish
+}
+
+// handleDrain moves agents off this server without cutting live requests,
+// e.g. before maintenance: every tunnel, or the one named in the path,
+// stops getting new requests and its agent is told to reconnect once its
+// streams are done. Query parameters reconnect_after and timeout take
+// durations such as 30s.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.identify(w, r, r.Header.Get("X-API-Key"))
+	if !ok {
+		return
+	}
+	if !key.Admin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	msg := drainMessage{Type: "drain"}
+	for _, p := range []struct {
+		name string
+		dst  *int
+		def  time.Duration
+	}{
+		{"reconnect_after", &msg.ReconnectAfter, defaultDrainReconnect},
+		{"timeout", &msg.Timeout, defaultDrainTimeout},
+	} {
+		d := p.def
+		if v := r.URL.Query().Get(p.name); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d < 0 {
+				http.Error(w, "Invalid "+p.name+": want a duration such as 30s", http.StatusBadRequest)
+				return
+			}
+		}
+		*p.dst = int(d.Round(time.Second) / time.Second)
+	}
+
+	tunnels := s.registry.List()
+	if subdomain, ok := mux.Vars(r)["subdomain"]; ok {
+		t, exists := s.registry.Get(subdomain)
+		if !exists {
+			http.Error(w, "Tunnel not found", http.StatusNotFound)
+			return
+		}
+		tunnels = []*Tunnel{t}
+	}
+
+	drained := []string{}
+	for _, t := range tunnels {
+		if agent := t.Agent(); agent != nil && s.drainAgent(t.Subdomain, agent, msg) {
+			drained = append(drained, t.Subdomain)
+		}
+	}
+
+	slog.Info("Agents drained by admin", "admin", key.Name, "tunnels", len(drained),
+		"reconnect_after", msg.ReconnectAfter, "timeout", msg.Timeout)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"drained": drained})
+}
+
+// drainAgent stops routing new requests to agent and sends it msg. It
+// reports false if the agent was already draining or has gone. Agents that
+// have not hung up once msg.Timeout and drainGrace have passed, such as
+// ones that ignore the message, are disconnected.
+func (s *Server) drainAgent(subdomain string, agent *agentSession, msg drainMessage) bool {
+	if !agent.draining.CompareAndSwap(false, true) {
+		return false
+	}
+	data, _ := json.Marshal(msg)
+	if err := agent.session.SendControl(data); err != nil {
+		slog.Debug("Drain message not sent", "subdomain", subdomain, "err", err)
+		agent.draining.Store(false)
+		return false
+	}
+
+	// The agent waits for its streams to close, and requests finishing
+	// meanwhile would park theirs in the transport's idle pool.
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		deadline := time.NewTimer(time.Duration(msg.Timeout)*time.Second + drainGrace)
+		defer deadline.Stop()
+		for {
+			agent.transport.CloseIdleConnections()
+			select {
+			case <-ticker.C:
+			case <-deadline.C:
+				slog.Info("Drained agent did not disconnect, closing its session", "subdomain", subdomain)
+				agent.session.CloseWithCode(websocket.CloseGoingAway, "drained")
+				return
+			case <-agent.session.Done():
+				return
+			}
+		}
+	}()
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultErrorPage is shown to browsers when proxy.error_page is unset.
+const defaultErrorPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} {{.StatusText}} · expose-local</title>
+<style>
+body{font-family:system-ui,sans-serif;background:#f6f7f9;color:#1f2933;margin:0;display:flex;min-height:100vh;align-items:center;justify-content:center}
+main{background:#fff;border-radius:8px;box-shadow:0 1px 4px rgba(0,0,0,.08);padding:2.5rem 3rem;max-width:32rem}
+h1{font-size:1.4rem;margin:0 0 .5rem}
+p{line-height:1.5;margin:.5rem 0}
+code{background:#eef0f3;padding:.1rem .35rem;border-radius:4px}
+small{color:#7b8794}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Status}} · {{.Message}}</h1>
+{{if .Subdomain}}<p>Tunnel <code>{{.Subdomain}}</code></p>{{end}}
+{{if .Hint}}<p>{{.Hint}}</p>{{end}}
+<p><small>expose-local</small></p>
+</main>
+</body>
+</html>
+`
+
+// errorPage is what an error page template is rendered with.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Subdomain  string
+	Message    string
+	Hint       string
+}
+
+// loadErrorPage parses proxy.error_page, or the built-in page when path is
+// empty.
+func loadErrorPage(path string) (*template.Template, error) {
+	if path == "" {
+		return template.New("error").Parse(defaultErrorPage)
+	}
+	return template.ParseFiles(path)
+}
+
+// proxyError answers a visitor whose request could not reach the backend.
+// Browsers get the HTML error page; other clients get the message as text.
+func (s *Server) proxyError(w http.ResponseWriter, r *http.Request, code int, subdomain, message, hint string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, message, code)
+		return
+	}
+
+	var buf bytes.Buffer
+	page := errorPage{Status: code, StatusText: http.StatusText(code), Subdomain: subdomain, Message: message, Hint: hint}
+	if err := s.errorPage.Execute(&buf, page); err != nil {
+		slog.Error("Rendering error page failed", "err", err)
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs accepts CIDRs or bare IPs, treating the latter as single hosts.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admits reports whether a visitor at addr may use the tunnel. A deny
+// entry always wins; a non-empty allow list admits only its members.
+func (t *Tunnel) admits(addr string) bool {
+	if len(t.allow) == 0 && len(t.deny) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || containsIP(t.deny, ip) {
+		return false
+	}
+	return len(t.allow) == 0 || containsIP(t.allow, ip)
+}
+
+func (s *Server) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && containsIP(s.trustedProxies, ip)
+}
+
+// remoteIP strips the port from r.RemoteAddr.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the originating client address. X-Forwarded-For is only
+// consulted when the direct peer is a trusted proxy, and then the rightmost
+// hop that is not itself a trusted proxy wins.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !s.isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !s.isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// setForwardedHeaders prepares the X-Forwarded-* headers on the outgoing
+// request. Headers from untrusted peers are discarded; httputil.ReverseProxy
+// then appends the peer address to X-Forwarded-For itself.
+func (s *Server) setForwardedHeaders(out, in *http.Request) {
+	if !s.isTrustedProxy(remoteIP(in)) {
+		out.Header.Del("X-Forwarded-For")
+		out.Header.Del("X-Forwarded-Proto")
+		out.Header.Del("X-Forwarded-Host")
+	}
+
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if in.TLS != nil {
+			proto = "https"
+		}
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+// Values of Tunnel.hostHeader with special meaning.
+const (
+	hostPreserve = "preserve" // Forward the visitor's Host unchanged
+	hostTarget   = "target"   // Use the backend address, e.g. localhost:3000
+)
+
+// rewriteHost sets the Host the backend sees. X-Forwarded-Host still
+// carries the original either way.
+func (t *Tunnel) rewriteHost(out *http.Request) {
+	switch t.hostHeader {
+	case "", hostPreserve:
+	case hostTarget:
+		out.Host = out.URL.Host
+	default:
+		out.Host = t.hostHeader
+	}
+}
+
+// validateHostHeader rejects values that cannot appear in a Host header.
+func validateHostHeader(host string) error {
+	if strings.ContainsAny(host, " \t\r\n/") {
+		return errors.New("must be a host or host:port")
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// securityHeaders adds the headers configured under proxy.security_headers
+// to every tunnel response that does not set them itself.
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+	h := s.cfg.Proxy.SecurityHeaders
+	defaults := http.Header{}
+	if h.NoSniff {
+		defaults.Set("X-Content-Type-Options", "nosniff")
+	}
+	if h.FrameOptions != "" {
+		defaults.Set("X-Frame-Options", h.FrameOptions)
+	}
+	hsts := ""
+	if h.HSTS {
+		hsts = "max-age=" + strconv.Itoa(int(h.HSTSMaxAge.Seconds()))
+		if h.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	if len(defaults) == 0 && hsts == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		add := defaults
+		// Browsers ignore HSTS over plain HTTP, and sending it there would
+		// only mislead.
+		if hsts != "" && s.isHTTPS(r) {
+			add = defaults.Clone()
+			add.Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, add: add}, r)
+	})
+}
+
+// isHTTPS reports whether the visitor connected over TLS, directly or to a
+// trusted proxy in front of us.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return s.isTrustedProxy(remoteIP(r)) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// headerWriter fills in headers the handler, or the backend behind it,
+// left unset by the time the response header is written.
+type headerWriter struct {
+	http.ResponseWriter
+	add         http.Header
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		dst := w.Header()
+		for name, values := range w.add {
+			if dst.Get(name) == "" {
+				dst[name] = values
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Hijack for WebSocket upgrades.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *headerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// headerRules are the response headers a registration asked to set or
+// remove on everything its backend sends back.
+type headerRules struct {
+	set    http.Header
+	remove []string
+}
+
+// framingHeaders describe the connection or message length rather than the
+// content; changing them would corrupt responses.
+var framingHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// newHeaderRules validates a registration's response_headers and
+// remove_response_headers. It returns nil when both are empty.
+func newHeaderRules(set map[string]string, remove []string) (*headerRules, error) {
+	if len(set) == 0 && len(remove) == 0 {
+		return nil, nil
+	}
+	rules := &headerRules{set: http.Header{}}
+	for name, value := range set {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("value of %s contains a line break", name)
+		}
+		rules.set.Set(name, value)
+	}
+	for _, name := range remove {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		rules.remove = append(rules.remove, http.CanonicalHeaderKey(name))
+	}
+	return rules, nil
+}
+
+func checkHeaderName(name string) error {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) >= 0 {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if framingHeaders[http.CanonicalHeaderKey(name)] {
+		return fmt.Errorf("%s cannot be changed", http.CanonicalHeaderKey(name))
+	}
+	return nil
+}
+
+// apply removes, then sets, headers on a backend response.
+func (h *headerRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.remove {
+		header.Del(name)
+	}
+	for name, values := range h.set {
+		header[name] = values
+	}
+}
+
+// setMap and removeList return the rules in registration form.
+func (h *headerRules) setMap() map[string]string {
+	if h == nil || len(h.set) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(h.set))
+	for name := range h.set {
+		m[name] = h.set.Get(name)
+	}
+	return m
+}
+
+func (h *headerRules) removeList() []string {
+	if h == nil {
+		return nil
+	}
+	return h.remove
+}
+
+// Defaults for proxy.transport.max_header_bytes and max_headers.
+const (
+	defaultTunnelHeaderBytes = 1 << 20
+	defaultTunnelHeaders     = 200
+)
+
+// headerLimits bound the header blocks carried over a tunnel in either
+// direction, so that a backend answering with endless headers cannot make
+// the server hold them all in memory.
+type headerLimits struct {
+	bytes int // Names and values, with ": " and CRLF for each field
+	count int // Fields; a name sent with several values counts once for each
+}
+
+func (s *Server) headerLimits() headerLimits {
+	l := headerLimits{bytes: s.cfg.Proxy.Transport.MaxHeaderBytes, count: s.cfg.Proxy.Transport.MaxHeaders}
+	if l.bytes <= 0 {
+		l.bytes = defaultTunnelHeaderBytes
+	}
+	if l.count <= 0 {
+		l.count = defaultTunnelHeaders
+	}
+	return l
+}
+
+// headerLimitError is a header block over one of the limits; its message
+// says which, as "<what was sent>, more than the <limit> allowed".
+type headerLimitError struct {
+	reason string
+}
+
+func (e *headerLimitError) Error() string {
+	return e.reason
+}
+
+// check returns a *headerLimitError if h has more fields or bytes than l
+// allows.
+func (l headerLimits) check(h http.Header) error {
+	count, size := 0, 0
+	for name, values := range h {
+		for _, v := range values {
+			count++
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+	if count > l.count {
+		return &headerLimitError{fmt.Sprintf("%d header fields, more than the %d allowed", count, l.count)}
+	}
+	if size > l.bytes {
+		return &headerLimitError{fmt.Sprintf("%d bytes of headers, more than the %d allowed", size, l.bytes)}
+	}
+	return nil
+}
+
+// exceeded reports whether err, from proxying a request, means the response
+// headers were over l, and if so describes them. The transport stops
+// reading at the byte limit itself, with an error that has no type of its
+// own.
+func (l headerLimits) exceeded(err error) (string, bool) {
+	var limitErr *headerLimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.reason, true
+	}
+	if strings.Contains(err.Error(), "response headers exceeded") {
+		return fmt.Sprintf("more than the %d bytes of headers allowed", l.bytes), true
+	}
+	return "", false
+}
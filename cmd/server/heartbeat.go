@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// agentStatus is what an agent last reported about itself in a heartbeat
+// control message.
+type agentStatus struct {
+	Version      string    `json:"version"`
+	Commit       string    `json:"commit,omitempty"`
+	OS           string    `json:"os"`
+	Arch         string    `json:"arch"`
+	LocalHealthy bool      `json:"local_healthy"`         // Whether the agent could connect to its local service
+	LocalError   string    `json:"local_error,omitempty"` // Why not
+	ReceivedAt   time.Time `json:"received_at"`
+}
+
+// readControl records the control messages an agent sends until its
+// session ends. Unknown message types are ignored so agents may add more.
+func (s *Server) readControl(subdomain string, agent *agentSession) {
+	for {
+		select {
+		case data := <-agent.session.Control():
+			var msg struct {
+				Type string `json:"type"`
+				agentStatus
+			}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				slog.Debug("Invalid control message from agent", "subdomain", subdomain, "err", err)
+				continue
+			}
+			if msg.Type != "heartbeat" {
+				continue
+			}
+			status := msg.agentStatus
+			status.ReceivedAt = time.Now()
+			if prev := agent.status.Swap(&status); prev == nil || prev.LocalHealthy != status.LocalHealthy {
+				slog.Debug("Agent heartbeat", "subdomain", subdomain, "version", status.Version,
+					"os", status.OS, "local_healthy", status.LocalHealthy, "local_error", status.LocalError)
+			}
+		case <-agent.session.Done():
+			return
+		}
+	}
+}
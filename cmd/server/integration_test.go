@@ -0,0 +1,867 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"github.com/rahulthapaofficial/expose-local/pkg/tunnel"
+)
+
+// startTLSTunnel serves s over HTTPS with a self-signed certificate, the
+// way it runs in production, connects an agent for subdomain "foo"
+// forwarding to backend, and returns the server's base URL and a client
+// that trusts it.
+func startTLSTunnel(t *testing.T, s *Server, backend *httptest.Server, options ...func(*tunnel.Config)) (string, *http.Client) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(s.Router())
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	connectAgent(t, s, srv, backend, options...)
+	return srv.URL, srv.Client()
+}
+
+// visit sends a GET for path on host to the server at base, with header
+// added, and returns the response with its body read.
+func visit(t *testing.T, client *http.Client, base, host, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+	req.Host = host
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestIntegrationProxiesBackendBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	base, client := startTLSTunnel(t, newTestServer(t), backend)
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/greeting", nil)
+	req.Host = "foo.exposelocal.dev"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: got %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	if got := resp.Header.Get("X-Backend"); got != "yes" {
+		t.Errorf("X-Backend: got %q, want yes", got)
+	}
+	if got, want := string(body), "hello from /greeting"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+}
+
+// Requests proxied at the same time share the agent's WebSocket; each must
+// get back exactly its own bytes, in order, in both directions.
+func TestIntegrationConcurrentBodiesDoNotInterleave(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	base, client := startTLSTunnel(t, newTestServer(t), backend)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Spans many frames, so streams' writes overlap on the wire.
+			payload := make([]byte, 256*1024)
+			for j := range payload {
+				payload[j] = byte(rand.IntN(256))
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/echo/%d", base, i), bytes.NewReader(payload))
+			req.Host = "foo.exposelocal.dev"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("request %d: reading body: %v", i, err)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("request %d: status %d", i, resp.StatusCode)
+				return
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("request %d: echoed body differs (%d bytes, want %d)", i, len(got), len(payload))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A download in flight when the agent's WebSocket drops carries on over the
+// resumed session instead of starting again.
+func TestIntegrationDownloadSurvivesReconnect(t *testing.T) {
+	payload := make([]byte, 2<<20)
+	for i := range payload {
+		payload[i] = byte(rand.IntN(256))
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for chunk := range slices.Chunk(payload, 64*1024) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	base, client := startTLSTunnel(t, s, backend)
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/download", nil)
+	req.Host = "foo.exposelocal.dev"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	got := make([]byte, 256*1024)
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	tun, _ := s.registry.Get("foo")
+	agent := tun.Agent()
+	agent.session.Suspend() // As if the connection dropped
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading after the drop: %v", err)
+	}
+	if got = append(got, rest...); !bytes.Equal(got, payload) {
+		t.Errorf("body differs after resume (%d bytes, want %d)", len(got), len(payload))
+	}
+	if tun.Agent() != agent {
+		t.Error("agent session was replaced rather than resumed")
+	}
+}
+
+func TestIntegrationRoutesPathsToBackends(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	frontend, api, admin := backend("frontend"), backend("api"), backend("admin")
+	port := func(srv *httptest.Server) string { return strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port) }
+
+	s := newTestServer(t)
+	srv := httptest.NewUnstartedServer(s.Router())
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	connectAgent(t, s, srv, frontend, func(cfg *tunnel.Config) {
+		cfg.Routes = map[string]string{"/api": port(api), "/api/admin/": port(admin)}
+	})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "frontend /"},
+		{"/api", "api /api"},
+		{"/api/users", "api /api/users"},
+		{"/apix", "frontend /apix"},
+		{"/api/admin", "admin /api/admin"},
+		{"/api/admin/x", "admin /api/admin/x"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		req.Host = "foo.exposelocal.dev"
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := string(body); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// A visitor whose request reaches a replica without the tunnel is served by
+// the replica the agent is connected to.
+func TestIntegrationForwardsToOwningReplica(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s via %s", r.URL.Path, r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+
+	redisURL := fakeRedis(t)
+	replica := func() (*Server, *httptest.Server) {
+		srv := httptest.NewUnstartedServer(nil)
+		cfg := config.Default()
+		cfg.Cluster.NodeURL = "http://" + srv.Listener.Addr().String()
+		cfg.Cluster.RedisURL = redisURL
+		cfg.Proxy.TrustedProxies = []string{"127.0.0.1/32"}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		srv.Config.Handler = s.Router()
+		srv.Start()
+		t.Cleanup(srv.Close)
+		return s, srv
+	}
+	a, srvA := replica()
+	_, srvB := replica()
+	connectAgent(t, a, srvA, backend)
+	// Registered with A, but its WebSocket lands on B, which passes it on.
+	connectAgent(t, a, srvB, backend, func(cfg *tunnel.Config) {
+		cfg.Subdomain = "bar"
+		cfg.RegisterURL = srvA.URL + "/register"
+	})
+
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, srvB.URL+"/greeting", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get("foo.exposelocal.dev"); code != http.StatusOK || body != "hello from /greeting via foo.exposelocal.dev" {
+		t.Errorf("via the other replica: got %d %q", code, body)
+	}
+	if code, body := get("bar.exposelocal.dev"); code != http.StatusOK || body != "hello from /greeting via bar.exposelocal.dev" {
+		t.Errorf("agent connected through the other replica: got %d %q", code, body)
+	}
+	if code, _ := get("baz.exposelocal.dev"); code != http.StatusNotFound {
+		t.Errorf("unknown tunnel: got %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestIntegrationCachesGetResponses(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.Method+" "+r.URL.Path]++
+		n := hits[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/static":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		fmt.Fprintf(w, "%s #%d", r.URL.Path, n)
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	srv := httptest.NewUnstartedServer(s.Router())
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	connectAgent(t, s, srv, backend, func(cfg *tunnel.Config) { cfg.CacheBytes = 1 << 20 })
+
+	do := func(method, path string) (string, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Host = "foo.exposelocal.dev"
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.Header.Get(cacheHeader)
+	}
+
+	tests := []struct {
+		method, path string
+		body, cache  string
+	}{
+		{"GET", "/static", "/static #1", "MISS"},
+		{"GET", "/static", "/static #1", "HIT"},
+		{"GET", "/etag", "/etag #1", "MISS"},
+		{"GET", "/etag", "/etag #1", "HIT"}, // Revalidated with a 304
+		{"GET", "/private", "/private #1", "MISS"},
+		{"GET", "/private", "/private #2", "MISS"},
+		{"POST", "/static", "/static #1", ""},
+		{"GET", "/static", "/static #2", "MISS"}, // The POST invalidated it
+	}
+	for i, tt := range tests {
+		body, cache := do(tt.method, tt.path)
+		if body != tt.body || cache != tt.cache {
+			t.Errorf("%d: %s %s: got %q (X-Cache %q), want %q (X-Cache %q)", i, tt.method, tt.path, body, cache, tt.body, tt.cache)
+		}
+	}
+	if hits["GET /etag"] != 2 {
+		t.Errorf("/etag reached the backend %d times, want 2", hits["GET /etag"])
+	}
+}
+
+func TestIntegrationLimitsHeadersOverTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/many":
+			for i := range 30 {
+				w.Header().Add("X-Field", strconv.Itoa(i))
+			}
+		case "/large":
+			w.Header().Set("X-Large", strings.Repeat("a", 8192))
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	s.cfg.Proxy.Transport.MaxHeaders = 20
+	s.cfg.Proxy.Transport.MaxHeaderBytes = 4096
+	srv := httptest.NewUnstartedServer(s.Router())
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	connectAgent(t, s, srv, backend)
+
+	tests := []struct {
+		path   string
+		fields int // Extra request header fields
+		want   int
+	}{
+		{"/", 0, http.StatusOK},
+		{"/many", 0, http.StatusBadGateway},
+		{"/large", 0, http.StatusBadGateway},
+		{"/", 30, http.StatusRequestHeaderFieldsTooLarge},
+		{"/", 0, http.StatusOK}, // The tunnel still works
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		req.Host = "foo.exposelocal.dev"
+		for i := range tt.fields {
+			req.Header.Add("X-Field", strconv.Itoa(i))
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s with %d fields: got %d, want %d: %s", tt.path, tt.fields, resp.StatusCode, tt.want, body)
+		}
+	}
+}
+
+// Paths the server serves its own endpoints under reach the tunnelled app
+// when asked for under the tunnel's name.
+func TestIntegrationTunnelKeepsOperatorPaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	base, client := startTLSTunnel(t, newTestServer(t), backend)
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for _, path := range []string{"/metrics", "/healthz", "/tunnels", "/register/foo"} {
+		if code, body := get("foo.exposelocal.dev", path); code != http.StatusOK || body != "backend "+path {
+			t.Errorf("tunnel %s: got %d %q, want the backend's", path, code, body)
+		}
+	}
+	if code, body := get("exposelocal.dev", "/healthz"); code != http.StatusOK || strings.HasPrefix(body, "backend") {
+		t.Errorf("server /healthz: got %d %q, want the server's", code, body)
+	}
+}
+
+// Visitors are admitted by the tunnel's allow and deny lists; deny wins.
+func TestIntegrationRestrictsVisitorsByCIDR(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	// X-Forwarded-For names the visitor, as the test client connects from
+	// a trusted proxy.
+	cfg := config.Default()
+	cfg.Proxy.TrustedProxies = []string{"127.0.0.1"}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, client := startTLSTunnel(t, s, backend, func(cfg *tunnel.Config) {
+		cfg.AllowCIDRs = []string{"198.51.100.0/24", "203.0.113.5"}
+		cfg.DenyCIDRs = []string{"203.0.113.0/24"}
+	})
+
+	tests := []struct {
+		visitor string
+		want    int
+	}{
+		{"198.51.100.7", http.StatusOK},
+		{"203.0.113.5", http.StatusForbidden}, // Allowed, but denied too
+		{"192.0.2.1", http.StatusForbidden},   // Not allowed
+		{"", http.StatusForbidden},            // The proxy itself
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.visitor != "" {
+			header.Set("X-Forwarded-For", tt.visitor)
+		}
+		if resp, body := visit(t, client, base, "foo.exposelocal.dev", "/", header); resp.StatusCode != tt.want {
+			t.Errorf("visitor %q: got %d, want %d: %s", tt.visitor, resp.StatusCode, tt.want, body)
+		}
+	}
+}
+
+// A tunnel with basic auth turns away visitors without its credentials and
+// keeps them from the backend.
+func TestIntegrationBasicAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "authorization=%q", r.Header.Get("Authorization"))
+	}))
+	defer backend.Close()
+
+	base, client := startTLSTunnel(t, newTestServer(t), backend, func(cfg *tunnel.Config) {
+		cfg.BasicAuth = "user:pass"
+	})
+
+	credentials := func(user, pass string) http.Header {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, pass)
+		return req.Header
+	}
+	resp, _ := visit(t, client, base, "foo.exposelocal.dev", "/", nil)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("no credentials: got %d, WWW-Authenticate %q; want 401 with a Basic challenge", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp, _ := visit(t, client, base, "foo.exposelocal.dev", "/", credentials("user", "wrong")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want 401", resp.StatusCode)
+	}
+	resp, body := visit(t, client, base, "foo.exposelocal.dev", "/", credentials("user", "pass"))
+	if resp.StatusCode != http.StatusOK || body != `authorization=""` {
+		t.Errorf("right credentials: got %d %s, want 200 without Authorization at the backend", resp.StatusCode, body)
+	}
+}
+
+// A custom domain reaches its tunnel and cannot be claimed by another key.
+func TestIntegrationCustomDomain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "host=%s", r.Host)
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	s.auth = NewStaticAuthenticator(append(s.cfg.Auth.Keys,
+		config.KeyInfo{Key: "team-b", Name: "team-b"}))
+	base, client := startTLSTunnel(t, s, backend, func(cfg *tunnel.Config) {
+		cfg.Domain = "myapp.example.com"
+	})
+
+	if resp, body := visit(t, client, base, "myapp.example.com", "/", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("custom domain: got %d %s, want 200", resp.StatusCode, body)
+	}
+	if resp, _ := visit(t, client, base, "other.example.com", "/", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown domain: got %d, want 404", resp.StatusCode)
+	}
+
+	rec := register(t, s, `{"subdomain":"bar","target_port":"3000","api_key":"team-b","custom_domain":"myapp.example.com"}`)
+	var resp struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeDomainTaken {
+		t.Errorf("taken domain: got %d %q, want 409 %q", rec.Code, resp.Code, codeDomainTaken)
+	}
+}
+
+// A wildcard tunnel serves names below its subdomain; others do not.
+func TestIntegrationWildcard(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "host=%s", r.Host)
+	}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	base, client := startTLSTunnel(t, s, backend, func(cfg *tunnel.Config) {
+		cfg.Wildcard = true
+	})
+	if rec := register(t, s, `{"subdomain":"bar","target_port":"3000","api_key":"test123"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("register bar: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if resp, body := visit(t, client, base, "api.foo.exposelocal.dev", "/", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("api.foo: got %d %s, want 200", resp.StatusCode, body)
+	}
+	if resp, _ := visit(t, client, base, "api.bar.exposelocal.dev", "/", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("api.bar: got %d, want 404", resp.StatusCode)
+	}
+}
+
+// A panicking handler costs its request a 500, not the server.
+func TestIntegrationRecoversPanics(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		fmt.Fprint(w, "ok")
+	})))
+	defer srv.Close()
+
+	for _, path := range []string{"/panic", "/", "/panic", "/"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		want := http.StatusOK
+		if path == "/panic" {
+			want = http.StatusInternalServerError
+		}
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+// Draining a tunnel tells its agent to go, and a one-shot agent does.
+func TestIntegrationDrain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	base, client := startTLSTunnel(t, s, backend, func(cfg *tunnel.Config) {
+		cfg.OneShot = true
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/drain/foo", nil)
+	req.Header.Set("X-API-Key", "test123")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Drained []string `json:"drained"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !slices.Equal(body.Drained, []string{"foo"}) {
+		t.Fatalf("drain: got %d %v, want 200 [foo]", resp.StatusCode, body.Drained)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tun, ok := s.registry.Get("foo"); !ok || tun.Agent() == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("agent still connected after drain")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Every proxied request carries one ID to both the visitor and the backend.
+func TestIntegrationRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request-ID"))
+	}))
+	defer backend.Close()
+
+	base, client := startTLSTunnel(t, newTestServer(t), backend)
+
+	tests := []struct {
+		name, sent string
+		kept       bool
+	}{
+		{"none", "", false},
+		{"valid", "abc-123", true},
+		{"with a space", "abc 123", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.sent != "" {
+				header.Set("X-Request-ID", tt.sent)
+			}
+			resp, body := visit(t, client, base, "foo.exposelocal.dev", "/", header)
+			id := resp.Header.Get("X-Request-ID")
+			if id == "" || id != body {
+				t.Fatalf("visitor got %q, backend saw %q; want the same non-empty ID", id, body)
+			}
+			if kept := id == tt.sent; kept != tt.kept {
+				t.Errorf("sent %q, got %q; kept = %v, want %v", tt.sent, id, kept, tt.kept)
+			}
+		})
+	}
+}
+
+// Registrations past a key's burst are refused with 429 until it refills.
+func TestIntegrationRegisterRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.Tunnels.RegisterRate.PerMinute = 1
+	cfg.Tunnels.RegisterRate.Burst = 2
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Router())
+	defer srv.Close()
+
+	post := func(subdomain string) *http.Response {
+		body := fmt.Sprintf(`{"subdomain":%q,"target_port":"3000","api_key":"test123"}`, subdomain)
+		resp, err := http.Post(srv.URL+"/register", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	for _, subdomain := range []string{"one", "two"} {
+		if resp := post(subdomain); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("register %s: got %d, want 201", subdomain, resp.StatusCode)
+		}
+	}
+
+	resp := post("three")
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusTooManyRequests || body.Code != codeRateLimited {
+		t.Fatalf("over the burst: got %d %q, want 429 %q", resp.StatusCode, body.Code, codeRateLimited)
+	}
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("Retry-After = %q, want whole seconds", resp.Header.Get("Retry-After"))
+	}
+}
+
+// The circuit breaker opens after repeated dial failures, lets one probe
+// through per cooldown, and closes once the backend answers again.
+func TestIntegrationCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var hits atomic.Int64
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.Header().Set(dialErrorHeader, "dial")
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer backend.Close()
+
+	cfg := config.Default()
+	cfg.Proxy.CircuitBreaker.Failures = 2
+	cfg.Proxy.CircuitBreaker.Cooldown = 100 * time.Millisecond
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, client := startTLSTunnel(t, s, backend)
+
+	step := func(name string, wantStatus int, wantHits int64) {
+		t.Helper()
+		resp, _ := visit(t, client, base, "foo.exposelocal.dev", "/", nil)
+		if resp.StatusCode != wantStatus || hits.Load() != wantHits {
+			t.Fatalf("%s: got %d after %d backend hits, want %d after %d", name, resp.StatusCode, hits.Load(), wantStatus, wantHits)
+		}
+		if resp.Header.Get(dialErrorHeader) != "" {
+			t.Fatalf("%s: %s leaked to the visitor", name, dialErrorHeader)
+		}
+	}
+	step("first failure", http.StatusBadGateway, 1)
+	step("second failure", http.StatusBadGateway, 2)
+	step("open", http.StatusServiceUnavailable, 2)
+
+	time.Sleep(150 * time.Millisecond)
+	step("failed probe", http.StatusBadGateway, 3)
+	step("reopened", http.StatusServiceUnavailable, 3)
+
+	time.Sleep(150 * time.Millisecond)
+	failing.Store(false)
+	step("good probe", http.StatusOK, 4)
+	step("closed", http.StatusOK, 5)
+}
+
+// Heartbeats keep an agent connected but not its tunnel alive: without
+// visitor traffic the idle timeout still expires it.
+func TestIntegrationIdleTimeoutIgnoresHeartbeats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg := config.Default()
+	cfg.Tunnels.IdleTimeout = 200 * time.Millisecond
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTLSTunnel(t, s, backend, func(cfg *tunnel.Config) {
+		cfg.Heartbeat = 20 * time.Millisecond
+	})
+	tun, _ := s.registry.Get("foo")
+
+	time.Sleep(300 * time.Millisecond)
+	if tun.Agent() == nil || tun.Agent().status.Load() == nil {
+		t.Fatal("agent not heartbeating")
+	}
+	s.expireTunnels(time.Now())
+	if got, ok := s.registry.Get("foo"); ok && got == tun {
+		t.Fatalf("tunnel idle for 300ms with a 200ms timeout was kept; last active %v", tun.LastActive())
+	}
+}
+
+// An agent whose sessions drop as soon as they start keeps backing off
+// rather than reconnecting at once every time.
+func TestIntegrationAgentBacksOffFlappingSessions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	s := newTestServer(t)
+	var sessions atomic.Int64
+	upgrader := websocket.Upgrader{}
+	router := s.Router()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tunnel" {
+			router.ServeHTTP(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessions.Add(1)
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tunnel.New(tunnel.Config{
+		TunnelURL:  "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+		APIKey:     "test123",
+		Subdomain:  "foo",
+		LocalPort:  port,
+		RetryDelay: 50 * time.Millisecond,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}).Start(ctx)
+
+	// Doubling from 50ms with full jitter allows a handful of sessions in
+	// a second; reconnecting at once makes as many as registration allows.
+	if n := sessions.Load(); n < 2 || n > 10 {
+		t.Errorf("%d sessions in a second, want a few", n)
+	}
+}
+
+// BenchmarkProxyLargeBody downloads 100MB through a tunnel with a 1KB and
+// with the default 32KB copy buffer.
+func BenchmarkProxyLargeBody(b *testing.B) {
+	const size = 100 << 20
+	body := make([]byte, size)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	for _, bufSize := range []int{1 << 10, 32 << 10} {
+		b.Run(fmt.Sprintf("buffer=%dKB", bufSize>>10), func(b *testing.B) {
+			cfg := config.Default()
+			cfg.Server.BufferSize = bufSize
+			s, err := NewServer(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			srv := httptest.NewUnstartedServer(s.Router())
+			srv.StartTLS()
+			b.Cleanup(srv.Close)
+			connectAgent(b, s, srv, backend, func(cfg *tunnel.Config) { cfg.BufferSize = bufSize })
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+				req.Host = "foo.exposelocal.dev"
+				resp, err := srv.Client().Do(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("got %d bytes, %v; want %d", n, err, size)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const (
+	// janitorInterval is how often expired tunnels are swept.
+	janitorInterval = 10 * time.Second
+
+	// expiredRetention is how long an expired subdomain keeps answering 410.
+	expiredRetention = 24 * time.Hour
+)
+
+// runJanitor periodically removes tunnels past their TTL or idle window.
+func (s *Server) runJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Tunnels restored from the state file are ours from the start.
+	s.claimTunnels(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.expireTunnels(now)
+			s.claimTunnels(ctx)
+			s.tokens.prune(now)
+			if s.limiter != nil {
+				s.limiter.prune(now)
+			}
+			if s.registerLimit != nil {
+				s.registerLimit.prune(now)
+			}
+		}
+	}
+}
+
+// expireTunnels removes every tunnel whose TTL has elapsed or that has been
+// idle for longer than its idle timeout, dropping any connected agent.
+func (s *Server) expireTunnels(now time.Time) {
+	removed := s.registry.Expire(now, func(t *Tunnel) string {
+		switch {
+		case t.ttl > 0 && now.Sub(t.registeredAt) >= t.ttl:
+			return "ttl elapsed"
+		case t.idleTimeout > 0 && now.Sub(t.LastActive()) >= t.idleTimeout:
+			return "idle timeout"
+		}
+		return ""
+	})
+
+	for t, reason := range removed {
+		slog.Info("Tunnel expired", "subdomain", t.Subdomain, "reason", reason)
+		if agent := t.Agent(); agent != nil {
+			agent.session.Close()
+		}
+	}
+}
+
+// capDuration parses a requested duration and bounds it by the server
+// limit. An empty request takes the limit; a zero limit means unbounded.
+func capDuration(requested string, limit time.Duration) (time.Duration, error) {
+	if requested == "" {
+		return limit, nil
+	}
+	d, err := time.ParseDuration(requested)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration")
+	}
+	if limit > 0 && (d == 0 || d > limit) {
+		return limit, nil
+	}
+	return d, nil
+}
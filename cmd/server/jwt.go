@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTAuthenticator accepts short-lived tokens signed by an identity
+// provider instead of static keys. A token is valid if its signature
+// checks out against the configured public key or JWKS, it has not
+// expired, and its aud claim names auth.jwt.audience. The sub claim
+// becomes the owner; the subdomains and admin claims, if present, limit
+// what it may register and grant the operator endpoints.
+type JWTAuthenticator struct {
+	keys            *jwtKeys
+	issuer          string // Required iss; empty accepts any
+	audience        string
+	subdomainsClaim string
+	adminClaim      string
+	leeway          time.Duration // Clock skew allowed on exp and nbf
+}
+
+// JWTOptions configures a JWTAuthenticator.
+type JWTOptions struct {
+	PublicKey       string        // PEM file with the signing key; or
+	JWKSURL         string        // Where the provider publishes its keys
+	Issuer          string        // Required iss claim; empty accepts any
+	Audience        string        // Required in the aud claim
+	SubdomainsClaim string        // Claim listing allowed subdomain patterns; defaults to "subdomains"
+	AdminClaim      string        // Boolean claim granting admin; defaults to "admin"
+	Leeway          time.Duration // Clock skew allowed; defaults to 1m
+}
+
+// NewJWTAuthenticator loads the public key, if given as a file. A JWKS is
+// fetched on first use and refreshed hourly.
+func NewJWTAuthenticator(opts JWTOptions) (*JWTAuthenticator, error) {
+	if opts.SubdomainsClaim == "" {
+		opts.SubdomainsClaim = "subdomains"
+	}
+	if opts.AdminClaim == "" {
+		opts.AdminClaim = "admin"
+	}
+	if opts.Leeway <= 0 {
+		opts.Leeway = time.Minute
+	}
+
+	keys := &jwtKeys{jwksURL: opts.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+	if opts.PublicKey != "" {
+		key, err := loadPublicKey(opts.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("auth.jwt.public_key: %w", err)
+		}
+		keys.static = key
+	}
+	return &JWTAuthenticator{
+		keys:            keys,
+		issuer:          opts.Issuer,
+		audience:        opts.Audience,
+		subdomainsClaim: opts.SubdomainsClaim,
+		adminClaim:      opts.AdminClaim,
+		leeway:          opts.Leeway,
+	}, nil
+}
+
+// Authenticate verifies token and maps its claims to an identity. Tokens
+// that fail any check are errUnauthorized; only a JWKS that cannot be
+// fetched is reported as a backend failure.
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	header, claims, err := a.verify(ctx, token)
+	if err != nil {
+		if errors.Is(err, errJWKSUnavailable) {
+			return nil, err
+		}
+		slog.Debug("JWT rejected", "kid", header.KeyID, "err", err)
+		return nil, errUnauthorized
+	}
+
+	sub, _ := claims["sub"].(string)
+	id := &Identity{Owner: "jwt:" + sub, Name: sub}
+	switch v := claims[a.subdomainsClaim].(type) {
+	case string:
+		id.Subdomains = strings.Fields(v)
+	case []any:
+		for _, p := range v {
+			if s, ok := p.(string); ok {
+				id.Subdomains = append(id.Subdomains, s)
+			}
+		}
+		// A token listing nothing may register nothing, not everything.
+		if len(id.Subdomains) == 0 {
+			id.Subdomains = []string{""}
+		}
+	}
+	id.Admin, _ = claims[a.adminClaim].(bool)
+	return id, nil
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) verify(ctx context.Context, token string) (jwtHeader, map[string]any, error) {
+	var header jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, errors.New("not a JWT")
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return header, nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, fmt.Errorf("signature: %w", err)
+	}
+
+	key, err := a.keys.get(ctx, header.KeyID)
+	if err != nil {
+		return header, nil, err
+	}
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return header, nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return header, nil, fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return header, nil, errors.New("no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.leeway)) {
+		return header, nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return header, nil, errors.New("token not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return header, nil, fmt.Errorf("issuer %v not accepted", claims["iss"])
+	}
+	if !audienceIncludes(claims["aud"], a.audience) {
+		return header, nil, fmt.Errorf("audience %v does not include %s", claims["aud"], a.audience)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return header, nil, errors.New("no sub claim")
+	}
+	return header, claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceIncludes reports whether the aud claim, a string or a list of
+// them, names want.
+func audienceIncludes(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		return slices.Contains(v, any(want))
+	}
+	return false
+}
+
+// verifySignature checks sig over signed with key. Only asymmetric
+// algorithms are accepted: the server never holds a secret that could
+// mint tokens, and "none" is never valid.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "RS") && hash != 0:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest(hash, signed), sig)
+	case strings.HasPrefix(alg, "PS") && hash != 0:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", alg)
+		}
+		return rsa.VerifyPSS(pub, hash, digest(hash, signed), sig, nil)
+	case strings.HasPrefix(alg, "ES") && hash != 0:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an ECDSA key", alg)
+		}
+		// JWS signatures are r || s, each the size of the curve.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest(hash, signed), r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an Ed25519 key", alg)
+		}
+		if !ed25519.Verify(pub, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q not accepted", alg)
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// loadPublicKey reads a PEM public key or certificate.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// errJWKSUnavailable means tokens cannot be checked right now, as opposed
+// to being invalid.
+var errJWKSUnavailable = errors.New("JWKS unavailable")
+
+const (
+	// jwksRefresh is how long fetched keys are used before fetching again.
+	jwksRefresh = time.Hour
+	// jwksMinRefetch spaces out fetches prompted by unknown key IDs, so
+	// tokens with made-up kids cannot hammer the provider.
+	jwksMinRefetch = time.Minute
+)
+
+// jwtKeys holds the verification keys: one fixed key, or the provider's
+// JWKS by key ID.
+type jwtKeys struct {
+	static  crypto.PublicKey
+	jwksURL string
+	client  *http.Client
+
+	mu      sync.Mutex
+	byID    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func (k *jwtKeys) get(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if k.static != nil {
+		return k.static, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.byID[kid]
+	age := time.Since(k.fetched)
+	if ok && age < jwksRefresh {
+		return key, nil
+	}
+	if k.byID == nil || age >= jwksMinRefetch {
+		if err := k.fetch(ctx); err != nil {
+			// Keep using what we had rather than failing every login
+			// while the provider is briefly unreachable.
+			if k.byID == nil {
+				return nil, fmt.Errorf("%w: %v", errJWKSUnavailable, err)
+			}
+			slog.Warn("Failed to refresh JWKS", "url", k.jwksURL, "err", err)
+		}
+	}
+	if key, ok := k.byID[kid]; ok {
+		return key, nil
+	}
+	// Tokens without a kid are fine as long as there is only one key.
+	if kid == "" && len(k.byID) == 1 {
+		for _, key := range k.byID {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// fetch replaces the keys with the provider's current set. Called with
+// k.mu held.
+func (k *jwtKeys) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+	byID := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			slog.Warn("Skipping JWKS key", "kid", j.KeyID, "err", err)
+			continue
+		}
+		byID[j.KeyID] = key
+	}
+	k.byID = byID
+	k.fetched = time.Now()
+	return nil
+}
+
+// jwk is one entry of a JSON Web Key Set.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`   // RSA modulus
+	E       string `json:"e"`   // RSA exponent
+	Curve   string `json:"crv"` // EC or OKP curve
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch j.KeyType {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Curve)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Curve)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.KeyType)
+}
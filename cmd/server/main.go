@@ -1,202 +1,1352 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"github.com/rahulthapaofficial/expose-local/internal/logging"
+	"github.com/rahulthapaofficial/expose-local/internal/version"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
 )
 
-var (
-	tunnels   = make(map[string]*url.URL) // Maps subdomains to local target URLs
-	tunnelsMu sync.RWMutex                // Ensures thread safety
+// RegistrationRequest represents the expected JSON request body.
+type RegistrationRequest struct {
+	Subdomain   string `json:"subdomain"`
+	TargetPort  string `json:"target_port"`
+	APIKey      string `json:"api_key"`
+	Type        string `json:"type,omitempty"` // "http" (default) or "tcp"
+	BasicUser   string `json:"basic_auth_user,omitempty"`
+	BasicPass   string `json:"basic_auth_pass,omitempty"`
+	TTL         string `json:"ttl,omitempty"`          // e.g. "2h"; capped by the server's limit
+	IdleTimeout string `json:"idle_timeout,omitempty"` // e.g. "15m"; capped by the server's limit
 
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true }, // Allow all origins for dev
-	}
+	// MaxBytesPerSec throttles the tunnel in both directions combined. It
+	// is capped by the server's limit; 0 takes that limit.
+	MaxBytesPerSec int64 `json:"max_bytes_per_sec,omitempty"`
+
+	// MaxInFlight limits concurrent HTTP requests to the tunnel, with up to
+	// MaxQueued more waiting. Both are capped by the server's limits; 0
+	// takes those limits.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	MaxQueued   int `json:"max_queued,omitempty"`
+
+	// HostHeader is the Host sent to the backend: "preserve", "target" or a
+	// literal value. Empty takes the server default.
+	HostHeader string `json:"host_header,omitempty"`
+
+	// CustomDomain is a full host name, e.g. "myapp.example.com", whose DNS
+	// is CNAMEd at the proxy and which should route to this tunnel too.
+	CustomDomain string `json:"custom_domain,omitempty"`
+
+	// RandomSubdomain lets the server pick a free name when Subdomain is
+	// taken, by appending a random suffix, or any name when it is empty.
+	// The response carries the name that was granted.
+	RandomSubdomain bool `json:"random_subdomain,omitempty"`
+
+	// Fallback picks how a taken Subdomain is varied: "random", the same
+	// as RandomSubdomain, or "sequential", which grants the lowest free
+	// of foo-2, foo-3 and so on so that names stay predictable.
+	Fallback string `json:"fallback,omitempty"`
+
+	// Routes sends requests under a path prefix to another local port
+	// instead of TargetPort, e.g. {"/api": "8000"}. The longest matching
+	// prefix wins; HTTP tunnels only.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// AllowCIDRs and DenyCIDRs restrict visitors by IP address or CIDR.
+	// Deny entries win; a non-empty allow list admits only its members.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty"`
+
+	// TargetHost is where the agent forwards to, "localhost" by default.
+	// The agent does the dialing; the server only needs it for the
+	// "target" host_header mode and for display.
+	TargetHost string `json:"target_host,omitempty"`
+
+	// ResponseHeaders are set on every response from the backend, e.g.
+	// CORS headers, after RemoveResponseHeaders are deleted from it.
+	ResponseHeaders       map[string]string `json:"response_headers,omitempty"`
+	RemoveResponseHeaders []string          `json:"remove_response_headers,omitempty"`
+
+	// Wildcard also routes every name below the subdomain to the tunnel,
+	// e.g. api.foo.exposelocal.dev to foo, for apps that split on host.
+	Wildcard bool `json:"wildcard,omitempty"`
+
+	// CacheBytes has the server keep cacheable GET responses, up to this
+	// many bytes, and answer repeat requests without asking the agent. It
+	// is capped by the server's limit; 0 disables caching.
+	CacheBytes int64 `json:"cache_bytes,omitempty"`
+}
+
+// Codes in the body of a refused registration, {"error": ..., "code": ...},
+// for clients to act on. Codes are stable; messages are for people and may
+// change.
+const (
+	codeInvalidRequest     = "invalid_request" // A field other than those below is invalid
+	codeRequestTooLarge    = "request_too_large"
+	codeUnauthorized       = "unauthorized"
+	codeAuthUnavailable    = "auth_unavailable" // The auth backend could not be reached; retry
+	codeRateLimited        = "rate_limited"     // Too many registrations for the key; retry after Retry-After
+	codeInvalidSubdomain   = "invalid_subdomain"
+	codeInvalidDomain      = "invalid_custom_domain"
+	codeSubdomainForbidden = "subdomain_not_permitted" // Outside the key's allowed patterns
+	codePortInvalid        = "port_invalid"
+	codeSubdomainTaken     = "subdomain_taken"
+	codeDomainTaken        = "domain_taken"
+	codeTooManyForIP       = "too_many_tunnels_for_ip"
+	codeTunnelLimit        = "tunnel_limit_reached"
+	codeNoTCPPorts         = "no_tcp_ports"
+	codeInternal           = "internal_error"
 )
 
-// RegistrationRequest represents the expected JSON request body.
-type RegistrationRequest struct {
-	Subdomain  string `json:"subdomain"`
-	TargetPort string `json:"target_port"`
-	APIKey     string `json:"api_key"`
+// registerError refuses a registration with status and a JSON body giving
+// code and msg.
+func registerError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
 }
 
 func main() {
-	// Default tunnel (for testing)
-	tunnels["test"], _ = url.Parse("http://127.0.0.1:80")
+	configPath := flag.String("config", "", "Path to the server YAML config")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
 
-	r := mux.NewRouter()
+	if *showVersion {
+		fmt.Println(version.String("expose-local server"))
+		return
+	}
 
-	// Endpoints
-	r.HandleFunc("/register", handleRegister).Methods("POST")
-	r.HandleFunc("/tunnel", handleTunnel).Methods("GET")
-	r.PathPrefix("/").HandlerFunc(handleHTTP)
+	cfg := config.Default()
+	if *configPath != "" {
+		loaded, err := config.LoadConfig(*configPath)
+		if err != nil {
+			fatal("Failed to load config", "path", *configPath, "err", err)
+		}
+		cfg = loaded
+	} else if key, err := config.ResolveAPIKey("", ""); err != nil {
+		fatal("Invalid API key", "err", err)
+	} else if key != "" {
+		// $TUNNEL_API_KEY replaces the built-in development key.
+		cfg.Auth.Keys = []config.KeyInfo{{Key: key, Name: "default", Admin: true}}
+	}
 
-	// certFile := "exposelocal.dev.pem"
-	// keyFile := "exposelocal.dev-key.pem"
+	logger, err := logging.New(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fatal("Invalid log config", "err", err)
+	}
+	slog.SetDefault(logger)
+	slog.Info("expose-local server", version.LogAttrs()...)
 
-	// WebSocket server
-	go func() {
-		log.Println("Starting WebSocket server on https://exposelocal.dev:8081")
-		if err := http.ListenAndServe(":8081", r); err != nil {
-			log.Fatal("WebSocket server error:", err)
-		}
-		// if err := http.ListenAndServeTLS(":8081", certFile, keyFile, r); err != nil {
-		// 	log.Fatal("WebSocket server error:", err)
-		// }
-	}()
+	s, err := NewServer(cfg)
+	if err != nil {
+		fatal("Invalid config", "err", err)
+	}
+
+	// Default tunnel (for testing)
+	if cfg.Tunnels.SeedTestTunnel {
+		s.seedTestTunnel()
+	}
+
+	// Graceful shutdown handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// HTTP reverse proxy
-	log.Println("Starting HTTP server on https://exposelocal.dev:8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal("HTTP server error:", err)
+	if err := s.Run(ctx); err != nil {
+		fatal("Server error", "err", err)
 	}
-	// if err := http.ListenAndServeTLS(":8080", certFile, keyFile, r); err != nil {
-	// 	log.Fatal("HTTP server error:", err)
-	// }
+	slog.Info("Server stopped")
 }
 
-// ✅ **Handles WebSocket Connections (Improved)**
-func handleTunnel(w http.ResponseWriter, r *http.Request) {
-	apiKey := r.Header.Get("X-API-Key")
-	if apiKey != "test123" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// handleTunnel upgrades an agent's connection and attaches it to the
+// tunnel it registered.
+func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	release, ok := s.startUpgrade()
+	if !ok {
+		slog.Warn("Too many pending WebSocket upgrades", "remote_addr", r.RemoteAddr)
+		setRetryAfter(w, time.Second)
+		http.Error(w, "Too many connections being set up, try again", http.StatusServiceUnavailable)
 		return
 	}
+	defer release()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade failed:", err)
+	// Authentication (a JWKS fetch, say) must fit within the handshake
+	// deadline too, or a slow step keeps the slot taken.
+	ctx, cancel := context.WithTimeout(r.Context(), s.handshakeTimeout())
+	key, ok := s.identify(w, r.WithContext(ctx), r.Header.Get("X-API-Key"))
+	cancel()
+	if !ok {
 		return
 	}
-	defer conn.Close()
 
 	subdomain := r.Header.Get("X-Subdomain")
-	tunnelsMu.RLock()
-	target, exists := tunnels[subdomain]
-	tunnelsMu.RUnlock()
+	if !key.Allows(subdomain) {
+		http.Error(w, "Subdomain not permitted for this API key", http.StatusForbidden)
+		return
+	}
 
+	t, exists := s.registry.Get(subdomain)
 	if !exists {
-		log.Printf("No tunnel found for subdomain: %s", subdomain)
+		release()
+		if s.forwardToOwner(w, r, subdomain) {
+			return
+		}
+		slog.Warn("No tunnel found", "subdomain", subdomain, "remote_addr", r.RemoteAddr)
 		http.Error(w, "Tunnel not registered", http.StatusNotFound)
 		return
 	}
+	// Only whoever registered the tunnel may carry its traffic, whatever
+	// names other keys allow. The seeded test tunnel belongs to nobody.
+	if t.owner != "" && t.owner != key.Owner {
+		slog.Warn("Tunnel registered by another key", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "key", key.Name)
+		http.Error(w, "Tunnel registered by another API key", http.StatusForbidden)
+		return
+	}
+
+	// Agents that predate negotiation offer nothing and speak v1; gorilla
+	// would let one offering only unknown versions through without a
+	// protocol, so refuse it here.
+	if offered := websocket.Subprotocols(r); len(offered) > 0 && wsmux.NegotiateProtocol(offered) == "" {
+		slog.Warn("No common tunnel protocol", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "offered", offered)
+		http.Error(w, fmt.Sprintf("No common tunnel protocol version: agent offers %s, server speaks %s",
+			strings.Join(offered, ", "), strings.Join(wsmux.Protocols, ", ")), http.StatusUpgradeRequired)
+		return
+	}
 
-	localConn, err := net.Dial("tcp", target.Host)
+	if id := r.Header.Get(wsmux.HeaderSession); id != "" {
+		s.resumeAgent(w, r, t, id, release)
+		return
+	}
+
+	// v2 sessions outlive a dropped WebSocket; the agent reconnects
+	// quoting this ID to pick up where it left off.
+	var responseHeader http.Header
+	resumeID := ""
+	if wsmux.NegotiateProtocol(websocket.Subprotocols(r)) == wsmux.ProtocolV2 {
+		resumeID = newResumeID()
+		responseHeader = http.Header{wsmux.HeaderSession: {resumeID}}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, responseHeader)
+	release()
+	if err != nil {
+		slog.Warn("WebSocket upgrade failed", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+	s.watchAgentConn(conn)
+
+	// Every proxied request gets its own stream on this session.
+	var session *wsmux.Session
+	if resumeID != "" {
+		session = wsmux.NewResumableSession(conn, true, s.reconnectGrace)
+	} else {
+		session = wsmux.NewSession(conn, true)
+	}
+	session.SetMaxStreams(s.cfg.Tunnels.MaxConnsPerTunnel)
+	agent := &agentSession{
+		session:     session,
+		transport:   s.newTunnelTransport(session, t),
+		connectedAt: time.Now(),
+		resumeID:    resumeID,
+	}
+	defer func() {
+		session.Close()
+		agent.transport.CloseIdleConnections()
+	}()
+
+	if !s.registry.Attach(t, agent) {
+		// Deregistered while the upgrade was in flight.
+		session.CloseWithCode(websocket.ClosePolicyViolation, "tunnel not registered")
+		return
+	}
+	tunnelsActive.Inc()
+	defer tunnelsActive.Dec()
+	protocol := conn.Subprotocol()
+	if protocol == "" {
+		protocol = wsmux.ProtocolV1
+	}
+	// gorilla accepts any permessage-deflate offer when compression is on.
+	offered := wsmux.OffersDeflate(r.Header)
+	if offered && !s.cfg.Server.Compression {
+		slog.Debug("Agent offered compression, which server.compression disables", "subdomain", subdomain)
+	}
+	slog.Info("Agent connected", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "protocol", protocol,
+		"compression", offered && s.cfg.Server.Compression)
+
+	s.readControl(subdomain, agent)
+
+	if s.registry.Detach(t, agent) {
+		time.AfterFunc(s.reconnectGrace, func() { s.expireDisconnected(t) })
+	}
+	if err := session.Err(); wsmux.NormalClose(err) {
+		slog.Info("Agent disconnected", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "err", err)
+	} else {
+		slog.Warn("Agent connection lost", "subdomain", subdomain, "remote_addr", r.RemoteAddr, "err", err)
+	}
+}
+
+// resumeAgent moves the suspended session of t's agent onto a new
+// WebSocket, so the streams on it carry on. The handler that accepted the
+// agent in the first place still owns the session; this one only hands
+// over the connection.
+func (s *Server) resumeAgent(w http.ResponseWriter, r *http.Request, t *Tunnel, id string, release func()) {
+	agent := t.Agent()
+	if agent == nil || agent.resumeID == "" || subtle.ConstantTimeCompare([]byte(agent.resumeID), []byte(id)) != 1 {
+		// Expired or replaced; the agent starts over.
+		http.Error(w, "Tunnel session expired", http.StatusGone)
+		return
+	}
+	peerReceived, err := strconv.ParseUint(r.Header.Get(wsmux.HeaderReceived), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+wsmux.HeaderReceived, http.StatusBadRequest)
+		return
+	}
+
+	received := agent.session.Suspend()
+	responseHeader := http.Header{
+		wsmux.HeaderSession:  {id},
+		wsmux.HeaderReceived: {strconv.FormatUint(received, 10)},
+	}
+	conn, err := s.upgrader.Upgrade(w, r, responseHeader)
+	release()
 	if err != nil {
-		log.Printf("Failed to connect to %s: %v", target.Host, err)
-		http.Error(w, "Target service unavailable", http.StatusBadGateway)
+		slog.Warn("WebSocket upgrade failed", "subdomain", t.Subdomain, "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+	s.watchAgentConn(conn)
+	if err := agent.session.Resume(conn, peerReceived); err != nil {
+		slog.Warn("Agent session resume failed", "subdomain", t.Subdomain, "remote_addr", r.RemoteAddr, "err", err)
+		conn.Close()
 		return
 	}
-	defer localConn.Close()
+	slog.Info("Agent resumed", "subdomain", t.Subdomain, "remote_addr", r.RemoteAddr,
+		"streams", agent.session.NumStreams())
+}
+
+// watchAgentConn sets up the keepalive that notices a dead agent
+// connection, and compression if the agent offered it.
+func (s *Server) watchAgentConn(conn *websocket.Conn) {
+	// Only takes effect if the agent offered permessage-deflate.
+	conn.EnableWriteCompression(s.cfg.Server.Compression)
+	conn.SetReadLimit(s.maxMessageBytes())
 
-	// ✅ **Detect WebSocket Disconnects**
+	// An agent that sends nothing, not even a pong, for a minute is dropped.
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		return nil
 	})
+	// Agents ping us, so their pings keep the tunnel alive as well.
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+}
+
+// expireDisconnected frees the subdomain unless its agent came back within
+// the reconnect grace period.
+func (s *Server) expireDisconnected(t *Tunnel) {
+	if s.registry.RemoveIfDisconnected(t, s.reconnectGrace) {
+		slog.Info("Subdomain released after agent disconnect", "subdomain", t.Subdomain)
+	}
+}
+
+// handshakeTimeout bounds an agent connection from first byte to upgrade.
+func (s *Server) handshakeTimeout() time.Duration {
+	if d := s.cfg.Server.HandshakeTimeout; d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// maxMessageBytes is the largest WebSocket message read from an agent.
+func (s *Server) maxMessageBytes() int64 {
+	if n := s.cfg.Server.MaxMessageBytes; n > 0 {
+		return n
+	}
+	return 4 << 20
+}
+
+// startUpgrade takes one of the server's pending upgrade slots, reporting
+// false when all are taken. The returned func gives the slot back and may be
+// called more than once.
+func (s *Server) startUpgrade() (release func(), ok bool) {
+	if s.upgrades == nil {
+		return func() {}, true
+	}
+	select {
+	case s.upgrades <- struct{}{}:
+	default:
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-s.upgrades }) }, true
+}
 
-	// ✅ **WebSocket → Local**
-	go func() {
-		for {
-			_, msg, err := conn.ReadMessage()
+// checkOrigin admits WebSocket upgrades whose Origin is in the configured
+// allow list. Agents are not browsers and send no Origin, so they pass.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.cfg.Server.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	slog.Warn("Rejected WebSocket origin", "origin", origin, "remote_addr", r.RemoteAddr)
+	return false
+}
+
+// newTunnelTransport returns a transport that writes each request onto a
+// fresh stream over the agent's session and reads the response back from
+// it. The dial address is ignored: the agent decides where to connect.
+// Pooling and timeouts come from proxy.transport.
+func (s *Server) newTunnelTransport(session *wsmux.Session, t *Tunnel) *http.Transport {
+	cfg := s.cfg.Proxy.Transport
+	maxIdle := cfg.MaxIdleConnsPerHost
+	if maxIdle == 0 {
+		maxIdle = 32
+	}
+	idleTimeout := cfg.IdleConnTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 90 * time.Second
+	}
+	return &http.Transport{
+		// The transport has no limit on the number of fields; handleHTTP
+		// checks that once they are read.
+		MaxResponseHeaderBytes: int64(s.headerLimits().bytes),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Requests routed to another local port name it to the agent.
+			target := ""
+			if addr != t.target.Host {
+				_, target, _ = net.SplitHostPort(addr)
+			}
+			stream, err := session.OpenTarget(target)
 			if err != nil {
-				log.Println("WebSocket read error:", err)
-				return
+				return nil, err
 			}
-			if _, err := localConn.Write(msg); err != nil {
-				log.Println("Local write error:", err)
+			return t.throttle(countingConn{stream, &t.stats}), nil
+		},
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+}
+
+// handleHTTP proxies a visitor's request to the tunnel its host names.
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	t, host, prefix, exists := s.route(r)
+	if !exists {
+		if s.forwardToOwner(w, r, s.ownerNames(r, host)...) {
+			return
+		}
+		if s.registry.IsExpired(host) {
+			s.proxyError(w, r, http.StatusGone, host, "Tunnel expired", "The tunnel reached its time limit. Start the agent again to get a new one.")
+			return
+		}
+		s.proxyError(w, r, http.StatusNotFound, host, "Tunnel not found", "Nothing is registered under this name. Check the address, or start the agent that should serve it.")
+		slog.Debug("No tunnel found", "subdomain", host, "remote_addr", r.RemoteAddr)
+		return
+	}
+	if t.kind == tunnelTCP {
+		s.proxyError(w, r, http.StatusNotFound, host, "Tunnel does not serve HTTP", "This is a TCP tunnel; connect to its public port instead.")
+		return
+	}
+
+	// Without the trailing slash, relative links in the backend's pages
+	// would resolve outside the tunnel's prefix.
+	if prefix != "" && r.URL.Path == prefix {
+		target := prefix + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if !t.admits(s.clientIP(r)) {
+		s.proxyError(w, r, http.StatusForbidden, host, "Access denied", "This tunnel only accepts visitors from certain networks.")
+		return
+	}
+
+	if s.limiter != nil {
+		if ok, retryAfter := s.limiter.allow(host, s.clientIP(r)); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+	}
+
+	if t.basicAuth != nil {
+		if !t.basicAuth.check(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+host+`", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The tunnel's credentials are not meant for the backend.
+		r.Header.Del("Authorization")
+	}
+
+	limits := s.headerLimits()
+	if err := limits.check(r.Header); err != nil {
+		s.proxyError(w, r, http.StatusRequestHeaderFieldsTooLarge, host, "Request headers too large", "The request carries "+err.Error()+", so the tunnel will not pass it on.")
+		return
+	}
+
+	// Only known tunnels are labelled, keeping metric cardinality bounded.
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { observeRequest(host, rec.Status(), start) }()
+	w = rec
+
+	// A fresh stored response needs no agent at all; a stale one with a
+	// validator is checked with the backend by a conditional request.
+	var cached *cacheEntry
+	cacheable := t.cache != nil && cacheableRequest(r)
+	if cacheable {
+		if cached = t.cache.get(r); cached != nil && cached.fresh(time.Now()) && !wantsRevalidation(r) {
+			t.touch()
+			t.stats.requests.Add(1)
+			cacheRequests.WithLabelValues("hit").Inc()
+			serveCached(w, r, cached)
+			return
+		}
+	} else if t.cache != nil && unsafeMethod(r.Method) {
+		t.cache.invalidate(cacheKey(http.MethodGet, r))
+	}
+	revalidate := cached != nil && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" &&
+		len(cached.validators()) > 0
+
+	// The server never dials the target itself; requests only reach the
+	// backend through the agent's WebSocket, so NATed agents work.
+	agent := t.Agent()
+	if agent == nil || agent.draining.Load() {
+		s.proxyError(w, r, http.StatusBadGateway, host, "Tunnel agent not connected", "Is your agent running? It may be reconnecting; try again in a few seconds.")
+		slog.Warn("No agent connected", "subdomain", host, "remote_addr", r.RemoteAddr)
+		return
+	}
+
+	t.touch()
+	t.stats.requests.Add(1)
+
+	if t.breaker != nil {
+		if ok, retryAfter := t.breaker.allow(); !ok {
+			setRetryAfter(w, retryAfter)
+			s.proxyError(w, r, http.StatusServiceUnavailable, host, "Backend unavailable", "The service behind the tunnel has been failing, so requests are paused briefly. Start or fix it and try again.")
+			return
+		}
+	}
+
+	// Bound the whole exchange, except for streams the visitor asked for
+	// explicitly, which are meant to stay open; they are exempt from the
+	// server's read and write timeouts too.
+	if isLongLived(r) {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	if timeout := s.cfg.Proxy.RequestTimeout; timeout > 0 && !isLongLived(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Time spent waiting for a slot counts against the request timeout.
+	if t.queue != nil {
+		if err := t.queue.acquire(r.Context()); err != nil {
+			if errors.Is(err, context.Canceled) {
 				return
 			}
+			queueRejections.Inc()
+			s.proxyError(w, r, http.StatusServiceUnavailable, host, "Tunnel busy", "The tunnel is handling as many requests as it may at once. Try again shortly.")
+			return
 		}
-	}()
+		defer t.queue.release()
+	}
 
-	// ✅ **Local → WebSocket**
-	buf := make([]byte, 1024)
-	for {
-		n, err := localConn.Read(buf)
-		if err != nil {
-			log.Println("Local read error:", err)
+	// Upgrade requests such as WebSockets need no special casing: the 101
+	// response from the stream-backed transport has a writable body, so
+	// ReverseProxy hijacks the visitor's connection and splices it onto the
+	// tunnel stream in both directions. Likewise, ReverseProxy flushes
+	// text/event-stream and unknown-length responses after every write, and
+	// the agent forwards each local read as it arrives, so SSE streams.
+	proxy := httputil.NewSingleHostReverseProxy(t.target)
+	proxy.Transport = agent.transport
+	proxy.BufferPool = s.buffers
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if prefix != "" {
+			stripPrefix(req, prefix)
+		}
+		// The transport opens the stream for whichever port this names.
+		req.URL.Host = t.targetFor(req.URL.Path).Host
+		s.setForwardedHeaders(req, r)
+		t.rewriteHost(req)
+		if revalidate {
+			for k, v := range cached.validators() {
+				req.Header[k] = v
+			}
+		}
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := limits.check(resp.Header); err != nil {
+			return err
+		}
+		// The visitor already has the ID; a backend echoing it back would
+		// otherwise send it twice.
+		resp.Header.Del(requestIDHeader)
+		t.recordResponse(resp)
+		t.headers.apply(resp.Header)
+		if prefix != "" {
+			prefixRedirects(resp, prefix, r.Host, scheme)
+		}
+		switch {
+		case revalidate && resp.StatusCode == http.StatusNotModified:
+			cacheRequests.WithLabelValues("revalidated").Inc()
+			t.cache.revalidated(cached, resp)
+		case cacheable:
+			cacheRequests.WithLabelValues("miss").Inc()
+			t.cache.capture(r, resp)
+			resp.Header.Set(cacheHeader, "MISS")
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// An agent that drops the stream without answering counts against
+		// the backend too; visitors giving up, full tunnels and answers
+		// over the header limits do not.
+		reason, overLimit := limits.exceeded(err)
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, wsmux.ErrTooManyStreams) && !overLimit {
+			t.backendFailed()
+		}
+		if errors.Is(err, wsmux.ErrTooManyStreams) {
+			s.proxyError(w, r, http.StatusServiceUnavailable, host, "Tunnel connection limit reached", "The tunnel is serving as many requests as it may at once. Try again shortly.")
+			return
+		}
+		if overLimit {
+			slog.Warn("Backend response headers over limit", "subdomain", host, "request_id", r.Header.Get(requestIDHeader), "err", err)
+			s.proxyError(w, r, http.StatusBadGateway, host, "Backend response headers too large", "The service behind the tunnel answered with "+reason+".")
 			return
 		}
-		if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-			log.Println("WebSocket write error:", err)
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			slog.Warn("Proxy timeout", "subdomain", host, "remote_addr", r.RemoteAddr, "request_id", r.Header.Get(requestIDHeader), "err", err)
+			s.proxyError(w, r, http.StatusGatewayTimeout, host, "Backend timed out", "The service behind the tunnel did not answer in time.")
 			return
 		}
+		slog.Warn("Proxy error", "subdomain", host, "remote_addr", r.RemoteAddr, "request_id", r.Header.Get(requestIDHeader), "err", err)
+		s.proxyError(w, r, http.StatusBadGateway, host, "Backend unavailable", "Is your agent running, and is the local service it forwards to up?")
 	}
+	proxy.ServeHTTP(w, r)
 }
 
-// ✅ **Reverse Proxy (Fixed Subdomain Extraction)**
-func handleHTTP(w http.ResponseWriter, r *http.Request) {
-	host := strings.Split(r.Host, ".")[0] // Extract subdomain
-	tunnelsMu.RLock()
-	target, exists := tunnels["test"]
-	tunnelsMu.RUnlock()
+// isLongLived reports whether r opens a stream that may legitimately last
+// longer than proxy.request_timeout: a protocol upgrade such as a WebSocket,
+// or a Server-Sent Events subscription.
+func isLongLived(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
 
-	if !exists {
-		http.Error(w, "Tunnel not found", http.StatusNotFound)
-		log.Printf("No tunnel found for subdomain: %s", host)
-		return
+// lookup finds the tunnel for a Host header. Custom domains are matched on
+// the full host name first; otherwise the subdomain is whatever precedes
+// the base domain. A deeper name such as "api.foo.exposelocal.dev" reaches
+// tunnel foo only if foo registered as a wildcard, and nothing otherwise.
+// Hosts outside the base domain, such as foo.localhost during development,
+// fall back to their first label.
+func (s *Server) lookup(hostport string) (*Tunnel, string, bool) {
+	host := hostOnly(hostport)
+	if t, ok := s.registry.GetByDomain(host); ok {
+		return t, t.Subdomain, true
 	}
 
-	// ✅ **Create and use a reverse proxy**
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	proxy.ServeHTTP(w, r)
+	subdomain, found := strings.CutSuffix(host, "."+s.baseDomain())
+	if !found {
+		subdomain, _, _ = strings.Cut(host, ".")
+	}
+	if i := strings.LastIndexByte(subdomain, '.'); i >= 0 {
+		t, ok := s.registry.Get(subdomain[i+1:])
+		if !ok || !t.wildcard {
+			return nil, subdomain, false
+		}
+		return t, t.Subdomain, true
+	}
+	t, ok := s.registry.Get(subdomain)
+	return t, subdomain, ok
 }
 
-// ✅ **Handles Subdomain Registration (Fixed Mutex & Logs)**
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-	var req RegistrationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Println("Invalid registration request:", err)
+// defaultMaxBodyBytes applies when server.max_body_bytes is unset.
+const defaultMaxBodyBytes = 64 * 1024
+
+// decodeJSON reads a JSON request body of at most server.max_body_bytes
+// into v. On failure it has already answered 413 or 400.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	err := s.readJSON(w, r, v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	case err != nil:
 		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+	return err
+}
+
+// readJSON is decodeJSON without the answer; a body over the limit fails
+// with *http.MaxBytesError.
+func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	limit := s.cfg.Server.MaxBodyBytes
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// publicURL is where visitors reach t: its custom domain if it has one,
+// otherwise its subdomain, or the allocated port for TCP tunnels.
+func (s *Server) publicURL(t *Tunnel, listener net.Listener) string {
+	if listener != nil {
+		return fmt.Sprintf("tcp://%s:%d", s.baseDomain(), listenerPort(listener))
+	}
+	scheme, defaultPort := "http", 80
+	if s.cfg.Server.TLS.Enabled {
+		scheme, defaultPort = "https", 443
+	}
+	host, path := t.Subdomain+"."+s.baseDomain(), ""
+	if s.cfg.Proxy.Routing == routePath {
+		host, path = s.baseDomain(), s.pathPrefix()+t.Subdomain+"/"
+	}
+	if t.CustomDomain != "" {
+		host, path = t.CustomDomain, ""
+	}
+	if s.cfg.Server.Port != defaultPort {
+		host = net.JoinHostPort(host, strconv.Itoa(s.cfg.Server.Port))
+	}
+	return scheme + "://" + host + path
+}
+
+// handleRegister reserves a subdomain for the caller's key.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegistrationRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		slog.Warn("Invalid registration request", "remote_addr", r.RemoteAddr, "err", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			registerError(w, http.StatusRequestEntityTooLarge, codeRequestTooLarge, "Request body too large")
+		} else {
+			registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request")
+		}
+		return
+	}
+	if s.forwardRegistration(w, r, &req) {
 		return
 	}
 
-	// Validate API key
-	if req.APIKey != "test123" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Validate the API key or client certificate
+	key, err := s.authenticate(r, req.APIKey)
+	switch {
+	case errors.Is(err, errUnauthorized):
+		registerError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 		return
+	case err != nil:
+		registerError(w, http.StatusServiceUnavailable, codeAuthUnavailable, "Authentication unavailable")
+		return
+	}
+	if s.registerLimit != nil {
+		sum := sha256.Sum256([]byte(key.Owner))
+		if ok, retryAfter := s.registerLimit.allow(hex.EncodeToString(sum[:]), ""); !ok {
+			slog.Warn("Registration rate exceeded", "key", key.Name, "remote_addr", r.RemoteAddr)
+			setRetryAfter(w, retryAfter)
+			registerError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+			return
+		}
+	}
+
+	switch req.Fallback {
+	case "":
+	case fallbackRandom:
+		req.RandomSubdomain = true
+	case fallbackSequential:
+		req.RandomSubdomain = false
+	default:
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid fallback: must be random or sequential")
+		return
+	}
+	if req.Subdomain == "" && req.RandomSubdomain {
+		req.Subdomain = randomSubdomain("")
 	}
 
 	// Validate subdomain format
-	if !isValidSubdomain(req.Subdomain) {
-		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+	if err := s.validateSubdomain(req.Subdomain); err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidSubdomain, "Invalid subdomain: "+err.Error())
 		return
 	}
 
-	// Check for existing subdomain
-	tunnelsMu.Lock()
-	if _, exists := tunnels[req.Subdomain]; exists {
-		tunnelsMu.Unlock()
-		http.Error(w, "Subdomain already registered", http.StatusConflict)
+	customDomain := strings.ToLower(req.CustomDomain)
+	if customDomain != "" {
+		if err := validateDomain(customDomain); err != nil {
+			registerError(w, http.StatusBadRequest, codeInvalidDomain, "Invalid custom_domain: "+err.Error())
+			return
+		}
+		// Custom domains are matched first, so one under the base domain
+		// could hijack somebody else's subdomain.
+		if base := s.baseDomain(); customDomain == base || strings.HasSuffix(customDomain, "."+base) {
+			registerError(w, http.StatusBadRequest, codeInvalidDomain, "Invalid custom_domain: must not be under "+base)
+			return
+		}
+	}
+
+	// Keys may be scoped to a subset of subdomains
+	if !key.Allows(req.Subdomain) {
+		registerError(w, http.StatusForbidden, codeSubdomainForbidden, "Subdomain not permitted for this API key")
+		return
+	}
+
+	ttl, err := capDuration(req.TTL, s.cfg.Tunnels.TTL)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid ttl")
+		return
+	}
+	idleTimeout, err := capDuration(req.IdleTimeout, s.cfg.Tunnels.IdleTimeout)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid idle_timeout")
+		return
+	}
+
+	if req.MaxBytesPerSec < 0 {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid max_bytes_per_sec")
+		return
+	}
+	bandwidth := req.MaxBytesPerSec
+	if limit := s.cfg.Tunnels.MaxBytesPerSec; limit > 0 && (bandwidth == 0 || bandwidth > limit) {
+		bandwidth = limit
+	}
+	if req.CacheBytes < 0 {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid cache_bytes")
+		return
+	}
+	if req.MaxInFlight < 0 || req.MaxQueued < 0 {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid max_in_flight or max_queued")
+		return
+	}
+	maxQueued := req.MaxQueued
+	if maxQueued == 0 || maxQueued > s.cfg.Tunnels.MaxQueued {
+		maxQueued = s.cfg.Tunnels.MaxQueued
+	}
+
+	hostHeader := req.HostHeader
+	if hostHeader == "" {
+		hostHeader = s.cfg.Proxy.HostHeader
+	}
+	if err := validateHostHeader(hostHeader); err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid host_header: "+err.Error())
+		return
+	}
+
+	responseHeaders, err := newHeaderRules(req.ResponseHeaders, req.RemoveResponseHeaders)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid response headers: "+err.Error())
+		return
+	}
+
+	allow, err := parseCIDRs(req.AllowCIDRs)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid allow_cidrs: "+err.Error())
+		return
+	}
+	deny, err := parseCIDRs(req.DenyCIDRs)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deny_cidrs: "+err.Error())
+		return
+	}
+
+	kind := req.Type
+	if kind == "" {
+		kind = tunnelHTTP
+	}
+	if kind != tunnelHTTP && kind != tunnelTCP {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid tunnel type")
+		return
+	}
+
+	var auth *basicAuth
+	if req.BasicUser != "" || req.BasicPass != "" {
+		if req.BasicUser == "" || req.BasicPass == "" {
+			registerError(w, http.StatusBadRequest, codeInvalidRequest, "basic_auth_user and basic_auth_pass must be set together")
+			return
+		}
+		if auth, err = newBasicAuth(req.BasicUser, req.BasicPass); err != nil {
+			registerError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+	}
+
+	if err := validatePort(req.TargetPort); err != nil {
+		registerError(w, http.StatusBadRequest, codePortInvalid, "Invalid target_port: "+err.Error())
 		return
 	}
 
 	// Register new tunnel
-	targetURL, _ := url.Parse("http://localhost:" + req.TargetPort)
-	tunnels[req.Subdomain] = targetURL
-	tunnelsMu.Unlock()
+	targetHost := strings.ToLower(req.TargetHost)
+	if targetHost == "" {
+		targetHost = "localhost"
+	} else if err := validateTargetHost(targetHost); err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid target_host: "+err.Error())
+		return
+	}
+	targetURL, _ := url.Parse("http://" + net.JoinHostPort(targetHost, req.TargetPort))
+	if len(req.Routes) > 0 && kind != tunnelHTTP {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid routes: only HTTP tunnels route by path")
+		return
+	}
+	routes, err := newBackendRoutes(req.Routes, targetHost)
+	if err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid routes: "+err.Error())
+		return
+	}
+	t := &Tunnel{
+		Subdomain:    req.Subdomain,
+		CustomDomain: customDomain,
+		kind:         kind,
+		basicAuth:    auth,
+		target:       targetURL,
+		routes:       routes,
+		owner:        key.Owner,
+		registeredAt: time.Now(),
+		ttl:          ttl,
+		idleTimeout:  idleTimeout,
+		bandwidth:    newBandwidthLimiter(bandwidth),
+		queue:        newRequestQueue(capLimit(req.MaxInFlight, s.cfg.Tunnels.MaxInFlight), maxQueued),
+		hostHeader:   hostHeader,
+		headers:      responseHeaders,
+		allow:        allow,
+		deny:         deny,
+		wildcard:     req.Wildcard,
+		cache:        newResponseCache(min(req.CacheBytes, s.cfg.Tunnels.MaxCacheBytes)),
+		sourceIP:     s.clientIP(r),
+		breaker:      s.newBreaker(),
+	}
+	t.touch()
 
-	log.Printf("Subdomain registered: %s -> %s", req.Subdomain, targetURL.String())
+	// The owner may reclaim a name while no agent is connected, e.g. after a
+	// restart within the grace period. A valid reconnect token also lets it
+	// displace an agent whose connection the server still thinks is alive.
+	// A reclaimed TCP tunnel keeps its public port.
+	resume := s.tokens.valid(r.Context(), r.Header.Get("X-Reconnect-Token"), req.Subdomain, key.Owner)
+	var listener, allocated net.Listener
+	var displaced *agentSession
+	var next func() string
+	switch {
+	case req.RandomSubdomain:
+		attempts := 0
+		next = func() string {
+			for attempts < maxSubdomainAttempts {
+				attempts++
+				if name := randomSubdomain(req.Subdomain); key.Allows(name) {
+					return name
+				}
+			}
+			return ""
+		}
+	case req.Fallback == fallbackSequential:
+		n := 1
+		next = func() string {
+			for n < maxSequentialSuffix {
+				n++
+				if name := numberedSubdomain(req.Subdomain, n); key.Allows(name) {
+					return name
+				}
+			}
+			return ""
+		}
+	}
+	evicted, err := s.registry.ClaimUnique(t, resume, next, func(old *Tunnel) error {
+		if old != nil {
+			displaced = old.Agent()
+		}
+		if kind != tunnelTCP {
+			return nil
+		}
+		if old != nil && old.listener != nil {
+			listener, old.listener = old.listener, nil
+		} else {
+			ln, err := s.allocateTCPListener()
+			if err != nil {
+				return err
+			}
+			listener, allocated = ln, ln
+		}
+		t.listener = listener
+		return nil
+	})
+	switch {
+	case errors.Is(err, errSubdomainTaken):
+		registerError(w, http.StatusConflict, codeSubdomainTaken, "Subdomain already registered")
+		return
+	case errors.Is(err, errDomainTaken):
+		registerError(w, http.StatusConflict, codeDomainTaken, "Custom domain already registered")
+		return
+	case errors.Is(err, errTooManyForIP):
+		slog.Warn("Registration rejected, too many tunnels from one address", "subdomain", t.Subdomain,
+			"remote_addr", t.sourceIP, "max_per_ip", s.cfg.Tunnels.MaxPerIP)
+		registerError(w, http.StatusTooManyRequests, codeTooManyForIP, "Too many tunnels registered from this address")
+		return
+	case errors.Is(err, errRegistryFull):
+		slog.Warn("Registration rejected, tunnel limit reached", "subdomain", t.Subdomain, "max_tunnels", s.cfg.Tunnels.MaxTunnels)
+		registerError(w, http.StatusServiceUnavailable, codeTunnelLimit, "Tunnel limit reached")
+		return
+	case err != nil:
+		slog.Error("TCP port allocation failed", "subdomain", t.Subdomain, "err", err)
+		registerError(w, http.StatusServiceUnavailable, codeNoTCPPorts, "No TCP ports available")
+		return
+	}
+	if allocated != nil {
+		go s.serveTCPTunnel(t.Subdomain, allocated)
+	}
+	if evicted != nil {
+		slog.Info("Evicted least recently used tunnel", "subdomain", evicted.Subdomain, "last_active", evicted.LastActive())
+		tunnelsEvicted.Inc()
+		if agent := evicted.Agent(); agent != nil {
+			agent.session.CloseWithCode(websocket.CloseGoingAway, "tunnel evicted")
+		}
+	}
+	if displaced != nil {
+		slog.Info("Dropping stale agent for resumed tunnel", "subdomain", t.Subdomain)
+		displaced.session.CloseWithCode(websocket.ClosePolicyViolation, "tunnel resumed elsewhere")
+	}
+	registrationsTotal.Inc()
+	s.claimTunnel(r.Context(), t)
+
+	slog.Info("Subdomain registered", "subdomain", t.Subdomain, "type", kind, "target", targetURL.String(), "remote_addr", r.RemoteAddr)
+	resp := map[string]any{
+		"status":    "Registered Successfully",
+		"subdomain": t.Subdomain,
+		"url":       s.publicURL(t, listener),
+	}
+	if token, err := s.tokens.issue(r.Context(), t.Subdomain, key.Owner); err == nil {
+		resp["reconnect_token"] = token
+	} else {
+		slog.Warn("Failed to issue reconnect token", "subdomain", t.Subdomain, "err", err)
+	}
+	if listener != nil {
+		resp["port"] = listenerPort(listener)
+	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "Registered Successfully"})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleCheckSubdomain answers whether a subdomain is taken, 200, or free,
+// 404, so agents and tooling can pick a name before registering. Neither
+// answer has a body; an invalid name gets the JSON error registering
+// would. A free name may still be taken by the time it is registered. With
+// auth.require_key_for_lookup it needs a valid key like registering does.
+func (s *Server) handleCheckSubdomain(w http.ResponseWriter, r *http.Request) {
+	subdomain := mux.Vars(r)["subdomain"]
+
+	if s.cfg.Auth.RequireKeyForLookup {
+		if _, ok := s.identify(w, r, r.Header.Get("X-API-Key")); !ok {
+			return
+		}
+	}
+	if err := s.validateSubdomain(subdomain); err != nil {
+		registerError(w, http.StatusBadRequest, codeInvalidSubdomain, "Invalid subdomain: "+err.Error())
+		return
+	}
+
+	// A tunnel whose agent dropped is still reserved for its owner.
+	if _, exists := s.registry.Get(subdomain); exists {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
 }
 
-// ✅ **Improved Subdomain Validation**
-func isValidSubdomain(subdomain string) bool {
-	return len(subdomain) > 0 && strings.IndexFunc(subdomain, func(r rune) bool {
+// handleDeregister removes a tunnel and drops its agent, if connected.
+func (s *Server) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	subdomain := mux.Vars(r)["subdomain"]
+
+	key, ok := s.identify(w, r, r.Header.Get("X-API-Key"))
+	if !ok {
+		return
+	}
+	if !key.Allows(subdomain) {
+		http.Error(w, "Subdomain not permitted for this API key", http.StatusForbidden)
+		return
+	}
+
+	t, exists := s.registry.Get(subdomain)
+	if !exists {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	// A key allowed the name may still not remove someone else's tunnel.
+	if t.owner != key.Owner && !key.Admin {
+		http.Error(w, "Tunnel registered by another API key", http.StatusForbidden)
+		return
+	}
+	if !s.registry.RemoveTunnel(t) {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	agent := t.Agent()
+
+	if agent != nil {
+		agent.session.Close()
+	}
+
+	slog.Info("Subdomain deregistered", "subdomain", subdomain, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDisconnect lets an admin kick a tunnel: its agent, if connected,
+// is dropped and the registration removed. The agent may register again
+// unless its key is revoked too.
+func (s *Server) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.identify(w, r, r.Header.Get("X-API-Key"))
+	if !ok {
+		return
+	}
+	if !key.Admin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	subdomain := mux.Vars(r)["subdomain"]
+	t, exists := s.registry.Remove(subdomain)
+	if !exists {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	agent := t.Agent()
+	if agent != nil {
+		agent.session.CloseWithCode(websocket.ClosePolicyViolation, "disconnected by operator")
+	}
+
+	slog.Info("Tunnel disconnected by admin", "subdomain", subdomain, "admin", key.Name, "connected", agent != nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"subdomain": subdomain, "connected": agent != nil})
+}
+
+// tunnelInfo is the JSON view of a tunnel returned by /tunnels.
+type tunnelInfo struct {
+	Subdomain string            `json:"subdomain"`
+	Domain    string            `json:"custom_domain,omitempty"`
+	Target    string            `json:"target"`
+	Routes    map[string]string `json:"routes,omitempty"`
+	Connected bool              `json:"connected"`
+	Draining  bool              `json:"draining,omitempty"`
+	Streams   int               `json:"streams"` // Open backend connections
+	Bandwidth int64             `json:"max_bytes_per_sec,omitempty"`
+	Cache     int64             `json:"cache_bytes,omitempty"`
+	SourceIP  string            `json:"source_ip,omitempty"` // Address that registered it
+	Since     time.Time         `json:"since"`
+
+	Requests    int64      `json:"requests"`               // HTTP requests or TCP connections proxied
+	BytesIn     int64      `json:"bytes_in"`               // Sent by visitors to the agent
+	BytesOut    int64      `json:"bytes_out"`              // Sent by the agent back to visitors
+	ConnectedAt *time.Time `json:"connected_at,omitempty"` // When the current agent connected
+	LastActive  time.Time  `json:"last_active"`
+
+	Agent *agentStatus `json:"agent,omitempty"` // From the agent's last heartbeat
+}
+
+// handleListTunnels reports every registered tunnel to admins.
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	key, ok := s.identify(w, r, r.Header.Get("X-API-Key"))
+	if !ok {
+		return
+	}
+	if !key.Admin {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tunnels := s.registry.List()
+	list := make([]tunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		agent := t.Agent()
+		info := tunnelInfo{
+			Subdomain: t.Subdomain,
+			Domain:    t.CustomDomain,
+			Target:    t.target.String(),
+			Routes:    t.routeMap(),
+			Connected: agent != nil,
+			Draining:  agent != nil && agent.draining.Load(),
+			Since:     t.registeredAt,
+			Bandwidth: bandwidthLimit(t.bandwidth),
+			Cache:     t.cache.limit(),
+			SourceIP:  t.sourceIP,
+
+			Requests:   t.stats.requests.Load(),
+			BytesIn:    t.stats.bytesIn.Load(),
+			BytesOut:   t.stats.bytesOut.Load(),
+			LastActive: t.LastActive(),
+		}
+		if agent != nil {
+			info.Streams = agent.session.NumStreams()
+			info.ConnectedAt = &agent.connectedAt
+			info.Agent = agent.status.Load()
+		}
+		list = append(list, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// validateSubdomain checks that the name is a DNS label we are willing to
+// hand out, and says which rule it breaks.
+func (s *Server) validateSubdomain(subdomain string) error {
+	switch {
+	case len(subdomain) == 0:
+		return errors.New("must not be empty")
+	case len(subdomain) > 63:
+		return errors.New("must be at most 63 characters")
+	case strings.IndexFunc(subdomain, func(r rune) bool {
 		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
-	}) == -1
+	}) != -1:
+		return errors.New("may only contain lowercase letters, digits and hyphens")
+	case strings.HasPrefix(subdomain, "-") || strings.HasSuffix(subdomain, "-"):
+		return errors.New("must not start or end with a hyphen")
+	}
+
+	for _, reserved := range s.cfg.Tunnels.ReservedSubdomains {
+		if subdomain == reserved {
+			return fmt.Errorf("%q is reserved", subdomain)
+		}
+	}
+	return nil
+}
+
+// maxSubdomainAttempts bounds how many random names one registration tries.
+const maxSubdomainAttempts = 10
+
+// maxSequentialSuffix is the highest number a sequential fallback tries.
+const maxSequentialSuffix = 1000
+
+// Values of RegistrationRequest.Fallback.
+const (
+	fallbackRandom     = "random"
+	fallbackSequential = "sequential"
+)
+
+// randomSubdomain appends a random suffix to base, shortening base so the
+// result stays a valid label. An empty base yields just the suffix.
+func randomSubdomain(base string) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	suffix := make([]byte, 6)
+	for i := range suffix {
+		suffix[i] = alphabet[rand.IntN(len(alphabet))]
+	}
+	if base == "" {
+		return string(suffix)
+	}
+	if len(base) > 63-len(suffix)-1 {
+		base = strings.TrimRight(base[:63-len(suffix)-1], "-")
+	}
+	return base + "-" + string(suffix)
+}
+
+// numberedSubdomain returns base-n, shortening base so the result stays a
+// valid label.
+func numberedSubdomain(base string, n int) string {
+	suffix := "-" + strconv.Itoa(n)
+	if len(base) > 63-len(suffix) {
+		base = strings.TrimRight(base[:63-len(suffix)], "-")
+	}
+	return base + suffix
+}
+
+// validateDomain checks that a custom domain is a fully qualified host name.
+func validateDomain(domain string) error {
+	if len(domain) > 253 {
+		return errors.New("must be at most 253 characters")
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return errors.New("must be a fully qualified host name")
+	}
+	return validateLabels(labels)
+}
+
+// validatePort checks that the agent's local port is a number in 1-65535.
+func validatePort(port string) error {
+	if port == "" {
+		return errors.New("must not be empty")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q is not a port number between 1 and 65535", port)
+	}
+	return nil
+}
+
+// validateTargetHost checks the host an agent forwards to, which may be an
+// IP address or a single-label name such as a container's.
+func validateTargetHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return errors.New("must be at most 253 characters")
+	}
+	return validateLabels(strings.Split(host, "."))
+}
+
+func validateLabels(labels []string) error {
+	for _, label := range labels {
+		switch {
+		case len(label) == 0 || len(label) > 63:
+			return fmt.Errorf("label %q must be 1-63 characters", label)
+		case strings.IndexFunc(label, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
+		}) != -1:
+			return fmt.Errorf("label %q may only contain letters, digits and hyphens", label)
+		case strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-"):
+			return fmt.Errorf("label %q must not start or end with a hyphen", label)
+		}
+	}
+	return nil
 }
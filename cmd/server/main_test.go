@@ -0,0 +1,1121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+	"github.com/rahulthapaofficial/expose-local/pkg/tunnel"
+)
+
+// newTestServer returns a server with the default config and no tunnels.
+func newTestServer(t testing.TB) *Server {
+	t.Helper()
+	s, err := NewServer(config.Default())
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s
+}
+
+func register(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.handleRegister(rec, req)
+	return rec
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"valid", `{"subdomain":"foo","target_port":"3000","api_key":"test123"}`, http.StatusCreated},
+		{"bad api key", `{"subdomain":"foo","target_port":"3000","api_key":"nope"}`, http.StatusUnauthorized},
+		{"invalid subdomain", `{"subdomain":"Foo_Bar","target_port":"3000","api_key":"test123"}`, http.StatusBadRequest},
+		{"leading hyphen", `{"subdomain":"-foo","target_port":"3000","api_key":"test123"}`, http.StatusBadRequest},
+		{"reserved", `{"subdomain":"www","target_port":"3000","api_key":"test123"}`, http.StatusBadRequest},
+		{"missing port", `{"subdomain":"foo","api_key":"test123"}`, http.StatusBadRequest},
+		{"port out of range", `{"subdomain":"foo","target_port":"70000","api_key":"test123"}`, http.StatusBadRequest},
+		{"malformed json", `{"subdomain":`, http.StatusBadRequest},
+		{"routes", `{"subdomain":"foo","target_port":"3000","api_key":"test123","routes":{"/api":"8000"}}`, http.StatusCreated},
+		{"route without slash", `{"subdomain":"foo","target_port":"3000","api_key":"test123","routes":{"api":"8000"}}`, http.StatusBadRequest},
+		{"route bad port", `{"subdomain":"foo","target_port":"3000","api_key":"test123","routes":{"/api":"x"}}`, http.StatusBadRequest},
+		{"duplicate routes", `{"subdomain":"foo","target_port":"3000","api_key":"test123","routes":{"/api":"8000","/api/":"8001"}}`, http.StatusBadRequest},
+		{"tcp routes", `{"subdomain":"foo","target_port":"3000","api_key":"test123","type":"tcp","routes":{"/api":"8000"}}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if rec := register(t, s, tt.body); rec.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	s := newTestServer(t)
+
+	body := `{"subdomain":"foo","target_port":"3000","api_key":"test123"}`
+	if rec := register(t, s, body); rec.Code != http.StatusCreated {
+		t.Fatalf("first register: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	// Another key may not take over the name.
+	s.auth = NewStaticAuthenticator(append(s.cfg.Auth.Keys, config.KeyInfo{Key: "other", Name: "other"}))
+
+	rec := register(t, s, `{"subdomain":"foo","target_port":"3000","api_key":"other"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate register: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+	var reply struct{ Error, Code string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("decode error: %v: %s", err, rec.Body.String())
+	}
+	if reply.Code != codeSubdomainTaken {
+		t.Errorf("code = %q, want %q", reply.Code, codeSubdomainTaken)
+	}
+}
+
+func TestDeregisterRemovesTunnel(t *testing.T) {
+	r := newTestServer(t).Router()
+
+	req := httptest.NewRequest(http.MethodPost, "/register",
+		strings.NewReader(`{"subdomain":"foo","target_port":"3000","api_key":"test123"}`))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/register/foo", nil)
+	req.Header.Set("X-API-Key", "test123")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("deregister: got %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "foo.exposelocal.dev"
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("proxy after deregister: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// A key whose patterns allow the name still may not remove a tunnel another
+// key registered.
+func TestDeregisterRequiresOwner(t *testing.T) {
+	s := newTestServer(t)
+	s.auth = NewStaticAuthenticator(append(s.cfg.Auth.Keys,
+		config.KeyInfo{Key: "team-a", Name: "team-a"},
+		config.KeyInfo{Key: "team-b", Name: "team-b"}))
+	if rec := register(t, s, `{"subdomain":"foo","target_port":"3000","api_key":"team-a"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	deregister := func(key string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/register/foo", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := deregister("team-b"); code != http.StatusForbidden {
+		t.Fatalf("another key: got %d, want %d", code, http.StatusForbidden)
+	}
+	if _, ok := s.registry.Get("foo"); !ok {
+		t.Fatal("tunnel removed by another key")
+	}
+	if code := deregister("team-a"); code != http.StatusNoContent {
+		t.Fatalf("owner: got %d, want %d", code, http.StatusNoContent)
+	}
+}
+
+func TestDeregisterRequiresAPIKey(t *testing.T) {
+	r := newTestServer(t).Router()
+
+	req := httptest.NewRequest(http.MethodDelete, "/register/foo", nil)
+	req.Header.Set("X-API-Key", "wrong")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// startTunnel serves s over HTTP, connects an agent for subdomain "foo"
+// forwarding to backend, and returns the server's base URL.
+func startTunnel(t *testing.T, s *Server, backend *httptest.Server) string {
+	t.Helper()
+	srv := httptest.NewServer(s.Router())
+	t.Cleanup(srv.Close)
+	connectAgent(t, s, srv, backend)
+	return srv.URL
+}
+
+// connectAgent runs an agent that registers subdomain "foo" at srv and
+// forwards it to backend, and waits until its tunnel is attached. When srv
+// serves TLS the agent trusts its certificate. Options adjust the agent's
+// config.
+func connectAgent(t testing.TB, s *Server, srv, backend *httptest.Server, options ...func(*tunnel.Config)) {
+	t.Helper()
+	_, port, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tlsConfig *tls.Config
+	if srv.TLS != nil {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		tlsConfig = &tls.Config{RootCAs: roots}
+	}
+	cfg := tunnel.Config{
+		TunnelURL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+		APIKey:    "test123",
+		Subdomain: "foo",
+		LocalPort: port,
+		TLSConfig: tlsConfig,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := tunnel.New(cfg)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tun, ok := s.registry.Get(cfg.Subdomain); ok && tun.Agent() != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyPreservesGzipBody(t *testing.T) {
+	// Large enough to span several frames and copy buffers.
+	var plain bytes.Buffer
+	for i := 0; plain.Len() < 200*1024; i++ {
+		fmt.Fprintf(&plain, "line %d of a compressible response body\n", i)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(plain.Bytes())
+	zw.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer backend.Close()
+
+	base := startTunnel(t, newTestServer(t), backend)
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/data", nil)
+	req.Host = "foo.exposelocal.dev"
+	req.Header.Set("Accept-Encoding", "gzip")
+	// Keep the transport from decoding the body behind our back.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding: got %q, want gzip", got)
+	}
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(compressed.Len()); got != want {
+		t.Errorf("Content-Length: got %s, want %s", got, want)
+	}
+	if !bytes.Equal(body, compressed.Bytes()) {
+		t.Fatalf("body differs from the backend's gzip bytes (%d vs %d bytes)", len(body), compressed.Len())
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, plain.Bytes()) {
+		t.Fatal("decoded body differs from the original")
+	}
+}
+
+func TestProxyWebSocketEcho(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			kind, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(kind, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	base := startTunnel(t, newTestServer(t), backend)
+
+	header := http.Header{"Host": {"foo.exposelocal.dev"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/chat", header)
+	if err != nil {
+		if resp != nil {
+			t.Fatalf("dial: %v (status %d)", err, resp.StatusCode)
+		}
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"hello", strings.Repeat("x", 100*1024)} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != msg {
+			t.Fatalf("echo: got %d bytes, want %d", len(got), len(msg))
+		}
+	}
+}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	const gap = 200 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(gap)
+		}
+	}))
+	defer backend.Close()
+
+	base := startTunnel(t, newTestServer(t), backend)
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/events", nil)
+	req.Host = "foo.exposelocal.dev"
+	req.Header.Set("Accept", "text/event-stream")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Each event must arrive on its own schedule, not once the backend is
+	// done; the whole response takes three gaps.
+	scanner := bufio.NewScanner(resp.Body)
+	var arrivals []time.Duration
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			arrivals = append(arrivals, time.Since(start))
+			t.Logf("%s at %v", line, arrivals[len(arrivals)-1])
+		}
+	}
+	if len(arrivals) != 3 {
+		t.Fatalf("got %d events, want 3", len(arrivals))
+	}
+	if arrivals[0] >= gap {
+		t.Errorf("first event arrived after %v, want before %v", arrivals[0], gap)
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if d := arrivals[i] - arrivals[i-1]; d < gap/2 {
+			t.Errorf("events %d and %d arrived %v apart, want about %v", i-1, i, d, gap)
+		}
+	}
+}
+
+// Compression is negotiated in the WebSocket handshake; when only one side
+// enables it, the tunnel must fall back to uncompressed frames rather than
+// garble them.
+func TestCompressionNegotiation(t *testing.T) {
+	body := strings.Repeat("compress me if you can\n", 20000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name          string
+		server, agent bool
+	}{
+		{"both", true, true},
+		{"server only", true, false},
+		{"agent only", false, true},
+		{"neither", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Server.Compression = tt.server
+			s, err := NewServer(cfg)
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			srv := httptest.NewServer(s.Router())
+			t.Cleanup(srv.Close)
+			connectAgent(t, s, srv, backend, func(c *tunnel.Config) { c.Compression = tt.agent })
+
+			for i := 0; i < 3; i++ {
+				req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+				req.Host = "foo.exposelocal.dev"
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusOK || string(got) != body {
+					t.Fatalf("request %d: status %d, %d bytes, want 200 with %d bytes", i, resp.StatusCode, len(got), len(body))
+				}
+			}
+		})
+	}
+}
+
+// Another key may not connect as the agent of a registered tunnel.
+func TestTunnelRequiresOwner(t *testing.T) {
+	s := newTestServer(t)
+	s.auth = NewStaticAuthenticator(append(s.cfg.Auth.Keys,
+		config.KeyInfo{Key: "team-a", Name: "team-a"},
+		config.KeyInfo{Key: "team-b", Name: "team-b"}))
+	srv := httptest.NewServer(s.Router())
+	defer srv.Close()
+	if rec := register(t, s, `{"subdomain":"foo","target_port":"3000","api_key":"team-a"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %d", rec.Code)
+	}
+
+	header := http.Header{"X-Api-Key": {"team-b"}, "X-Subdomain": {"foo"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", header)
+	if err == nil {
+		conn.Close()
+		t.Fatal("another key connected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %v, want %d", err, http.StatusForbidden)
+	}
+}
+
+// A message beyond server.max_message_bytes ends the agent's connection
+// instead of being buffered.
+func TestTunnelReadLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.MaxMessageBytes = 64 * 1024
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	srv := httptest.NewServer(s.Router())
+	defer srv.Close()
+	if rec := register(t, s, `{"subdomain":"foo","target_port":"3000","api_key":"test123"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %d", rec.Code)
+	}
+
+	header := http.Header{"X-Api-Key": {"test123"}, "X-Subdomain": {"foo"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tunnel", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 128*1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		_, _, err = conn.ReadMessage() // Frames the session sent first
+	}
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("got %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+// fakeRedis answers AUTH, SET, GET and DEL like Redis, without expiry,
+// and requires the password "secret".
+func fakeRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string]string)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		authed := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				r.ReadString('\n') // $<len>
+				arg, _ := r.ReadString('\n')
+				args[i] = strings.TrimSuffix(arg, "\r\n")
+			}
+			mu.Lock()
+			switch {
+			case args[0] == "AUTH" && args[len(args)-1] == "secret":
+				authed = true
+				io.WriteString(conn, "+OK\r\n")
+			case !authed:
+				io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			case args[0] == "SET":
+				data[args[1]] = args[2]
+				io.WriteString(conn, "+OK\r\n")
+			case args[0] == "GET":
+				if v, ok := data[args[1]]; ok {
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+				} else {
+					io.WriteString(conn, "$-1\r\n")
+				}
+			case args[0] == "DEL":
+				_, ok := data[args[1]]
+				delete(data, args[1])
+				fmt.Fprintf(conn, ":%d\r\n", map[bool]int{true: 1}[ok])
+			default:
+				io.WriteString(conn, "-ERR unknown command\r\n")
+			}
+			mu.Unlock()
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "redis://:secret@" + ln.Addr().String()
+}
+
+// Replicas sharing a Redis token store and secret honour reconnect tokens
+// issued by each other.
+func TestReconnectTokensSharedAcrossReplicas(t *testing.T) {
+	redisURL := fakeRedis(t)
+	replica := func() *Server {
+		cfg := config.Default()
+		cfg.Auth.TokenStore.Backend = config.TokenStoreRedis
+		cfg.Auth.TokenStore.RedisURL = redisURL
+		cfg.Auth.TokenStore.Secret = "0123456789abcdef"
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		return s
+	}
+	a, b := replica(), replica()
+	ctx := context.Background()
+
+	token, err := a.tokens.issue(ctx, "foo", "owner")
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if !b.tokens.valid(ctx, token, "foo", "owner") {
+		t.Error("token issued by one replica rejected by the other")
+	}
+	if b.tokens.valid(ctx, token, "foo", "someone else") {
+		t.Error("token accepted for another owner")
+	}
+	a.tokens.revoke("foo")
+	if b.tokens.valid(ctx, token, "foo", "owner") {
+		t.Error("revoked token still accepted")
+	}
+
+	store, _ := newRedisTokenStore(strings.Replace(redisURL, ":secret@", ":wrong@", 1))
+	if _, _, err := store.Get(ctx, "anything"); err == nil {
+		t.Error("wrong password: got no error")
+	}
+}
+
+// failingListener fails every Accept, with net.ErrClosed once closed.
+type failingListener struct {
+	net.Listener
+	failures int
+}
+
+func (ln *failingListener) Accept() (net.Conn, error) {
+	if ln.failures == 0 {
+		return nil, net.ErrClosed
+	}
+	ln.failures--
+	return nil, errors.New("accept: too many open files")
+}
+
+func TestServeTCPTunnelBacksOffAndStops(t *testing.T) {
+	s := newTestServer(t)
+	start := time.Now()
+	s.serveTCPTunnel("foo", &failingListener{failures: 3})
+	// 5ms, 10ms and 20ms between attempts, then a clean return.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("retried after %v in total, want at least 35ms", elapsed)
+	}
+}
+
+func TestRegisterLimitPerIP(t *testing.T) {
+	cfg := config.Default()
+	cfg.Tunnels.MaxPerIP = 2
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := func(name string) string {
+		return `{"subdomain":"` + name + `","target_port":"3000","api_key":"test123"}`
+	}
+
+	for _, tt := range []struct {
+		name string
+		want int
+	}{
+		{"foo", http.StatusCreated},
+		{"bar", http.StatusCreated},
+		{"baz", http.StatusTooManyRequests},
+		{"foo", http.StatusCreated}, // Replacing one of its own
+	} {
+		if rec := register(t, s, body(tt.name)); rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	// Another address has room of its own.
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body("baz")))
+	req.RemoteAddr = "198.51.100.7:4321"
+	rec := httptest.NewRecorder()
+	s.handleRegister(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("baz from another address: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	s.registry.Remove("bar")
+	if rec := register(t, s, body("qux")); rec.Code != http.StatusCreated {
+		t.Errorf("after removing bar: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
+
+// sessionPair connects a server and an agent session over a WebSocket.
+func sessionPair(t *testing.T) (server, agent *wsmux.Session) {
+	t.Helper()
+	accepted := make(chan *wsmux.Session, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- wsmux.NewSession(conn, true)
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent = wsmux.NewSession(conn, false)
+	server = <-accepted
+	t.Cleanup(func() {
+		agent.Close()
+		server.Close()
+	})
+	return server, agent
+}
+
+// A config file only needs the settings it changes; the rest keep their
+// defaults.
+func TestWebhookAuthenticator(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			APIKey string `json:"api_key"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		calls[req.APIKey]++
+		mu.Unlock()
+		switch req.APIKey {
+		case "alice":
+			fmt.Fprint(w, `{"owner":"alice","name":"Alice","subdomains":["a-*"],"admin":true}`)
+		case "anonymous":
+			fmt.Fprint(w, `{"name":"Anonymous"}`)
+		case "revoked":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "banned":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hook.Close()
+	a := NewWebhookAuthenticator(hook.URL, 0, 0)
+
+	tests := []struct {
+		key       string
+		want      string // "identity", "unauthorized" or "error"
+		wantCalls int    // After authenticating twice
+	}{
+		{"alice", "identity", 1},
+		{"anonymous", "identity", 1},
+		{"revoked", "unauthorized", 1},
+		{"banned", "unauthorized", 1},
+		{"broken", "error", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			var id *Identity
+			var err error
+			for range 2 {
+				id, err = a.Authenticate(context.Background(), tt.key)
+			}
+			got := "identity"
+			if errors.Is(err, errUnauthorized) {
+				got = "unauthorized"
+			} else if err != nil {
+				got = "error"
+			}
+			if got != tt.want {
+				t.Fatalf("got %s (%v), want %s", got, err, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if calls[tt.key] != tt.wantCalls {
+				t.Errorf("webhook called %d times, want %d", calls[tt.key], tt.wantCalls)
+			}
+			if id == nil {
+				return
+			}
+			switch tt.key {
+			case "alice":
+				if id.Owner != "alice" || !id.Admin || !slices.Equal(id.Subdomains, []string{"a-*"}) {
+					t.Errorf("identity = %+v", id)
+				}
+			case "anonymous":
+				if !strings.HasPrefix(id.Owner, "webhook:") {
+					t.Errorf("owner = %q, want a default webhook: owner", id.Owner)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookAuthenticatorCacheBound(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"owner":"someone"}`)
+	}))
+	defer hook.Close()
+	a := NewWebhookAuthenticator(hook.URL, 0, 0)
+	for i := range webhookCacheLimit {
+		a.cache[[32]byte{byte(i), byte(i >> 8)}] = webhookResult{expires: time.Now().Add(time.Hour)}
+	}
+
+	if _, err := a.Authenticate(context.Background(), "new"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.cache) > webhookCacheLimit {
+		t.Errorf("cache holds %d entries, limit is %d", len(a.cache), webhookCacheLimit)
+	}
+}
+
+func TestStateFileRestoresTunnels(t *testing.T) {
+	cfg := config.Default()
+	cfg.Tunnels.StateFile = filepath.Join(t.TempDir(), "tunnels.json")
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"subdomain":"foo","target_port":"3000","api_key":"test123","ttl":"1h"}`,
+		`{"subdomain":"db","target_port":"5432","api_key":"test123","type":"tcp"}`,
+	} {
+		if rec := register(t, s, body); rec.Code != http.StatusCreated {
+			t.Fatalf("register: got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	foo, _ := s.registry.Get("foo")
+	db, _ := s.registry.Get("db")
+	port := listenerPort(db.listener)
+	db.listener.Close() // Free the port for the restored tunnel
+
+	restored, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := restored.registry.Get("foo")
+	if !ok {
+		t.Fatal("foo not restored")
+	}
+	if got.owner != "test123" || !got.registeredAt.Equal(foo.registeredAt) || got.ttl != time.Hour {
+		t.Errorf("foo restored with owner %q, registered %v, ttl %v; want %q, %v, 1h",
+			got.owner, got.registeredAt, got.ttl, "test123", foo.registeredAt)
+	}
+	if got.Agent() != nil || got.disconnectedAt.IsZero() {
+		t.Error("foo restored as connected")
+	}
+	got, ok = restored.registry.Get("db")
+	if !ok {
+		t.Fatal("db not restored")
+	}
+	t.Cleanup(func() { got.listener.Close() })
+	if listenerPort(got.listener) != port {
+		t.Errorf("db restored on port %d, want %d", listenerPort(got.listener), port)
+	}
+}
+
+func TestStateFileCorrupt(t *testing.T) {
+	valid, err := json.Marshal([]savedTunnel{{Subdomain: "foo", Type: tunnelHTTP, Target: "http://localhost:3000", Owner: "test123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"garbage":   []byte("not json"),
+		"truncated": valid[:len(valid)/2],
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Tunnels.StateFile = filepath.Join(t.TempDir(), "tunnels.json")
+			if err := os.WriteFile(cfg.Tunnels.StateFile, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), cfg.Tunnels.StateFile) {
+				t.Errorf("NewServer: got %v, want an error naming the state file", err)
+			}
+		})
+	}
+}
+
+func TestCheckSubdomain(t *testing.T) {
+	s := newTestServer(t)
+	if rec := register(t, s, `{"subdomain":"foo","target_port":"3000","api_key":"test123"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		subdomain string
+		want      int
+		wantCode  string // In the JSON body; empty for no body
+	}{
+		{"foo", http.StatusOK, ""},
+		{"bar", http.StatusNotFound, ""},
+		{"Foo_Bar", http.StatusBadRequest, codeInvalidSubdomain},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/register/"+tt.subdomain, nil))
+		var body struct {
+			Code string `json:"code"`
+		}
+		if tt.wantCode != "" {
+			json.Unmarshal(rec.Body.Bytes(), &body)
+		} else if rec.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body %q", tt.subdomain, rec.Body.String())
+		}
+		if rec.Code != tt.want || body.Code != tt.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", tt.subdomain, rec.Code, body.Code, tt.want, tt.wantCode)
+		}
+	}
+}
+
+// signJWT returns a token with the given header and claims, signed with
+// key for EdDSA, an HMAC secret for HS256, or not at all.
+func signJWT(t *testing.T, key any, header, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := enc(header) + "." + enc(claims)
+	var sig []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewJWTAuthenticator(JWTOptions{PublicKey: keyFile, Issuer: "https://idp", Audience: "expose"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "https://idp", "aud": "expose", "exp": now + 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	eddsa := map[string]any{"alg": "EdDSA"}
+	tests := []struct {
+		name  string
+		token string
+		want  *Identity // Nil for errUnauthorized
+	}{
+		{"valid", signJWT(t, priv, eddsa, claims(nil)), &Identity{Owner: "jwt:alice", Name: "alice"}},
+		{"bad signature", signJWT(t, other, eddsa, claims(nil)), nil},
+		{"alg none", signJWT(t, nil, map[string]any{"alg": "none"}, claims(nil)), nil},
+		{"HS256", signJWT(t, []byte(der), map[string]any{"alg": "HS256"}, claims(nil)), nil},
+		{"no exp", signJWT(t, priv, eddsa, claims(map[string]any{"exp": nil})), nil},
+		{"expired", signJWT(t, priv, eddsa, claims(map[string]any{"exp": now - 120})), nil},
+		{"expired within leeway", signJWT(t, priv, eddsa, claims(map[string]any{"exp": now - 30})), &Identity{Owner: "jwt:alice", Name: "alice"}},
+		{"not valid yet", signJWT(t, priv, eddsa, claims(map[string]any{"nbf": now + 120})), nil},
+		{"nbf within leeway", signJWT(t, priv, eddsa, claims(map[string]any{"nbf": now + 30})), &Identity{Owner: "jwt:alice", Name: "alice"}},
+		{"aud mismatch", signJWT(t, priv, eddsa, claims(map[string]any{"aud": "other"})), nil},
+		{"aud list", signJWT(t, priv, eddsa, claims(map[string]any{"aud": []string{"other", "expose"}})), &Identity{Owner: "jwt:alice", Name: "alice"}},
+		{"aud list without us", signJWT(t, priv, eddsa, claims(map[string]any{"aud": []string{"other"}})), nil},
+		{"iss mismatch", signJWT(t, priv, eddsa, claims(map[string]any{"iss": "https://evil"})), nil},
+		{"no sub", signJWT(t, priv, eddsa, claims(map[string]any{"sub": nil})), nil},
+		{"subdomains and admin", signJWT(t, priv, eddsa, claims(map[string]any{"subdomains": []string{"a-*", "b"}, "admin": true})),
+			&Identity{Owner: "jwt:alice", Name: "alice", Subdomains: []string{"a-*", "b"}, Admin: true}},
+		{"subdomains as a string", signJWT(t, priv, eddsa, claims(map[string]any{"subdomains": "a-* b"})),
+			&Identity{Owner: "jwt:alice", Name: "alice", Subdomains: []string{"a-*", "b"}}},
+		{"no subdomains", signJWT(t, priv, eddsa, claims(map[string]any{"subdomains": []string{}})),
+			&Identity{Owner: "jwt:alice", Name: "alice", Subdomains: []string{""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.Authenticate(context.Background(), tt.token)
+			if tt.want == nil {
+				if !errors.Is(err, errUnauthorized) {
+					t.Fatalf("got %+v, %v; want errUnauthorized", id, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Owner != tt.want.Owner || id.Name != tt.want.Name || id.Admin != tt.want.Admin || !slices.Equal(id.Subdomains, tt.want.Subdomains) {
+				t.Errorf("got %+v, want %+v", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorJWKS(t *testing.T) {
+	type key struct {
+		kid  string
+		priv ed25519.PrivateKey
+	}
+	newKey := func(kid string) key {
+		_, priv, _ := ed25519.GenerateKey(rand.Reader)
+		return key{kid, priv}
+	}
+	var mu sync.Mutex
+	var published []key
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for _, k := range published {
+			x := base64.RawURLEncoding.EncodeToString(k.priv.Public().(ed25519.PublicKey))
+			set.Keys = append(set.Keys, jwk{KeyType: "OKP", Curve: "Ed25519", KeyID: k.kid, X: x})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer jwks.Close()
+	publish := func(keys ...key) {
+		mu.Lock()
+		defer mu.Unlock()
+		published = keys
+	}
+	fetched := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	claims := map[string]any{"sub": "alice", "aud": "expose", "exp": time.Now().Unix() + 60}
+	token := func(k key) string {
+		header := map[string]any{"alg": "EdDSA"}
+		if k.kid != "" {
+			header["kid"] = k.kid
+		}
+		return signJWT(t, k.priv, header, claims)
+	}
+	authenticate := func(a *JWTAuthenticator, k key) error {
+		_, err := a.Authenticate(context.Background(), token(k))
+		return err
+	}
+
+	k1, k2 := newKey("k1"), newKey("k2")
+	publish(k1)
+	a, err := NewJWTAuthenticator(JWTOptions{JWKSURL: jwks.URL, Audience: "expose"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(a, k1); err != nil || fetched() != 1 {
+		t.Fatalf("known kid: got %v after %d fetches, want success after 1", err, fetched())
+	}
+	if err := authenticate(a, key{"", k1.priv}); err != nil {
+		t.Errorf("no kid with one key loaded: got %v", err)
+	}
+
+	// The provider rotates in k2: tokens naming it prompt a refetch, but
+	// no more often than jwksMinRefetch.
+	publish(k1, k2)
+	if err := authenticate(a, k2); !errors.Is(err, errUnauthorized) || fetched() != 1 {
+		t.Fatalf("unknown kid right after a fetch: got %v after %d fetches, want errUnauthorized after 1", err, fetched())
+	}
+	a.keys.mu.Lock()
+	a.keys.fetched = time.Now().Add(-jwksMinRefetch)
+	a.keys.mu.Unlock()
+	if err := authenticate(a, k2); err != nil || fetched() != 2 {
+		t.Fatalf("unknown kid after jwksMinRefetch: got %v after %d fetches, want success after 2", err, fetched())
+	}
+	if err := authenticate(a, key{"", k1.priv}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("no kid with two keys loaded: got %v, want errUnauthorized", err)
+	}
+
+	// A provider that cannot be reached before any keys are loaded is a
+	// backend failure, not a bad token.
+	jwks.Close()
+	a, err = NewJWTAuthenticator(JWTOptions{JWKSURL: jwks.URL, Audience: "expose"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(a, k1); !errors.Is(err, errJWKSUnavailable) {
+		t.Errorf("JWKS down: got %v, want errJWKSUnavailable", err)
+	}
+}
+
+// A drain that cannot be sent leaves the tunnel serving, and one the agent
+// ignores ends with the server closing the session.
+func TestDrainAgent(t *testing.T) {
+	s := newTestServer(t)
+	newAgent := func() (*agentSession, *wsmux.Session) {
+		server, agent := sessionPair(t)
+		return &agentSession{session: server, transport: s.newTunnelTransport(server, nil)}, agent
+	}
+	msg := drainMessage{Type: "drain"}
+
+	failed, _ := newAgent()
+	failed.session.Close()
+	if s.drainAgent("foo", failed, msg) || failed.draining.Load() {
+		t.Error("drain to a closed session left the agent draining")
+	}
+
+	ignored, peer := newAgent()
+	if !s.drainAgent("foo", ignored, msg) {
+		t.Fatal("drain not sent")
+	}
+	select {
+	case <-ignored.session.Done():
+	case <-time.After(drainGrace + 5*time.Second):
+		t.Fatal("session still open after the drain timeout")
+	}
+	select {
+	case <-peer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent not told the session closed")
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(peer.Err(), &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("agent saw %v, want going away", peer.Err())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	registrationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_registrations_total",
+		Help: "Successful subdomain registrations.",
+	})
+	tunnelsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_evictions_total",
+		Help: "Tunnels evicted to make room under tunnels.max_tunnels.",
+	})
+	circuitBreakerTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_circuit_breaker_trips_total",
+		Help: "Times a tunnel's circuit breaker opened after repeated backend failures.",
+	})
+	queueRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_queue_rejections_total",
+		Help: "HTTP requests refused with 503 because a tunnel's request queue was full or the wait timed out.",
+	})
+	handlerPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "http_handler_panics_total",
+		Help: "Requests whose handler panicked and were answered with 500.",
+	})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_cache_requests_total",
+		Help: "GET requests to tunnels with a response cache: hit, revalidated with the backend, or miss.",
+	}, []string{"result"})
+	tunnelsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_active",
+		Help: "Agents currently connected.",
+	})
+	bytesForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bytes_forwarded_total",
+		Help: "Bytes carried over tunnel streams.",
+	}, []string{"direction"})
+	proxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Proxied HTTP requests by subdomain and status code.",
+	}, []string{"subdomain", "code"})
+	proxyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Time to serve proxied HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subdomain"})
+
+	bytesToAgent   = bytesForwarded.WithLabelValues("to_agent")
+	bytesFromAgent = bytesForwarded.WithLabelValues("from_agent")
+)
+
+// observeRequest records a finished proxied request.
+func observeRequest(subdomain string, code int, start time.Time) {
+	proxyRequests.WithLabelValues(subdomain, strconv.Itoa(code)).Inc()
+	proxyDuration.WithLabelValues(subdomain).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder captures the status code and body size written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the recorded code, defaulting to 200.
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Bytes returns the number of body bytes written.
+func (rec *statusRecorder) Bytes() int64 {
+	return rec.bytes
+}
+
+// countingConn tallies bytes moved over a tunnel stream, in total and for
+// its tunnel.
+type countingConn struct {
+	net.Conn
+	stats *tunnelStats
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	bytesFromAgent.Add(float64(n))
+	c.stats.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	bytesToAgent.Add(float64(n))
+	c.stats.bytesIn.Add(int64(n))
+	return n, err
+}
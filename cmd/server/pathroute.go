@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Routing modes selected by proxy.routing.
+const (
+	routeSubdomain = "subdomain" // foo.exposelocal.dev
+	routePath      = "path"      // exposelocal.dev/t/foo/
+)
+
+// route finds the tunnel for a visitor request. Custom domains always
+// match on the host. Otherwise, in path mode the tunnel name is the first
+// segment after proxy.path_prefix and prefix is what must be stripped
+// before forwarding, e.g. "/t/foo"; in subdomain mode prefix is empty.
+func (s *Server) route(r *http.Request) (t *Tunnel, name, prefix string, ok bool) {
+	if s.cfg.Proxy.Routing != routePath {
+		t, name, ok = s.lookup(r.Host)
+		return t, name, "", ok
+	}
+	if t, ok := s.registry.GetByDomain(hostOnly(r.Host)); ok {
+		return t, t.Subdomain, "", true
+	}
+
+	rest, found := strings.CutPrefix(r.URL.Path, s.pathPrefix())
+	if !found {
+		return nil, "", "", false
+	}
+	name, _, _ = strings.Cut(rest, "/")
+	prefix = s.pathPrefix() + name
+	t, ok = s.registry.Get(name)
+	return t, name, prefix, ok
+}
+
+// pathPrefix returns proxy.path_prefix, "/t/" by default, with exactly one
+// trailing slash.
+func (s *Server) pathPrefix() string {
+	if s.cfg.Proxy.PathPrefix == "" {
+		return "/t/"
+	}
+	return strings.TrimSuffix(s.cfg.Proxy.PathPrefix, "/") + "/"
+}
+
+// stripPrefix removes the routing prefix from an outgoing request and tells
+// the backend about it through X-Forwarded-Prefix.
+func stripPrefix(req *http.Request, prefix string) {
+	req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.RawPath, prefix), "/")
+	}
+	req.Header.Set("X-Forwarded-Prefix", prefix)
+}
+
+// prefixRedirects re-adds the routing prefix to redirects the backend sends,
+// which only know about the unprefixed paths. Relative-to-root locations
+// and absolute ones pointing back at the tunnel are rewritten; redirects to
+// other sites are left alone.
+func prefixRedirects(resp *http.Response, prefix, publicHost, scheme string) {
+	for _, header := range []string{"Location", "Content-Location"} {
+		loc := resp.Header.Get(header)
+		if loc == "" {
+			continue
+		}
+		u, err := url.Parse(loc)
+		if err != nil {
+			continue
+		}
+		switch {
+		case u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(loc, "//"):
+			u.Path = prefix + u.Path
+		case u.Host != "" && (strings.EqualFold(u.Host, resp.Request.Host) || strings.EqualFold(u.Host, publicHost)):
+			u.Scheme = scheme
+			u.Host = publicHost
+			u.Path = prefix + "/" + strings.TrimPrefix(u.Path, "/")
+		default:
+			continue
+		}
+		u.RawPath = ""
+		resp.Header.Set(header, u.String())
+	}
+}
+
+// hostOnly lowercases a Host header and drops any port.
+func hostOnly(hostport string) string {
+	host := strings.ToLower(hostport)
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	return host
+}
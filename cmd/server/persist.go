@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// savedTunnel is a registration as written to tunnels.state_file.
+type savedTunnel struct {
+	Subdomain      string            `json:"subdomain"`
+	CustomDomain   string            `json:"custom_domain,omitempty"`
+	Type           string            `json:"type"`
+	Target         string            `json:"target"`
+	Routes         map[string]string `json:"routes,omitempty"`
+	Port           int               `json:"port,omitempty"` // Public port of a TCP tunnel
+	Owner          string            `json:"owner"`
+	RegisteredAt   time.Time         `json:"registered_at"`
+	TTL            time.Duration     `json:"ttl,omitempty"`
+	IdleTimeout    time.Duration     `json:"idle_timeout,omitempty"`
+	MaxBytesPerSec int64             `json:"max_bytes_per_sec,omitempty"`
+	MaxInFlight    int               `json:"max_in_flight,omitempty"`
+	MaxQueued      int               `json:"max_queued,omitempty"`
+	HostHeader     string            `json:"host_header,omitempty"`
+	RespHeaders    map[string]string `json:"response_headers,omitempty"`
+	RemoveHeaders  []string          `json:"remove_response_headers,omitempty"`
+	AllowCIDRs     []string          `json:"allow_cidrs,omitempty"`
+	DenyCIDRs      []string          `json:"deny_cidrs,omitempty"`
+	BasicAuth      *savedAuth        `json:"basic_auth,omitempty"`
+	Wildcard       bool              `json:"wildcard,omitempty"`
+	CacheBytes     int64             `json:"cache_bytes,omitempty"`
+	SourceIP       string            `json:"source_ip,omitempty"`
+}
+
+// savedAuth keeps the salted hash; the password itself is never stored.
+type savedAuth struct {
+	User string `json:"user"`
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+func saveTunnel(t *Tunnel) savedTunnel {
+	st := savedTunnel{
+		Subdomain:      t.Subdomain,
+		CustomDomain:   t.CustomDomain,
+		Type:           t.kind,
+		Target:         t.target.String(),
+		Routes:         t.routeMap(),
+		Owner:          t.owner,
+		RegisteredAt:   t.registeredAt,
+		TTL:            t.ttl,
+		IdleTimeout:    t.idleTimeout,
+		MaxBytesPerSec: bandwidthLimit(t.bandwidth),
+		HostHeader:     t.hostHeader,
+		RespHeaders:    t.headers.setMap(),
+		RemoveHeaders:  t.headers.removeList(),
+		Wildcard:       t.wildcard,
+		CacheBytes:     t.cache.limit(),
+		SourceIP:       t.sourceIP,
+	}
+	st.MaxInFlight, st.MaxQueued = t.queue.limits()
+	if t.listener != nil {
+		st.Port = listenerPort(t.listener)
+	}
+	for _, n := range t.allow {
+		st.AllowCIDRs = append(st.AllowCIDRs, n.String())
+	}
+	for _, n := range t.deny {
+		st.DenyCIDRs = append(st.DenyCIDRs, n.String())
+	}
+	if a := t.basicAuth; a != nil {
+		st.BasicAuth = &savedAuth{User: a.user, Salt: a.salt, Hash: a.hash[:]}
+	}
+	return st
+}
+
+// writeState replaces the state file with list. It writes a temporary
+// file and renames it so a crash never leaves half a file.
+func writeState(path string, list []savedTunnel) error {
+	sort.Slice(list, func(i, j int) bool { return list[i].Subdomain < list[j].Subdomain })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Owners are API keys; CreateTemp makes the file private.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreTunnels loads registrations saved by a previous run. They come
+// back without an agent, reserved for their owners until one reconnects or
+// they expire. Tunnels that cannot be restored, e.g. because their TCP port
+// is taken, are logged and dropped.
+func (s *Server) restoreTunnels(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []savedTunnel
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	now := time.Now()
+	for _, st := range list {
+		t, err := s.restoreTunnel(st)
+		if err != nil {
+			slog.Warn("Dropping saved tunnel", "subdomain", st.Subdomain, "err", err)
+			continue
+		}
+		t.disconnectedAt = now
+		s.registry.Add(t)
+		if t.listener != nil {
+			go s.serveTCPTunnel(t.Subdomain, t.listener)
+		}
+	}
+	slog.Info("Restored tunnels", "path", path, "count", len(s.registry.List()))
+	return nil
+}
+
+func (s *Server) restoreTunnel(st savedTunnel) (*Tunnel, error) {
+	target, err := url.Parse(st.Target)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	routes, err := newBackendRoutes(st.Routes, target.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	allow, err := parseCIDRs(st.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %w", err)
+	}
+	deny, err := parseCIDRs(st.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %w", err)
+	}
+
+	responseHeaders, err := newHeaderRules(st.RespHeaders, st.RemoveHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("response headers: %w", err)
+	}
+
+	t := &Tunnel{
+		Subdomain:    st.Subdomain,
+		CustomDomain: st.CustomDomain,
+		kind:         st.Type,
+		target:       target,
+		routes:       routes,
+		owner:        st.Owner,
+		registeredAt: st.RegisteredAt,
+		ttl:          st.TTL,
+		idleTimeout:  st.IdleTimeout,
+		bandwidth:    newBandwidthLimiter(st.MaxBytesPerSec),
+		queue:        newRequestQueue(st.MaxInFlight, st.MaxQueued),
+		hostHeader:   st.HostHeader,
+		headers:      responseHeaders,
+		allow:        allow,
+		deny:         deny,
+		wildcard:     st.Wildcard,
+		cache:        newResponseCache(st.CacheBytes),
+		sourceIP:     st.SourceIP,
+		breaker:      s.newBreaker(),
+	}
+	if a := st.BasicAuth; a != nil {
+		t.basicAuth = &basicAuth{user: a.User, salt: a.Salt}
+		copy(t.basicAuth.hash[:], a.Hash)
+	}
+	if st.Type == tunnelTCP {
+		if t.listener, err = net.Listen("tcp", ":"+strconv.Itoa(st.Port)); err != nil {
+			return nil, err
+		}
+	}
+	t.touch()
+	return t, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// errQueueFull is returned when a tunnel has as many requests waiting as
+// it may queue.
+var errQueueFull = errors.New("request queue full")
+
+// requestQueue bounds how many requests a tunnel proxies at once. Requests
+// over the limit wait for a slot, up to a fixed number of them; beyond that
+// they are refused, so a flood degrades into 503s instead of goroutines and
+// buffers piling up without bound.
+type requestQueue struct {
+	slots   chan struct{} // Holds a token per request being proxied
+	depth   int64         // Requests allowed to wait for a slot
+	waiting atomic.Int64
+}
+
+// newRequestQueue returns a queue admitting maxInFlight requests at once
+// with up to maxQueued waiting, or nil when maxInFlight is 0.
+func newRequestQueue(maxInFlight, maxQueued int) *requestQueue {
+	if maxInFlight <= 0 {
+		return nil
+	}
+	return &requestQueue{slots: make(chan struct{}, maxInFlight), depth: int64(maxQueued)}
+}
+
+// acquire waits for a slot until ctx is done. The caller must call release
+// once the request is over.
+func (q *requestQueue) acquire(ctx context.Context) error {
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if q.waiting.Add(1) > q.depth {
+		q.waiting.Add(-1)
+		return errQueueFull
+	}
+	defer q.waiting.Add(-1)
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *requestQueue) release() {
+	<-q.slots
+}
+
+// limits returns the settings the queue was created with.
+func (q *requestQueue) limits() (maxInFlight, maxQueued int) {
+	if q == nil {
+		return 0, 0
+	}
+	return cap(q.slots), int(q.depth)
+}
+
+// capLimit applies a server-wide ceiling to a requested limit, where 0
+// means none: asking for nothing, or for more, gets the server's limit.
+func capLimit(requested, limit int) int {
+	if limit > 0 && (requested == 0 || requested > limit) {
+		return limit
+	}
+	return requested
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter keeps a token bucket per tunnel, or per visitor of each
+// tunnel when perIP is set. Registrations are limited with one keyed by
+// API key hash instead of subdomain.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	perIP bool
+
+	mu sync.Mutex
+	m  map[string]map[string]*rate.Limiter // subdomain -> client IP ("" unless perIP) -> bucket
+}
+
+func newRateLimiter(perSecond float64, burst int, perIP bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limit: rate.Limit(perSecond),
+		burst: burst,
+		perIP: perIP,
+		m:     make(map[string]map[string]*rate.Limiter),
+	}
+}
+
+// allow takes a token for the request, or returns how long until one is
+// available.
+func (l *rateLimiter) allow(subdomain, ip string) (bool, time.Duration) {
+	if !l.perIP {
+		ip = ""
+	}
+
+	l.mu.Lock()
+	buckets := l.m[subdomain]
+	if buckets == nil {
+		buckets = make(map[string]*rate.Limiter)
+		l.m[subdomain] = buckets
+	}
+	lim := buckets[ip]
+	if lim == nil {
+		lim = rate.NewLimiter(l.limit, l.burst)
+		buckets[ip] = lim
+	}
+	l.mu.Unlock()
+
+	res := lim.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// forget drops the buckets of a removed tunnel.
+func (l *rateLimiter) forget(subdomain string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.m, subdomain)
+}
+
+// prune drops buckets that have refilled completely; they would be created
+// again in the same state, so only idle visitors are affected.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for subdomain, buckets := range l.m {
+		for ip, lim := range buckets {
+			if lim.TokensAt(now) >= float64(l.burst) {
+				delete(buckets, ip)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(l.m, subdomain)
+		}
+	}
+}
+
+// tooManyRequests answers 429 with a Retry-After rounded up to whole seconds.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// setRetryAfter tells the client how many whole seconds to wait.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconnectTokenTTL bounds how long a token is honoured even if its tunnel
+// is never removed.
+const reconnectTokenTTL = 24 * time.Hour
+
+// reconnectTokens issues the tokens agents present to take their subdomain
+// back after a dropped connection, even before the server has noticed the
+// old one is gone. Tokens are HMAC-signed and also recorded in a
+// TokenStore, so they can be revoked when the tunnel is removed and, with a
+// shared store, honoured by every replica.
+type reconnectTokens struct {
+	secret []byte
+	store  TokenStore // One live token per subdomain, under "reconnect:<subdomain>"
+}
+
+// reconnectToken is the record kept in the store.
+type reconnectToken struct {
+	Token     string    `json:"token"`
+	Subdomain string    `json:"subdomain"`
+	Owner     string    `json:"owner"`
+	Expires   time.Time `json:"expires"`
+}
+
+// newReconnectTokens signs with secret, or a random secret if it is empty.
+func newReconnectTokens(store TokenStore, secret string) (*reconnectTokens, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &reconnectTokens{secret: key, store: store}, nil
+}
+
+func (rt *reconnectTokens) sign(nonce string, tok reconnectToken) string {
+	mac := hmac.New(sha256.New, rt.secret)
+	mac.Write([]byte(strings.Join([]string{nonce, tok.Subdomain, tok.Owner, strconv.FormatInt(tok.Expires.Unix(), 10)}, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func reconnectKey(subdomain string) string {
+	return "reconnect:" + subdomain
+}
+
+// issue returns a fresh token for subdomain, replacing any earlier one.
+func (rt *reconnectTokens) issue(ctx context.Context, subdomain, owner string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+	tok := reconnectToken{Subdomain: subdomain, Owner: owner, Expires: time.Now().Add(reconnectTokenTTL).Truncate(time.Second)}
+	tok.Token = nonce + "." + rt.sign(nonce, tok)
+
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+	if err := rt.store.Save(ctx, reconnectKey(subdomain), string(data), reconnectTokenTTL); err != nil {
+		return "", err
+	}
+	return tok.Token, nil
+}
+
+// valid reports whether token was issued to owner for subdomain and has
+// neither expired nor been revoked. A store that cannot be reached
+// validates nothing.
+func (rt *reconnectTokens) valid(ctx context.Context, token, subdomain, owner string) bool {
+	nonce, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+
+	data, ok, err := rt.store.Get(ctx, reconnectKey(subdomain))
+	if err != nil {
+		slog.Warn("Reconnect token lookup failed", "subdomain", subdomain, "err", err)
+		return false
+	}
+	var tok reconnectToken
+	if !ok || json.Unmarshal([]byte(data), &tok) != nil || !hmac.Equal([]byte(token), []byte(tok.Token)) {
+		return false
+	}
+	if time.Now().After(tok.Expires) || tok.Subdomain != subdomain || tok.Owner != owner {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(rt.sign(nonce, tok)))
+}
+
+// revoke forgets the token for subdomain.
+func (rt *reconnectTokens) revoke(subdomain string) {
+	if err := rt.store.Delete(context.Background(), reconnectKey(subdomain)); err != nil {
+		slog.Warn("Reconnect token revocation failed", "subdomain", subdomain, "err", err)
+	}
+}
+
+// prune drops expired tokens from an in-memory store; shared stores expire
+// them by themselves.
+func (rt *reconnectTokens) prune(now time.Time) {
+	if ms, ok := rt.store.(*memoryTokenStore); ok {
+		ms.prune(now)
+	}
+}
+
+// newResumeID returns 32 random hex digits to name a resumable agent
+// session. Only the agent holding the session learns it.
+func newResumeID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
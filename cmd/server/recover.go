@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panic in next into a 500 for that request alone,
+// logged with its stack, instead of a crash taking every tunnel down.
+// http.ErrAbortHandler is passed on: ReverseProxy panics with it on purpose
+// to drop a visitor's connection mid-response.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			handlerPanics.Inc()
+			slog.Error("Handler panicked", "method", r.Method, "host", r.Host, "path", r.URL.Path,
+				"remote_addr", r.RemoteAddr, "panic", p, "stack", string(debug.Stack()))
+			// Too late for a status once the response has begun or the
+			// connection was taken over; the client sees it cut short.
+			if !pw.started {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(pw, r)
+	})
+}
+
+// panicWriter notes whether a response has begun. It implements
+// http.Hijacker itself since gorilla/websocket does not look through
+// Unwrap.
+type panicWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *panicWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *panicWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (w *panicWriter) Flush() {
+	w.started = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *panicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.started = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *panicWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces our keys in a Redis shared with other software.
+const redisKeyPrefix = "expose-local:"
+
+// redisTimeout bounds each command, including connecting; token lookups sit
+// on the registration path.
+const redisTimeout = 3 * time.Second
+
+// redisTokenStore is a TokenStore in Redis, speaking just enough of the
+// protocol (RESP) for SET, GET and DEL over one connection at a time.
+type redisTokenStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config // Nil for plain redis://
+
+	mu   sync.Mutex // Serializes commands on conn
+	conn net.Conn   // Nil until first use and after an error
+	r    *bufio.Reader
+}
+
+// newRedisTokenStore parses redis://[user:password@]host[:port][/db], or
+// rediss:// for TLS. It does not connect until the store is first used.
+func newRedisTokenStore(rawURL string) (*redisTokenStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	rs := &redisTokenStore{addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		rs.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("redis url must start with redis:// or rediss://, got %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		rs.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rs.username = u.User.Username()
+		rs.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if rs.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis database %q is not a number", db)
+		}
+	}
+	return rs, nil
+}
+
+func (rs *redisTokenStore) Save(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{"SET", redisKeyPrefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := rs.do(ctx, args...)
+	return err
+}
+
+func (rs *redisTokenStore) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := rs.do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	return value, ok, nil
+}
+
+func (rs *redisTokenStore) Delete(ctx context.Context, key string) error {
+	_, err := rs.do(ctx, "DEL", redisKeyPrefix+key)
+	return err
+}
+
+// redisError is an error reply from the server, such as a wrong password.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do sends one command and reads its reply: a string for simple and bulk
+// strings, int64 for integers and nil for a missing value. A broken
+// connection is dropped and dialled afresh by the next command.
+func (rs *redisTokenStore) do(ctx context.Context, args ...string) (any, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.conn == nil {
+		if err := rs.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rs.roundTrip(ctx, args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials the server and logs in. rs.mu must be held.
+func (rs *redisTokenStore) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if rs.tls != nil {
+		dialer := tls.Dialer{Config: rs.tls}
+		conn, err = dialer.DialContext(ctx, "tcp", rs.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", rs.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	rs.conn, rs.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	switch {
+	case rs.username != "":
+		setup = append(setup, []string{"AUTH", rs.username, rs.password})
+	case rs.password != "":
+		setup = append(setup, []string{"AUTH", rs.password})
+	}
+	if rs.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(rs.db)})
+	}
+	for _, args := range setup {
+		if _, err := rs.roundTrip(ctx, args); err != nil {
+			conn.Close()
+			rs.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes args as a RESP array and reads the reply. rs.mu must be
+// held.
+func (rs *redisTokenStore) roundTrip(ctx context.Context, args []string) (any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rs.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rs.conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return readRESP(rs.r)
+}
+
+// readRESP reads one reply that is not an array.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2) // With the trailing CRLF
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// errSubdomainTaken is returned when a name is held by someone else.
+	errSubdomainTaken = errors.New("subdomain already registered")
+
+	// errRegistryFull is returned when max_tunnels is reached and eviction
+	// is off.
+	errRegistryFull = errors.New("tunnel limit reached")
+
+	// errDomainTaken is returned when a custom domain routes to another tunnel.
+	errDomainTaken = errors.New("custom domain already registered")
+
+	// errTooManyForIP is returned when the registering address already
+	// holds tunnels.max_per_ip tunnels.
+	errTooManyForIP = errors.New("too many tunnels for this address")
+)
+
+// Tunnel is a registered subdomain and where the agent forwards it.
+type Tunnel struct {
+	Subdomain    string
+	CustomDomain string // Optional full host name CNAMEd at the proxy
+
+	kind         string // tunnelHTTP or tunnelTCP
+	target       *url.URL
+	routes       []backendRoute // Other local ports by path prefix, longest first
+	listener     net.Listener   // Public listener for TCP tunnels
+	basicAuth    *basicAuth     // Optional credentials required from visitors
+	owner        string         // Identity.Owner of whoever registered the tunnel
+	registeredAt time.Time
+	ttl          time.Duration
+	idleTimeout  time.Duration
+	bandwidth    *rate.Limiter  // Bytes per second in both directions; nil is unthrottled
+	queue        *requestQueue  // Bounds concurrent HTTP requests; nil is unlimited
+	hostHeader   string         // hostPreserve, hostTarget or a literal upstream Host
+	headers      *headerRules   // Set on backend responses; nil leaves them alone
+	allow        []*net.IPNet   // Visitors admitted; empty admits everyone not denied
+	deny         []*net.IPNet   // Visitors refused
+	wildcard     bool           // Also serves every name below the subdomain
+	cache        *responseCache // Stored GET responses; nil unless the registration asked for caching
+	sourceIP     string         // Client address that registered it, counted against tunnels.max_per_ip
+	breaker      *breaker       // Nil when proxy.circuit_breaker is off
+
+	agent          atomic.Pointer[agentSession] // Nil while no agent is connected
+	disconnectedAt time.Time                    // Guarded by Registry.mu; zero while connected
+	lastActivity   atomic.Int64                 // Unix nanoseconds of the last proxied request
+	stats          tunnelStats
+}
+
+// tunnelStats counts a tunnel's traffic since it was registered. The
+// counters sit on the proxy's hot path, hence atomics rather than a lock.
+type tunnelStats struct {
+	requests atomic.Int64 // HTTP requests and TCP connections
+	bytesIn  atomic.Int64 // Visitor to agent
+	bytesOut atomic.Int64 // Agent to visitor
+}
+
+// agentSession is a connected agent and the transport that opens streams on it.
+type agentSession struct {
+	session     *wsmux.Session
+	transport   *http.Transport
+	connectedAt time.Time
+	status      atomic.Pointer[agentStatus] // Last heartbeat; nil until one arrives
+	draining    atomic.Bool                 // Told to disconnect; gets no new requests
+	resumeID    string                      // Names a resumable session to the agent; empty for v1
+}
+
+// Agent returns the connected agent, or nil.
+func (t *Tunnel) Agent() *agentSession {
+	return t.agent.Load()
+}
+
+func (t *Tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LastActive is the later of the last proxied request and the last stream
+// traffic with the agent; heartbeats do not count.
+func (t *Tunnel) LastActive() time.Time {
+	last := time.Unix(0, t.lastActivity.Load())
+	if agent := t.Agent(); agent != nil && agent.session.LastActivity().After(last) {
+		last = agent.session.LastActivity()
+	}
+	return last
+}
+
+// release frees resources held by a tunnel that is being removed.
+func (t *Tunnel) release() {
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+}
+
+// Registry holds every tunnel known to a server.
+type Registry struct {
+	mu      sync.RWMutex
+	m       map[string]*Tunnel
+	domains map[string]*Tunnel   // Custom domains to the tunnels they route to
+	expired map[string]time.Time // Recently expired subdomains, answered with 410
+
+	// max caps the number of tunnels; 0 is unlimited. When full, a new
+	// claim evicts the least recently used tunnel if evictLRU is set and
+	// fails with errRegistryFull otherwise.
+	max      int
+	evictLRU bool
+
+	// maxPerIP caps the tunnels registered from one client address; 0 is
+	// unlimited. byIP counts them.
+	maxPerIP int
+	byIP     map[string]int
+
+	// onRemove, if set, is called under the lock for every tunnel removed.
+	onRemove func(t *Tunnel)
+
+	// statePath, if set, is rewritten whenever a call adds or removes
+	// tunnels, so registrations survive a restart.
+	statePath string
+	dirty     bool
+	snapshots uint64     // Counts copies taken for the state file
+	writeMu   sync.Mutex // Serialises writes, which happen outside mu
+	written   uint64     // The latest snapshot on disk; guarded by writeMu
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		m:       make(map[string]*Tunnel),
+		domains: make(map[string]*Tunnel),
+		expired: make(map[string]time.Time),
+		byIP:    make(map[string]int),
+	}
+}
+
+// Get returns the tunnel registered for subdomain.
+func (r *Registry) Get(subdomain string) (*Tunnel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.m[subdomain]
+	return t, ok
+}
+
+// GetByDomain returns the tunnel a custom domain routes to.
+func (r *Registry) GetByDomain(domain string) (*Tunnel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.domains[domain]
+	return t, ok
+}
+
+// Add stores t, replacing any existing tunnel with the same name.
+func (r *Registry) Add(t *Tunnel) {
+	r.mu.Lock()
+	defer r.unlock()
+	if old, ok := r.m[t.Subdomain]; ok && old != t {
+		r.delete(old)
+	}
+	r.store(t)
+}
+
+// store indexes t by name and custom domain. r.mu must be held.
+func (r *Registry) store(t *Tunnel) {
+	r.dirty = true
+	r.m[t.Subdomain] = t
+	if t.sourceIP != "" {
+		r.byIP[t.sourceIP]++
+	}
+	if t.CustomDomain != "" {
+		r.domains[t.CustomDomain] = t
+	}
+	delete(r.expired, t.Subdomain)
+}
+
+// delete unindexes and releases t. r.mu must be held.
+func (r *Registry) delete(t *Tunnel) {
+	r.dirty = true
+	if r.m[t.Subdomain] == t {
+		delete(r.m, t.Subdomain)
+		if t.sourceIP != "" {
+			if r.byIP[t.sourceIP]--; r.byIP[t.sourceIP] <= 0 {
+				delete(r.byIP, t.sourceIP)
+			}
+		}
+	}
+	if t.CustomDomain != "" && r.domains[t.CustomDomain] == t {
+		delete(r.domains, t.CustomDomain)
+	}
+	t.release()
+	if r.onRemove != nil {
+		r.onRemove(t)
+	}
+}
+
+// unlock releases r.mu, then writes the state file if anything changed.
+// The tunnels are copied under the lock and written outside it, so a slow
+// disk does not hold up lookups. A failed write is logged and retried on
+// the next change.
+func (r *Registry) unlock() {
+	if !r.dirty || r.statePath == "" {
+		r.mu.Unlock()
+		return
+	}
+	list := make([]savedTunnel, 0, len(r.m))
+	for _, t := range r.m {
+		list = append(list, saveTunnel(t))
+	}
+	r.dirty = false
+	r.snapshots++
+	snapshot := r.snapshots
+	r.mu.Unlock()
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	if snapshot < r.written {
+		return // A later snapshot is already on disk
+	}
+	if err := writeState(r.statePath, list); err != nil {
+		slog.Error("Failed to save tunnel state", "path", r.statePath, "err", err)
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+		return
+	}
+	r.written = snapshot
+}
+
+// Save writes the state file after a tunnel changed in place, e.g. its
+// bandwidth cap.
+func (r *Registry) Save() {
+	r.mu.Lock()
+	r.dirty = true
+	r.unlock()
+}
+
+// Claim stores t unless its name is held by a connected agent or by a
+// different owner, or its custom domain routes to another subdomain. With
+// resume set, the owner may take the name over from a connected agent too.
+// prepare, if set, runs under the lock with the tunnel
+// being replaced (or nil) and may veto the claim by returning an error.
+// If the registry is full, the tunnel evicted to make room is returned so
+// the caller can drop its agent.
+func (r *Registry) Claim(t *Tunnel, resume bool, prepare func(old *Tunnel) error) (evicted *Tunnel, err error) {
+	return r.ClaimUnique(t, resume, nil, prepare)
+}
+
+// ClaimUnique is Claim, except that while t's subdomain is taken it renames
+// t to whatever next returns and tries again, all under one lock so that
+// concurrent registrations cannot pick the same name. It gives up with
+// errSubdomainTaken once next returns "". A nil next behaves like Claim.
+func (r *Registry) ClaimUnique(t *Tunnel, resume bool, next func() string, prepare func(old *Tunnel) error) (evicted *Tunnel, err error) {
+	r.mu.Lock()
+	defer r.unlock()
+
+	for {
+		evicted, err = r.claim(t, resume, prepare)
+		if !errors.Is(err, errSubdomainTaken) || next == nil {
+			return evicted, err
+		}
+		name := next()
+		if name == "" {
+			return nil, err
+		}
+		t.Subdomain = name
+		resume = false // The token was for the original name
+	}
+}
+
+func (r *Registry) claim(t *Tunnel, resume bool, prepare func(old *Tunnel) error) (*Tunnel, error) {
+	old := r.m[t.Subdomain]
+	if old != nil && (old.Agent() != nil && !resume || old.owner != t.owner) {
+		return nil, errSubdomainTaken
+	}
+	if t.CustomDomain != "" {
+		if other, ok := r.domains[t.CustomDomain]; ok && other.Subdomain != t.Subdomain {
+			return nil, errDomainTaken
+		}
+	}
+	if r.maxPerIP > 0 && t.sourceIP != "" {
+		held := r.byIP[t.sourceIP]
+		if old != nil && old.sourceIP == t.sourceIP {
+			held-- // Replaced, so it frees its place
+		}
+		if held >= r.maxPerIP {
+			return nil, errTooManyForIP
+		}
+	}
+	var evicted *Tunnel
+	if old == nil && r.max > 0 && len(r.m) >= r.max {
+		if !r.evictLRU {
+			return nil, errRegistryFull
+		}
+		evicted = r.leastRecentlyUsed()
+	}
+	if prepare != nil {
+		if err := prepare(old); err != nil {
+			return nil, err
+		}
+	}
+	if old != nil {
+		r.delete(old)
+	}
+	if evicted != nil {
+		r.delete(evicted)
+	}
+	r.store(t)
+	return evicted, nil
+}
+
+// leastRecentlyUsed returns the tunnel that has gone longest without
+// traffic.
+func (r *Registry) leastRecentlyUsed() *Tunnel {
+	var lru *Tunnel
+	var lruActive time.Time
+	for _, t := range r.m {
+		if active := t.LastActive(); lru == nil || active.Before(lruActive) {
+			lru, lruActive = t, active
+		}
+	}
+	return lru
+}
+
+// Remove deletes the tunnel and returns it so the caller can drop its agent.
+func (r *Registry) Remove(subdomain string) (*Tunnel, bool) {
+	r.mu.Lock()
+	defer r.unlock()
+	t, ok := r.m[subdomain]
+	if !ok {
+		return nil, false
+	}
+	r.delete(t)
+	return t, true
+}
+
+// RemoveTunnel deletes t if it is still registered, rather than whatever
+// holds its name by now.
+func (r *Registry) RemoveTunnel(t *Tunnel) bool {
+	r.mu.Lock()
+	defer r.unlock()
+	if r.m[t.Subdomain] != t {
+		return false
+	}
+	r.delete(t)
+	return true
+}
+
+// List returns every tunnel sorted by subdomain.
+func (r *Registry) List() []*Tunnel {
+	r.mu.RLock()
+	list := make([]*Tunnel, 0, len(r.m))
+	for _, t := range r.m {
+		list = append(list, t)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Subdomain < list[j].Subdomain })
+	return list
+}
+
+// Attach records agent as the live connection for t, replacing any previous
+// one. It fails if t has been removed or replaced in the meantime.
+func (r *Registry) Attach(t *Tunnel, agent *agentSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[t.Subdomain] != t {
+		return false
+	}
+	t.agent.Store(agent)
+	t.disconnectedAt = time.Time{}
+	return true
+}
+
+// Detach clears agent from its tunnel if it is still the live connection.
+// It reports whether the tunnel is now without an agent.
+func (r *Registry) Detach(t *Tunnel, agent *agentSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !t.agent.CompareAndSwap(agent, nil) {
+		return false
+	}
+	t.disconnectedAt = time.Now()
+	return true
+}
+
+// RemoveIfDisconnected deletes t if it is still registered and has had no
+// agent for at least grace.
+func (r *Registry) RemoveIfDisconnected(t *Tunnel, grace time.Duration) bool {
+	r.mu.Lock()
+	defer r.unlock()
+	if r.m[t.Subdomain] != t || t.Agent() != nil || t.disconnectedAt.IsZero() {
+		return false
+	}
+	if time.Since(t.disconnectedAt) < grace {
+		return false
+	}
+	r.delete(t)
+	return true
+}
+
+// Expire removes every tunnel for which expire returns a non-empty reason,
+// remembering the name so later requests can be answered with 410.
+func (r *Registry) Expire(now time.Time, expire func(t *Tunnel) string) map[*Tunnel]string {
+	r.mu.Lock()
+	defer r.unlock()
+
+	removed := make(map[*Tunnel]string)
+	for subdomain, t := range r.m {
+		reason := expire(t)
+		if reason == "" {
+			continue
+		}
+		r.delete(t)
+		r.expired[subdomain] = now
+		removed[t] = reason
+	}
+
+	for subdomain, at := range r.expired {
+		if now.Sub(at) >= expiredRetention {
+			delete(r.expired, subdomain)
+		}
+	}
+	return removed
+}
+
+// IsExpired reports whether the subdomain was recently expired.
+func (r *Registry) IsExpired(subdomain string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.expired[subdomain]
+	return ok
+}
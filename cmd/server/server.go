@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	config "github.com/rahulthapaofficial/expose-local/configs"
+	"github.com/rahulthapaofficial/expose-local/internal/bufpool"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultBaseDomain is the zone subdomains are served under unless
+// server.base_domain says otherwise.
+const defaultBaseDomain = "exposelocal.dev"
+
+// Server owns the tunnel registry and everything the handlers need, so
+// several instances can run side by side in one process.
+type Server struct {
+	cfg            *config.Config
+	registry       *Registry
+	buffers        *bufpool.Pool
+	auth           Authenticator  // Checks API keys
+	clients        []Identity     // Certificate identities, named by subject
+	clientCAs      *x509.CertPool // Set when agents may authenticate with certificates
+	trustedProxies []*net.IPNet   // Peers whose X-Forwarded-* headers are believed
+	upgrader       websocket.Upgrader
+	upgrades       chan struct{} // Holds a token per agent handshake in progress; nil is unlimited
+	accessLog      *accessLogger // Nil when access logging is off
+	limiter        *rateLimiter  // Nil when rate limiting is off
+	registerLimit  *rateLimiter  // Registrations per API key, keyed by its hash; nil when off
+	tokens         *reconnectTokens
+	certManager    *autocert.Manager // Set when TLS certificates come from ACME
+	cluster        *cluster          // Nil when running alone
+	errorPage      *template.Template
+
+	// reconnectGrace is how long a dropped agent's subdomain stays reserved.
+	reconnectGrace time.Duration
+
+	// ready is set once every listener is accepting and cleared on shutdown.
+	ready atomic.Bool
+}
+
+// NewServer builds a server from cfg with an empty registry.
+func NewServer(cfg *config.Config) (*Server, error) {
+	proxies, err := parseCIDRs(cfg.Proxy.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("proxy.trusted_proxies: %w", err)
+	}
+
+	s := &Server{
+		cfg:            cfg,
+		registry:       NewRegistry(),
+		buffers:        bufpool.New(cfg.Server.BufferSize),
+		trustedProxies: proxies,
+		reconnectGrace: 30 * time.Second,
+	}
+	s.upgrader = websocket.Upgrader{
+		HandshakeTimeout:  s.handshakeTimeout(),
+		Subprotocols:      wsmux.Protocols, // Newest first, as gorilla picks the first the agent offers
+		CheckOrigin:       s.checkOrigin,
+		EnableCompression: cfg.Server.Compression,
+		ReadBufferSize:    cfg.Server.WSReadBuffer,
+		WriteBufferSize:   cfg.Server.WSWriteBuffer,
+	}
+	if n := cfg.Server.MaxPendingUpgrades; n > 0 {
+		s.upgrades = make(chan struct{}, n)
+	}
+	s.registry.onRemove = s.tunnelRemoved
+	s.registry.max = cfg.Tunnels.MaxTunnels
+	s.registry.maxPerIP = cfg.Tunnels.MaxPerIP
+	s.registry.evictLRU = cfg.Tunnels.EvictLRU
+	store, err := newTokenStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("auth.token_store: %w", err)
+	}
+	if s.tokens, err = newReconnectTokens(store, cfg.Auth.TokenStore.Secret); err != nil {
+		return nil, err
+	}
+	if s.auth, err = newAuthenticator(cfg); err != nil {
+		return nil, err
+	}
+	if s.cluster, err = newCluster(cfg); err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+
+	if mode := cfg.Auth.Mode; mode == config.AuthMTLS || mode == config.AuthEither {
+		if s.clientCAs, err = loadClientCAs(cfg.Auth.ClientCA); err != nil {
+			return nil, fmt.Errorf("auth.client_ca: %w", err)
+		}
+		// Certificates get owners of their own so that an API key and a
+		// certificate never count as the same owner by accident.
+		for _, c := range cfg.Auth.Clients {
+			s.clients = append(s.clients, Identity{
+				Owner:      "cert:" + c.Subject,
+				Name:       c.Subject,
+				Subdomains: c.Subdomains,
+				Admin:      c.Admin,
+			})
+		}
+	}
+
+	if cfg.Server.TLS.Enabled && cfg.Server.TLS.Autocert {
+		s.certManager = newCertManager(cfg)
+	}
+
+	if rl := cfg.Proxy.RateLimit; rl.RequestsPerSecond > 0 {
+		s.limiter = newRateLimiter(rl.RequestsPerSecond, rl.Burst, rl.PerClientIP)
+	}
+	if rr := cfg.Tunnels.RegisterRate; rr.PerMinute > 0 {
+		s.registerLimit = newRateLimiter(rr.PerMinute/60, rr.Burst, false)
+	}
+
+	if s.errorPage, err = loadErrorPage(cfg.Proxy.ErrorPage); err != nil {
+		return nil, fmt.Errorf("proxy.error_page: %w", err)
+	}
+
+	if cfg.Log.AccessLog != "" {
+		if s.accessLog, err = newAccessLogger(cfg.Log.AccessLog, cfg.Log.AccessFormat); err != nil {
+			return nil, fmt.Errorf("log.access_log: %w", err)
+		}
+	}
+
+	if path := cfg.Tunnels.StateFile; path != "" {
+		if err := s.restoreTunnels(path); err != nil {
+			return nil, fmt.Errorf("tunnels.state_file: %w", err)
+		}
+		s.registry.statePath = path
+	}
+	return s, nil
+}
+
+// baseDomain returns the zone every subdomain is served under.
+func (s *Server) baseDomain() string {
+	if s.cfg.Server.BaseDomain == "" {
+		return defaultBaseDomain
+	}
+	return s.cfg.Server.BaseDomain
+}
+
+// Router wires every endpoint; the catch-all proxy route must stay last.
+func (s *Server) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(s.recoverPanics)
+
+	// Endpoints
+	api := r.MatcherFunc(s.forServer).Subrouter()
+	api.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	api.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	api.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	api.HandleFunc("/register", s.handleRegister).Methods("POST")
+	api.HandleFunc("/register/{subdomain}", s.handleCheckSubdomain).Methods("GET")
+	api.HandleFunc("/register/{subdomain}", s.handleDeregister).Methods("DELETE")
+	api.HandleFunc("/tunnel", s.handleTunnel).Methods("GET")
+	api.HandleFunc("/tunnels", s.handleListTunnels).Methods("GET")
+	api.HandleFunc("/tunnels/{subdomain}/bandwidth", s.handleSetBandwidth).Methods("PUT")
+	api.HandleFunc("/admin/disconnect/{subdomain}", s.handleDisconnect).Methods("POST")
+	api.HandleFunc("/admin/drain", s.handleDrain).Methods("POST")
+	api.HandleFunc("/admin/drain/{subdomain}", s.handleDrain).Methods("POST")
+	r.PathPrefix("/").Handler(s.requestID(s.logAccess(s.securityHeaders(http.HandlerFunc(s.handleHTTP)))))
+
+	return r
+}
+
+// forServer matches requests for the server's own endpoints: those for any
+// host but one a tunnel is registered under, so that tunnelled apps keep
+// their own /metrics, /healthz and the like. A name the endpoints are
+// served under belongs in tunnels.reserved_subdomains.
+func (s *Server) forServer(r *http.Request, _ *mux.RouteMatch) bool {
+	host := hostOnly(r.Host)
+	if host == s.baseDomain() || net.ParseIP(host) != nil {
+		return true
+	}
+	if s.cfg.Proxy.Routing == routePath {
+		_, ok := s.registry.GetByDomain(host)
+		return !ok
+	}
+	_, _, ok := s.lookup(r.Host)
+	return !ok
+}
+
+// tunnelRemoved drops per-tunnel state kept outside the registry. It runs
+// under the registry lock.
+func (s *Server) tunnelRemoved(t *Tunnel) {
+	s.tokens.revoke(t.Subdomain)
+	s.releaseTunnel(t)
+	if s.limiter != nil {
+		s.limiter.forget(t.Subdomain)
+	}
+}
+
+// seedTestTunnel registers the "test" subdomain pointing at port 80.
+func (s *Server) seedTestTunnel() {
+	testTarget, _ := url.Parse("http://127.0.0.1:80")
+	s.registry.Add(&Tunnel{Subdomain: "test", kind: tunnelHTTP, target: testTarget, registeredAt: time.Now()})
+}
+
+// httpServer returns a server for addr with the configured connection
+// timeouts and header limit.
+func (s *Server) httpServer(addr string, h http.Handler) *http.Server {
+	readHeaderTimeout := s.cfg.Server.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = 10 * time.Second
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       s.cfg.Server.ReadTimeout,
+		WriteTimeout:      s.cfg.Server.WriteTimeout,
+		IdleTimeout:       s.cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    s.cfg.Server.MaxHeaderBytes,
+	}
+}
+
+// Run serves the tunnel and proxy ports until ctx is cancelled, then shuts
+// down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	r := s.Router()
+
+	go s.runJanitor(ctx, janitorInterval)
+
+	servers := []*http.Server{
+		s.httpServer(":"+strconv.Itoa(s.cfg.Server.TunnelPort), r), // WebSocket server
+		s.httpServer(":"+strconv.Itoa(s.cfg.Server.Port), r),       // HTTP reverse proxy
+	}
+	servers[0].ReadHeaderTimeout = s.handshakeTimeout()
+
+	// With TLS, net/http offers h2 unless TLSNextProto is non-nil. Requests
+	// reach the agent as HTTP/1.1 either way; disabling h2 only changes what
+	// visitors negotiate.
+	if !s.cfg.Server.HTTP2 {
+		servers[1].TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	// Bind every listener and load TLS material up front so that readiness
+	// reflects servers that can actually accept connections.
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		ln, err := s.listen(srv, i == 0)
+		if err != nil {
+			for _, ln := range listeners[:i] {
+				ln.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", srv.Addr, err)
+		}
+		listeners[i] = ln
+	}
+
+	// ACME HTTP-01 challenges arrive over plain HTTP; everything else on
+	// that port is redirected to https.
+	if s.certManager != nil && s.cfg.Server.TLS.HTTPAddr != "" {
+		srv := s.httpServer(s.cfg.Server.TLS.HTTPAddr, s.certManager.HTTPHandler(nil))
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", srv.Addr, err)
+		}
+		servers = append(servers, srv)
+		listeners = append(listeners, ln)
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			slog.Info("Starting server", "addr", srv.Addr)
+			if err := serve(srv, ln); err != nil && err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("server on %s: %w", srv.Addr, err)
+			}
+		}(srv, listeners[i])
+	}
+	s.ready.Store(true)
+
+	var runErr error
+	select {
+	case runErr = <-errCh:
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server")
+	s.ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// Let in-flight requests finish before the tunnels they use go away.
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("Shutdown incomplete", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	s.closeAllSessions()
+	s.releaseTunnels(shutdownCtx)
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	return runErr
+}
+
+// listen binds the server's address and, when TLS is enabled, loads the
+// certificate or hooks up the ACME manager in srv.TLSConfig. On the tunnel
+// port it also asks agents for client certificates if auth.mode uses them.
+func (s *Server) listen(srv *http.Server, tunnelPort bool) (net.Listener, error) {
+	if s.certManager != nil {
+		srv.TLSConfig = s.certManager.TLSConfig()
+		if srv.TLSNextProto != nil {
+			srv.TLSConfig = withoutH2(srv.TLSConfig)
+		}
+	} else if s.cfg.Server.TLS.Enabled {
+		cert, err := tls.LoadX509KeyPair(s.cfg.Server.TLS.Cert, s.cfg.Server.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if tunnelPort && s.clientCAs != nil && srv.TLSConfig != nil {
+		srv.TLSConfig.ClientCAs = s.clientCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.cfg.Auth.Mode == config.AuthMTLS {
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return net.Listen("tcp", srv.Addr)
+}
+
+// serve runs plain HTTP unless listen configured TLS.
+func serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// closeAllSessions disconnects every agent. Hijacked WebSocket connections
+// are not tracked by http.Server.Shutdown, so this is done by hand.
+func (s *Server) closeAllSessions() {
+	for _, t := range s.registry.List() {
+		if agent := t.Agent(); agent != nil {
+			agent.session.CloseWithCode(websocket.CloseGoingAway, "server shutting down")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	tunnelHTTP = "http"
+	tunnelTCP  = "tcp"
+)
+
+// allocateTCPListener binds the first free port in the configured range.
+func (s *Server) allocateTCPListener() (net.Listener, error) {
+	for port := s.cfg.Tunnels.TCPPortMin; port <= s.cfg.Tunnels.TCPPortMax; port++ {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d", s.cfg.Tunnels.TCPPortMin, s.cfg.Tunnels.TCPPortMax)
+}
+
+// listenerPort returns the port a listener is bound to.
+func listenerPort(ln net.Listener) int {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Bounds of the pause after a failed accept, doubled while failures
+// continue, as net/http does.
+const (
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
+)
+
+// serveTCPTunnel accepts public connections for a TCP tunnel until the
+// listener is closed. Other accept errors, such as running out of file
+// descriptors, are usually temporary; it pauses and tries again rather
+// than spinning on them.
+func (s *Server) serveTCPTunnel(subdomain string, ln net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, acceptRetryMin), acceptRetryMax)
+			slog.Warn("TCP accept error", "subdomain", subdomain, "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go s.bridgeTCP(subdomain, conn)
+	}
+}
+
+// bridgeTCP carries one public connection over a new stream to the agent.
+func (s *Server) bridgeTCP(subdomain string, client net.Conn) {
+	defer client.Close()
+	logger := slog.With("subdomain", subdomain, "remote_addr", client.RemoteAddr().String())
+
+	t, exists := s.registry.Get(subdomain)
+	var agent *agentSession
+	if exists {
+		agent = t.Agent()
+	}
+	if agent == nil || agent.draining.Load() {
+		logger.Warn("No agent connected for TCP tunnel")
+		return
+	}
+	if host, _, _ := net.SplitHostPort(client.RemoteAddr().String()); !t.admits(host) {
+		logger.Info("TCP connection refused by CIDR rules")
+		return
+	}
+	t.touch()
+	t.stats.requests.Add(1)
+
+	stream, err := agent.session.Open()
+	if err != nil {
+		logger.Warn("Failed to open stream", "err", err)
+		return
+	}
+	defer stream.Close()
+	logger = logger.With("stream_id", stream.ID())
+	logger.Debug("TCP connection opened")
+
+	// Each direction ends on its own: EOF from one side is passed on as a
+	// half-close so the other can keep sending, and only an error tears
+	// the whole connection down.
+	conn := t.throttle(countingConn{stream, &t.stats})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := s.buffers.Get()
+		defer s.buffers.Put(buf)
+		if _, err := io.CopyBuffer(conn, client, buf); err != nil {
+			stream.Close()
+			return
+		}
+		stream.CloseWrite()
+	}()
+
+	buf := s.buffers.Get()
+	defer s.buffers.Put(buf)
+	if _, err := io.CopyBuffer(client, conn, buf); err != nil || !stream.Writable() || closeWrite(client) != nil {
+		client.Close()
+	}
+	<-done
+	logger.Debug("TCP connection closed")
+}
+
+// closeWrite shuts down the sending side of conn, if it has one.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	config "github.com/rahulthapaofficial/expose-local/configs"
+)
+
+// TokenStore keeps the tokens the server issues, such as agents' reconnect
+// tokens. The in-memory store serves a single server; a shared one such as
+// Redis lets replicas behind a load balancer honour each other's tokens.
+type TokenStore interface {
+	// Save stores value under key, replacing any earlier value, until ttl
+	// has passed. A ttl of 0 keeps it until deleted.
+	Save(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get returns the value under key; ok is false if there is none or it
+	// has expired.
+	Get(ctx context.Context, key string) (value string, ok bool, err error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// newTokenStore returns the store selected by auth.token_store.
+func newTokenStore(cfg *config.Config) (TokenStore, error) {
+	switch cfg.Auth.TokenStore.Backend {
+	case "", config.TokenStoreMemory:
+		return newMemoryTokenStore(), nil
+	case config.TokenStoreRedis:
+		return newRedisTokenStore(cfg.Auth.TokenStore.RedisURL)
+	default:
+		return nil, fmt.Errorf("unknown token store %q", cfg.Auth.TokenStore.Backend)
+	}
+}
+
+// memoryTokenStore is a TokenStore private to this process.
+type memoryTokenStore struct {
+	mu sync.Mutex
+	m  map[string]memoryToken
+}
+
+type memoryToken struct {
+	value   string
+	expires time.Time // Zero never expires
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{m: make(map[string]memoryToken)}
+}
+
+func (ms *memoryTokenStore) Save(_ context.Context, key, value string, ttl time.Duration) error {
+	tok := memoryToken{value: value}
+	if ttl > 0 {
+		tok.expires = time.Now().Add(ttl)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.m[key] = tok
+	return nil
+}
+
+func (ms *memoryTokenStore) Get(_ context.Context, key string) (string, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	tok, ok := ms.m[key]
+	if !ok || !tok.expires.IsZero() && time.Now().After(tok.expires) {
+		return "", false, nil
+	}
+	return tok.value, true, nil
+}
+
+func (ms *memoryTokenStore) Delete(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.m, key)
+	return nil
+}
+
+// prune drops expired tokens, which Get already ignores, to free memory.
+func (ms *memoryTokenStore) prune(now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key, tok := range ms.m {
+		if !tok.expires.IsZero() && now.After(tok.expires) {
+			delete(ms.m, key)
+		}
+	}
+}
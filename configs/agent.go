@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Agent is the agent's configuration file.
+type Agent struct {
+	Proxy           string        `yaml:"proxy"`             // Tunnel WebSocket URL
+	Register        string        `yaml:"register"`          // Registration URL; derived from proxy when empty
+	BaseDomain      string        `yaml:"base_domain"`       // Zone the server serves subdomains under, for logging the public URL
+	APIKey          string        `yaml:"api_key"`           // Authentication key
+	APIKeyFile      string        `yaml:"api_key_file"`      // File holding the key; overrides api_key
+	BufferSize      int           `yaml:"buffer_size"`       // Bytes per pooled copy buffer
+	Compression     bool          `yaml:"compression"`       // Offer permessage-deflate
+	WSReadBuffer    int           `yaml:"ws_read_buffer"`    // WebSocket read buffer in bytes; 0 is 4KB
+	WSWriteBuffer   int           `yaml:"ws_write_buffer"`   // WebSocket write buffer in bytes; 0 is 4KB
+	MaxMessageBytes int64         `yaml:"max_message_bytes"` // Largest WebSocket message accepted from the server; 0 is 4MB
+	Keepalive       time.Duration `yaml:"keepalive"`         // Interval between WebSocket pings; 0 disables
+	Heartbeat       time.Duration `yaml:"heartbeat"`         // Interval between version and health reports to the server; 0 disables
+	DialTimeout     time.Duration `yaml:"dial_timeout"`      // Limit on connecting to local services
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`      // Close local connections idle this long; 0 disables
+	WaitForPort     time.Duration `yaml:"wait_for_port"`     // Wait up to this long for local services to accept connections before going live; 0 does not wait
+	OneShot         bool          `yaml:"one_shot"`          // Exit when the server drains a tunnel instead of reconnecting
+	TLS             struct {
+		Cert string `yaml:"cert"` // Client certificate for servers using mutual TLS
+		Key  string `yaml:"key"`
+		CA   string `yaml:"ca"` // Roots for the server's certificate; system roots when empty
+	} `yaml:"tls"`
+	Backoff struct {
+		Initial             time.Duration `yaml:"initial"`               // First reconnect delay
+		Max                 time.Duration `yaml:"max"`                   // Reconnect delay ceiling
+		MaxRegisterAttempts int           `yaml:"max_register_attempts"` // Failed registrations before exiting; 0 retries forever
+	} `yaml:"backoff"`
+	Log struct {
+		Level  string `yaml:"level"`  // debug, info, warn or error
+		Format string `yaml:"format"` // text or json
+	} `yaml:"log"`
+	Tunnels []AgentTunnel `yaml:"tunnels"`
+}
+
+// AgentTunnel maps one subdomain to a local port.
+type AgentTunnel struct {
+	Subdomain      string            `yaml:"subdomain"`
+	Port           string            `yaml:"port"`
+	Target         string            `yaml:"target"`                  // Host, or host:port, running the service; defaults to localhost
+	Routes         map[string]string `yaml:"routes"`                  // Path prefix to another port on the same host, e.g. /api: "8000"; the longest match wins
+	Type           string            `yaml:"type"`                    // http or tcp
+	BasicAuth      string            `yaml:"basic_auth"`              // Optional user:pass required from visitors
+	Domain         string            `yaml:"domain"`                  // Optional custom domain CNAMEd at the proxy
+	HostHeader     string            `yaml:"host_header"`             // preserve, target or a literal value
+	MaxBytesPerSec int64             `yaml:"max_bytes_per_sec"`       // Throughput cap; 0 takes the server's limit
+	MaxInFlight    int               `yaml:"max_in_flight"`           // HTTP requests served at once; 0 takes the server's limit
+	MaxQueued      int               `yaml:"max_queued"`              // Requests waiting for a slot before 503; 0 takes the server's limit
+	AllowCIDRs     []string          `yaml:"allow_cidrs"`             // Visitor IPs or CIDRs admitted; empty admits all not denied
+	DenyCIDRs      []string          `yaml:"deny_cidrs"`              // Visitor IPs or CIDRs refused
+	Wildcard       bool              `yaml:"wildcard"`                // Also route every name below the subdomain to this tunnel
+	CacheBytes     int64             `yaml:"cache_bytes"`             // Memory the server may use to cache GET responses marked cacheable; 0 disables
+	Fallback       string            `yaml:"fallback"`                // When the subdomain is taken: random (default) or sequential, e.g. foo-2
+	RespHeaders    map[string]string `yaml:"response_headers"`        // Set on every response, e.g. CORS headers
+	RemoveHeaders  []string          `yaml:"remove_response_headers"` // Removed from every response, e.g. Server
+}
+
+// DefaultAgent returns the agent configuration used when no file is given.
+func DefaultAgent() *Agent {
+	cfg := &Agent{}
+	cfg.Proxy = "wss://reverse-proxy-tunneling.onrender.com/tunnel"
+	cfg.APIKey = "test123"
+	cfg.BufferSize = 32 * 1024
+	cfg.Keepalive = 20 * time.Second
+	cfg.Heartbeat = 30 * time.Second
+	cfg.DialTimeout = 10 * time.Second
+	cfg.IdleTimeout = 5 * time.Minute
+	cfg.BaseDomain = "exposelocal.dev"
+	cfg.Backoff.Initial = 2 * time.Second
+	cfg.Backoff.Max = 60 * time.Second
+	cfg.Log.Level = "info"
+	cfg.Log.Format = "text"
+	cfg.Tunnels = []AgentTunnel{{Subdomain: "test", Port: "80", Type: "http"}}
+	return cfg
+}
+
+// LoadAgent reads an agent config file. Settings it omits keep their
+// defaults, except tunnels, which the file replaces as a whole.
+func LoadAgent(path string) (*Agent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultAgent()
+	cfg.Tunnels = nil
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
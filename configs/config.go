@@ -1,31 +1,244 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"os"
+	"time"
 )
 
 type Config struct {
 	Server struct {
-		Port int `yaml:"port"`
-		TLS  struct {
-			Enabled bool   `yaml:"enabled"`
-			Cert    string `yaml:"cert"`
-			Key     string `yaml:"key"`
+		Port               int           `yaml:"port"`
+		TunnelPort         int           `yaml:"tunnel_port"`
+		BaseDomain         string        `yaml:"base_domain"`          // Zone subdomains are served under, e.g. exposelocal.dev
+		BufferSize         int           `yaml:"buffer_size"`          // Bytes per pooled copy buffer
+		ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`     // How long in-flight requests may drain
+		HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`    // Limit on an agent's request headers, authentication and WebSocket upgrade; 0 means 10s
+		MaxPendingUpgrades int           `yaml:"max_pending_upgrades"` // Agent connections being authenticated and upgraded at once; more get 503; 0 is unlimited
+		ReadHeaderTimeout  time.Duration `yaml:"read_header_timeout"`  // Limit on receiving a visitor's request headers; 0 means 10s
+		ReadTimeout        time.Duration `yaml:"read_timeout"`         // Limit on receiving a whole request, body included; 0 disables
+		WriteTimeout       time.Duration `yaml:"write_timeout"`        // Limit on sending a response, from the end of the headers; 0 disables
+		IdleTimeout        time.Duration `yaml:"idle_timeout"`         // Keep-alive connections idle this long are closed; 0 means read_timeout
+		MaxHeaderBytes     int           `yaml:"max_header_bytes"`     // Largest request header block; more gets 431; 0 means 1MB
+		AllowedOrigins     []string      `yaml:"allowed_origins"`      // Browser origins that may open tunnels; "*" allows any
+		Compression        bool          `yaml:"compression"`          // Accept permessage-deflate from agents that offer it
+		HTTP2              bool          `yaml:"http2"`                // Offer h2 to visitors on the public TLS listener
+		WSReadBuffer       int           `yaml:"ws_read_buffer"`       // WebSocket I/O buffer per agent connection; 0 is gorilla's 4KB
+		WSWriteBuffer      int           `yaml:"ws_write_buffer"`      // Larger buffers mean fewer syscalls per frame, more memory per agent
+		MaxMessageBytes    int64         `yaml:"max_message_bytes"`    // Largest WebSocket message an agent may send before it is disconnected; 0 means 4MB
+		MaxBodyBytes       int64         `yaml:"max_body_bytes"`       // Largest JSON body accepted by /register and admin endpoints; 0 means 64KB
+		TLS                struct {
+			Enabled  bool     `yaml:"enabled"`
+			Cert     string   `yaml:"cert"`
+			Key      string   `yaml:"key"`
+			Autocert bool     `yaml:"autocert"`  // Obtain certificates from Let's Encrypt instead of cert/key
+			CacheDir string   `yaml:"cache_dir"` // Where issued certificates are kept between restarts
+			Domains  []string `yaml:"domains"`   // Host names to request certificates for
+			Email    string   `yaml:"email"`     // Contact for expiry notices; optional
+			HTTPAddr string   `yaml:"http_addr"` // Serves HTTP-01 challenges and redirects to https, e.g. ":80"
 		} `yaml:"tls"`
 	} `yaml:"server"`
+	Log struct {
+		Level        string `yaml:"level"`         // debug, info, warn or error
+		Format       string `yaml:"format"`        // text or json
+		AccessLog    string `yaml:"access_log"`    // File for proxied requests; "-" is stdout, empty disables
+		AccessFormat string `yaml:"access_format"` // combined or json
+	} `yaml:"log"`
+	Proxy struct {
+		TrustedProxies  []string      `yaml:"trusted_proxies"` // CIDRs whose X-Forwarded-* headers are kept
+		HostHeader      string        `yaml:"host_header"`     // Upstream Host: preserve, target or a literal value
+		Routing         string        `yaml:"routing"`         // subdomain (foo.example.com) or path (example.com/t/foo/)
+		PathPrefix      string        `yaml:"path_prefix"`     // Where tunnel names start in path routing, e.g. "/t/"
+		ErrorPage       string        `yaml:"error_page"`      // html/template shown to browsers when a tunnel cannot answer
+		RequestTimeout  time.Duration `yaml:"request_timeout"` // Limit on a whole proxied request; WebSockets and SSE are exempt; 0 disables
+		SecurityHeaders struct {
+			HSTS                  bool          `yaml:"hsts"`                    // Send Strict-Transport-Security on HTTPS responses
+			HSTSMaxAge            time.Duration `yaml:"hsts_max_age"`            // How long browsers insist on HTTPS
+			HSTSIncludeSubdomains bool          `yaml:"hsts_include_subdomains"` // Extend HSTS to every name below the requested one
+			NoSniff               bool          `yaml:"nosniff"`                 // X-Content-Type-Options: nosniff
+			FrameOptions          string        `yaml:"frame_options"`           // X-Frame-Options: DENY or SAMEORIGIN; empty sends none
+		} `yaml:"security_headers"`
+		CircuitBreaker struct {
+			Failures int           `yaml:"failures"` // Consecutive backend failures that open the breaker; 0 disables
+			Cooldown time.Duration `yaml:"cooldown"` // How long requests get 503 before a probe is let through
+		} `yaml:"circuit_breaker"`
+		RateLimit struct {
+			RequestsPerSecond float64 `yaml:"requests_per_second"` // Sustained rate per tunnel; 0 disables
+			Burst             int     `yaml:"burst"`               // Requests allowed at once above the rate
+			PerClientIP       bool    `yaml:"per_client_ip"`       // Track each visitor separately within a tunnel
+		} `yaml:"rate_limit"`
+		Transport struct {
+			MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"` // Idle streams kept open to each agent for reuse; 0 means 32
+			IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`       // How long an idle stream is kept; 0 means 90s
+			ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"` // Wait for a backend's response headers before answering 504; 0 waits indefinitely
+			MaxHeaderBytes        int           `yaml:"max_header_bytes"`        // Largest header block passed over a tunnel either way; 0 means 1MB
+			MaxHeaders            int           `yaml:"max_headers"`             // Most header fields passed over a tunnel either way; 0 means 200
+		} `yaml:"transport"`
+	} `yaml:"proxy"`
+	Tunnels struct {
+		TTL                time.Duration `yaml:"ttl"`                  // Maximum tunnel lifetime; 0 disables
+		IdleTimeout        time.Duration `yaml:"idle_timeout"`         // Expire after this long without traffic; 0 disables
+		TCPPortMin         int           `yaml:"tcp_port_min"`         // First public port handed to TCP tunnels
+		TCPPortMax         int           `yaml:"tcp_port_max"`         // Last public port handed to TCP tunnels
+		ReservedSubdomains []string      `yaml:"reserved_subdomains"`  // Names that can never be registered
+		MaxConnsPerTunnel  int           `yaml:"max_conns_per_tunnel"` // Concurrent streams per agent; 0 is unlimited
+		MaxBytesPerSec     int64         `yaml:"max_bytes_per_sec"`    // Throughput cap per tunnel, both directions; 0 is unlimited
+		MaxCacheBytes      int64         `yaml:"max_cache_bytes"`      // Largest GET response cache a registration may ask for; 0 disables caching
+		MaxInFlight        int           `yaml:"max_in_flight"`        // HTTP requests proxied at once per tunnel; 0 is unlimited
+		MaxQueued          int           `yaml:"max_queued"`           // Requests waiting for one of those slots; more get 503
+		MaxTunnels         int           `yaml:"max_tunnels"`          // Registered tunnels across all keys; 0 is unlimited
+		MaxPerIP           int           `yaml:"max_per_ip"`           // Registered tunnels per client address; 0 is unlimited
+		EvictLRU           bool          `yaml:"evict_lru"`            // When full, evict the least recently used tunnel instead of refusing
+		StateFile          string        `yaml:"state_file"`           // JSON file registrations are saved to and restored from; empty keeps them in memory
+		SeedTestTunnel     bool          `yaml:"seed_test_tunnel"`     // Register "test" → http://127.0.0.1:80 at startup, for development
+		RegisterRate       struct {
+			PerMinute float64 `yaml:"per_minute"` // Sustained registrations per API key; 0 disables
+			Burst     int     `yaml:"burst"`      // Registrations allowed at once above the rate
+		} `yaml:"register_rate"`
+	} `yaml:"tunnels"`
 	Auth struct {
-		APIKey string `yaml:"api_key"`
+		Mode       string       `yaml:"mode"`    // api_key, mtls, or either (a client certificate if presented, else the key)
+		Backend    string       `yaml:"backend"` // Who checks API keys: static (the keys below), webhook or jwt
+		APIKey     string       `yaml:"api_key"`
+		APIKeyFile string       `yaml:"api_key_file"` // File holding the key, e.g. a Docker secret; overrides api_key
+		Keys       []KeyInfo    `yaml:"keys"`
+		ClientCA   string       `yaml:"client_ca"` // PEM bundle that signs agent certificates on the tunnel port
+		Clients    []ClientCert `yaml:"clients"`   // Certificate identities and the subdomains they may claim
+		Webhook    struct {
+			URL      string        `yaml:"url"`       // Receives POST {"api_key": ...}; answers 200 with the identity or 401/403
+			Timeout  time.Duration `yaml:"timeout"`   // Per call; 0 means 5s
+			CacheTTL time.Duration `yaml:"cache_ttl"` // How long answers are reused; 0 means 1m
+		} `yaml:"webhook"`
+		JWT struct {
+			PublicKey       string        `yaml:"public_key"`       // PEM public key or certificate the provider signs with; or
+			JWKSURL         string        `yaml:"jwks_url"`         // The provider's JSON Web Key Set, refreshed hourly
+			Issuer          string        `yaml:"issuer"`           // Required iss claim; empty accepts any
+			Audience        string        `yaml:"audience"`         // Must appear in the aud claim
+			SubdomainsClaim string        `yaml:"subdomains_claim"` // Claim with the allowed subdomain patterns; default "subdomains", absent allows any
+			AdminClaim      string        `yaml:"admin_claim"`      // Boolean claim granting the operator endpoints; default "admin"
+			Leeway          time.Duration `yaml:"leeway"`           // Clock skew tolerated on exp and nbf; 0 means 1m
+		} `yaml:"jwt"`
+		RequireKeyForLookup bool `yaml:"require_key_for_lookup"` // GET /register/{subdomain} needs a key; otherwise anyone may ask if a name is taken
+		TokenStore          struct {
+			Backend  string `yaml:"backend"`   // Where issued reconnect tokens are kept: memory (default) or redis, shared by replicas
+			RedisURL string `yaml:"redis_url"` // redis://[user:password@]host[:port][/db], or rediss:// for TLS
+			Secret   string `yaml:"secret"`    // Signs reconnect tokens; the same on every replica. Required with redis; random per process otherwise
+		} `yaml:"token_store"`
 	} `yaml:"auth"`
+	Cluster struct {
+		NodeURL  string `yaml:"node_url"`  // How the other replicas reach this one, e.g. http://10.0.0.5:8080; empty runs standalone
+		RedisURL string `yaml:"redis_url"` // Shared record of which replica holds each tunnel; empty uses auth.token_store.redis_url
+	} `yaml:"cluster"`
 }
 
+// Authentication modes for agents.
+const (
+	AuthAPIKey = "api_key"
+	AuthMTLS   = "mtls"
+	AuthEither = "either"
+)
+
+// Token store backends.
+const (
+	TokenStoreMemory = "memory"
+	TokenStoreRedis  = "redis"
+)
+
+// API key backends.
+const (
+	AuthBackendStatic  = "static"
+	AuthBackendWebhook = "webhook"
+	AuthBackendJWT     = "jwt"
+)
+
+// ClientCert maps an agent certificate, by common name or DNS SAN, to the
+// subdomains it may claim.
+type ClientCert struct {
+	Subject    string   `yaml:"subject"`    // Common name or DNS SAN
+	Subdomains []string `yaml:"subdomains"` // Glob patterns; empty allows any subdomain
+	Admin      bool     `yaml:"admin"`      // May use the operator endpoints
+}
+
+// KeyInfo is an API key and the subdomains it may claim.
+type KeyInfo struct {
+	Key        string   `yaml:"key"`
+	Name       string   `yaml:"name"`
+	Subdomains []string `yaml:"subdomains"` // Glob patterns; empty allows any subdomain
+	Admin      bool     `yaml:"admin"`      // May use the operator endpoints
+}
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	cfg := &Config{}
+	cfg.Server.Port = 8080
+	cfg.Server.TunnelPort = 8081
+	cfg.Server.BaseDomain = "exposelocal.dev"
+	cfg.Server.BufferSize = 32 * 1024
+	cfg.Server.ShutdownTimeout = 15 * time.Second
+	cfg.Server.HandshakeTimeout = 10 * time.Second
+	cfg.Server.MaxPendingUpgrades = 100
+	cfg.Server.ReadHeaderTimeout = 10 * time.Second
+	cfg.Server.ReadTimeout = 5 * time.Minute
+	cfg.Server.WriteTimeout = 5 * time.Minute
+	cfg.Server.IdleTimeout = 2 * time.Minute
+	cfg.Server.MaxHeaderBytes = 64 * 1024
+	cfg.Server.MaxMessageBytes = 4 << 20
+	cfg.Server.AllowedOrigins = []string{"*"}
+	cfg.Server.HTTP2 = true
+	cfg.Server.MaxBodyBytes = 64 * 1024
+	cfg.Log.AccessFormat = "combined"
+	cfg.Proxy.HostHeader = "preserve"
+	cfg.Proxy.Routing = "subdomain"
+	cfg.Proxy.PathPrefix = "/t/"
+	cfg.Proxy.SecurityHeaders.HSTSMaxAge = 365 * 24 * time.Hour
+	cfg.Proxy.SecurityHeaders.NoSniff = true
+	cfg.Proxy.RateLimit.Burst = 20
+	cfg.Proxy.Transport.MaxIdleConnsPerHost = 32
+	cfg.Proxy.Transport.IdleConnTimeout = 90 * time.Second
+	cfg.Proxy.Transport.MaxHeaderBytes = 1 << 20
+	cfg.Proxy.Transport.MaxHeaders = 200
+	cfg.Tunnels.TCPPortMin = 20000
+	cfg.Tunnels.TCPPortMax = 20999
+	cfg.Tunnels.MaxQueued = 100
+	cfg.Tunnels.MaxCacheBytes = 16 << 20
+	cfg.Tunnels.RegisterRate.PerMinute = 30
+	cfg.Tunnels.RegisterRate.Burst = 20
+	cfg.Tunnels.ReservedSubdomains = []string{"www", "api", "admin", "test"}
+	cfg.Auth.Mode = AuthAPIKey
+	cfg.Auth.Backend = AuthBackendStatic
+	cfg.Auth.Keys = []KeyInfo{{Key: "test123", Name: "default", Admin: true}}
+	return cfg
+}
+
+// LoadConfig reads the YAML file at path over Default and validates it.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg := &Config{}
-	err = yaml.Unmarshal(data, cfg)
-	return cfg, err
+	// Settings the file leaves out keep their defaults, except the
+	// development key: a file without keys must not accept test123.
+	cfg := Default()
+	cfg.Auth.Keys = nil
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return cfg, err
+	}
+
+	// $TUNNEL_API_KEY and api_key_file take precedence over the inline key.
+	key, err := ResolveAPIKey(cfg.Auth.APIKey, cfg.Auth.APIKeyFile)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Auth.APIKey = key
+
+	// The single api_key is shorthand for an unrestricted admin key.
+	if cfg.Auth.APIKey != "" {
+		cfg.Auth.Keys = append(cfg.Auth.Keys, KeyInfo{Key: cfg.Auth.APIKey, Name: "default", Admin: true})
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
 }
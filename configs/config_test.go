@@ -0,0 +1,38 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	t.Setenv("TUNNEL_API_KEY", "")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	data := "server:\n  port: 9090\nauth:\n  api_key: secret\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	def := Default()
+	if cfg.Server.Port != 9090 {
+		t.Errorf("port = %d, want 9090", cfg.Server.Port)
+	}
+	if cfg.Server.TunnelPort != def.Server.TunnelPort || cfg.Server.ShutdownTimeout != def.Server.ShutdownTimeout {
+		t.Errorf("tunnel_port, shutdown_timeout = %d, %v; want the defaults", cfg.Server.TunnelPort, cfg.Server.ShutdownTimeout)
+	}
+	if !slices.Equal(cfg.Tunnels.ReservedSubdomains, def.Tunnels.ReservedSubdomains) ||
+		cfg.Tunnels.MaxQueued != def.Tunnels.MaxQueued ||
+		cfg.Tunnels.MaxCacheBytes != def.Tunnels.MaxCacheBytes ||
+		cfg.Tunnels.RegisterRate != def.Tunnels.RegisterRate {
+		t.Errorf("tunnels = %+v, want the defaults", cfg.Tunnels)
+	}
+	if len(cfg.Auth.Keys) != 1 || cfg.Auth.Keys[0].Key != "secret" {
+		t.Errorf("keys = %+v, want only the configured one", cfg.Auth.Keys)
+	}
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// APIKeyEnv names the environment variable holding the API key.
+const APIKeyEnv = "TUNNEL_API_KEY"
+
+// ResolveAPIKey picks the API key from $TUNNEL_API_KEY or the contents of
+// file, falling back to the inline value. The environment and the file may
+// both be set only if they agree.
+func ResolveAPIKey(inline, file string) (string, error) {
+	env := os.Getenv(APIKeyEnv)
+
+	var fromFile string
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("api_key_file: %w", err)
+		}
+		fromFile = strings.TrimSpace(string(data))
+		if fromFile == "" {
+			return "", fmt.Errorf("api_key_file %s is empty", file)
+		}
+	}
+
+	switch {
+	case env != "" && fromFile != "" && env != fromFile:
+		return "", fmt.Errorf("$%s and api_key_file %s hold different keys; set only one", APIKeyEnv, file)
+	case env != "":
+		return env, nil
+	case fromFile != "":
+		return fromFile, nil
+	}
+	return inline, nil
+}
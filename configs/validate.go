@@ -0,0 +1,259 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// Validate reports every problem with the configuration at once, so a bad
+// file is fixed in one pass rather than one error per restart.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	checkPort := func(name string, port int) {
+		if port < 1 || port > 65535 {
+			add("%s must be between 1 and 65535, got %d", name, port)
+		}
+	}
+	checkPort("server.port", c.Server.Port)
+	checkPort("server.tunnel_port", c.Server.TunnelPort)
+	if c.Server.Port == c.Server.TunnelPort && c.Server.Port != 0 {
+		add("server.port and server.tunnel_port must differ, both are %d", c.Server.Port)
+	}
+	if d := c.Server.BaseDomain; d != "" && (d != strings.ToLower(d) || strings.ContainsAny(d, ":/ ") || strings.HasPrefix(d, ".") || strings.HasSuffix(d, ".")) {
+		add("server.base_domain must be a lowercase host name without scheme or port, got %q", d)
+	}
+	if c.Server.BufferSize < 0 {
+		add("server.buffer_size must not be negative")
+	}
+	if c.Server.WSReadBuffer < 0 || c.Server.WSWriteBuffer < 0 {
+		add("server.ws_read_buffer and server.ws_write_buffer must not be negative")
+	}
+	if n := c.Server.MaxMessageBytes; n != 0 && n < wsmux.MaxFrameSize {
+		add("server.max_message_bytes must be 0 or at least %d, the largest tunnel frame, got %d", wsmux.MaxFrameSize, n)
+	}
+	if c.Server.MaxBodyBytes < 0 {
+		add("server.max_body_bytes must not be negative")
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		add("server.shutdown_timeout must not be negative")
+	}
+	if c.Server.HandshakeTimeout < 0 || c.Server.MaxPendingUpgrades < 0 {
+		add("server.handshake_timeout and max_pending_upgrades must not be negative")
+	}
+	if c.Server.ReadHeaderTimeout < 0 || c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		add("server read, write and idle timeouts must not be negative")
+	}
+	if c.Server.MaxHeaderBytes < 0 {
+		add("server.max_header_bytes must not be negative")
+	}
+
+	if c.Server.TLS.Enabled {
+		checkFile := func(name, path string) {
+			if path == "" {
+				add("%s is required when server.tls.enabled is true", name)
+				return
+			}
+			if _, err := os.Stat(path); err != nil {
+				add("%s: %v", name, err)
+			}
+		}
+		if c.Server.TLS.Autocert {
+			if len(c.Server.TLS.Domains) == 0 {
+				add("server.tls.domains is required when server.tls.autocert is true")
+			}
+			for _, d := range c.Server.TLS.Domains {
+				if strings.HasPrefix(d, "*.") {
+					add("server.tls.domains: wildcard %q needs DNS-01, which autocert cannot do", d)
+				}
+			}
+		} else {
+			checkFile("server.tls.cert", c.Server.TLS.Cert)
+			checkFile("server.tls.key", c.Server.TLS.Key)
+		}
+	} else if c.Server.TLS.Autocert {
+		add("server.tls.autocert requires server.tls.enabled")
+	}
+
+	if c.Log.AccessFormat != "" && !strings.EqualFold(c.Log.AccessFormat, "combined") && !strings.EqualFold(c.Log.AccessFormat, "json") {
+		add("log.access_format must be combined or json, got %q", c.Log.AccessFormat)
+	}
+
+	switch c.Proxy.Routing {
+	case "", "subdomain":
+	case "path":
+		if p := c.Proxy.PathPrefix; p != "" && (!strings.HasPrefix(p, "/") || strings.Trim(p, "/") == "") {
+			add("proxy.path_prefix must be an absolute path below /, e.g. /t/, got %q", c.Proxy.PathPrefix)
+		}
+	default:
+		add("proxy.routing must be subdomain or path, got %q", c.Proxy.Routing)
+	}
+	if c.Proxy.ErrorPage != "" {
+		if _, err := os.Stat(c.Proxy.ErrorPage); err != nil {
+			add("proxy.error_page: %v", err)
+		}
+	}
+	if c.Proxy.RequestTimeout < 0 {
+		add("proxy.request_timeout must not be negative")
+	}
+	sh := c.Proxy.SecurityHeaders
+	if sh.HSTS && sh.HSTSMaxAge <= 0 {
+		add("proxy.security_headers.hsts_max_age must be positive when hsts is on")
+	}
+	switch sh.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		add("proxy.security_headers.frame_options must be DENY or SAMEORIGIN, got %q", sh.FrameOptions)
+	}
+	if c.Proxy.CircuitBreaker.Failures < 0 || c.Proxy.CircuitBreaker.Cooldown < 0 {
+		add("proxy.circuit_breaker.failures and cooldown must not be negative")
+	}
+	if c.Proxy.RateLimit.RequestsPerSecond < 0 {
+		add("proxy.rate_limit.requests_per_second must not be negative")
+	}
+	if tr := c.Proxy.Transport; tr.MaxIdleConnsPerHost < 0 || tr.IdleConnTimeout < 0 || tr.ResponseHeaderTimeout < 0 ||
+		tr.MaxHeaderBytes < 0 || tr.MaxHeaders < 0 {
+		add("proxy.transport settings must not be negative")
+	}
+
+	t := c.Tunnels
+	if t.RegisterRate.PerMinute < 0 || t.RegisterRate.Burst < 0 {
+		add("tunnels.register_rate.per_minute and burst must not be negative")
+	}
+	if t.TTL < 0 {
+		add("tunnels.ttl must not be negative")
+	}
+	if t.IdleTimeout < 0 {
+		add("tunnels.idle_timeout must not be negative")
+	}
+	if t.TCPPortMin != 0 || t.TCPPortMax != 0 {
+		checkPort("tunnels.tcp_port_min", t.TCPPortMin)
+		checkPort("tunnels.tcp_port_max", t.TCPPortMax)
+		if t.TCPPortMin > t.TCPPortMax {
+			add("tunnels.tcp_port_min (%d) must not exceed tunnels.tcp_port_max (%d)", t.TCPPortMin, t.TCPPortMax)
+		}
+	}
+	if t.MaxConnsPerTunnel < 0 {
+		add("tunnels.max_conns_per_tunnel must not be negative")
+	}
+	if t.MaxBytesPerSec < 0 {
+		add("tunnels.max_bytes_per_sec must not be negative")
+	}
+	if t.MaxCacheBytes < 0 {
+		add("tunnels.max_cache_bytes must not be negative")
+	}
+	if t.MaxInFlight < 0 || t.MaxQueued < 0 {
+		add("tunnels.max_in_flight and max_queued must not be negative")
+	}
+	if t.MaxTunnels < 0 {
+		add("tunnels.max_tunnels must not be negative")
+	}
+	if t.MaxPerIP < 0 {
+		add("tunnels.max_per_ip must not be negative")
+	}
+
+	switch c.Auth.Mode {
+	case "", AuthAPIKey, AuthMTLS, AuthEither:
+	default:
+		add("auth.mode must be api_key, mtls or either, got %q", c.Auth.Mode)
+	}
+	if c.Auth.Mode == AuthMTLS || c.Auth.Mode == AuthEither {
+		if !c.Server.TLS.Enabled {
+			add("auth.mode %s requires server.tls.enabled", c.Auth.Mode)
+		}
+		if c.Auth.ClientCA == "" {
+			add("auth.client_ca is required when auth.mode is %s", c.Auth.Mode)
+		} else if _, err := os.Stat(c.Auth.ClientCA); err != nil {
+			add("auth.client_ca: %v", err)
+		}
+		if len(c.Auth.Clients) == 0 {
+			add("auth.clients is required when auth.mode is %s", c.Auth.Mode)
+		}
+		for i, cl := range c.Auth.Clients {
+			if cl.Subject == "" {
+				add("auth.clients[%d] has an empty subject", i)
+			}
+		}
+	}
+	switch c.Auth.Backend {
+	case "", AuthBackendStatic:
+	case AuthBackendWebhook:
+		if u, err := url.Parse(c.Auth.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("auth.webhook.url must be an http(s) URL, got %q", c.Auth.Webhook.URL)
+		}
+		if c.Auth.Webhook.Timeout < 0 || c.Auth.Webhook.CacheTTL < 0 {
+			add("auth.webhook.timeout and cache_ttl must not be negative")
+		}
+	case AuthBackendJWT:
+		j := c.Auth.JWT
+		if (j.PublicKey == "") == (j.JWKSURL == "") {
+			add("auth.jwt needs exactly one of public_key and jwks_url")
+		}
+		if j.PublicKey != "" {
+			if _, err := os.Stat(j.PublicKey); err != nil {
+				add("auth.jwt.public_key: %v", err)
+			}
+		}
+		if j.JWKSURL != "" {
+			if u, err := url.Parse(j.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("auth.jwt.jwks_url must be an http(s) URL, got %q", j.JWKSURL)
+			}
+		}
+		if j.Audience == "" {
+			add("auth.jwt.audience is required")
+		}
+		if j.Leeway < 0 {
+			add("auth.jwt.leeway must not be negative")
+		}
+	default:
+		add("auth.backend must be static, webhook or jwt, got %q", c.Auth.Backend)
+	}
+	switch ts := c.Auth.TokenStore; ts.Backend {
+	case "", TokenStoreMemory:
+	case TokenStoreRedis:
+		if u, err := url.Parse(ts.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			add("auth.token_store.redis_url must be a redis:// or rediss:// URL, got %q", ts.RedisURL)
+		}
+		// Replicas with secrets of their own reject each other's tokens.
+		if len(ts.Secret) < 16 {
+			add("auth.token_store.secret must be set, to at least 16 characters, when tokens are kept in redis")
+		}
+	default:
+		add("auth.token_store.backend must be memory or redis, got %q", ts.Backend)
+	}
+	// The webhook and the token issuer decide about keys themselves, so
+	// none need be listed.
+	if len(c.Auth.Keys) == 0 && c.Auth.Mode != AuthMTLS && c.Auth.Backend != AuthBackendWebhook && c.Auth.Backend != AuthBackendJWT {
+		add("no API key configured: set auth.api_key, auth.api_key_file, auth.keys or $%s", APIKeyEnv)
+	}
+	for i, k := range c.Auth.Keys {
+		if k.Key == "" {
+			add("auth.keys[%d] (%s) has an empty key", i, k.Name)
+		}
+	}
+	if cl := c.Cluster; cl.NodeURL != "" {
+		if u, err := url.Parse(cl.NodeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			add("cluster.node_url must be an http(s) URL without a path, got %q", cl.NodeURL)
+		}
+		redisURL := cl.RedisURL
+		if redisURL == "" {
+			redisURL = c.Auth.TokenStore.RedisURL
+		}
+		if u, err := url.Parse(redisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			add("cluster.redis_url must be a redis:// or rediss:// URL, got %q", redisURL)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
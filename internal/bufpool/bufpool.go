@@ -0,0 +1,45 @@
+// Package bufpool provides fixed-size byte buffers shared across copy loops.
+package bufpool
+
+import "sync"
+
+// DefaultSize is used when a pool is created with a non-positive size.
+const DefaultSize = 32 * 1024
+
+// Pool hands out buffers of a fixed size. It satisfies httputil.BufferPool.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// New returns a pool of buffers of the given size.
+func New(size int) *Pool {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	p := &Pool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Size returns the length of buffers handed out by the pool.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer of Size bytes.
+func (p *Pool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool. Buffers of the wrong size are dropped.
+func (p *Pool) Put(buf []byte) {
+	if cap(buf) < p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
@@ -0,0 +1,61 @@
+// Package version reports which build is running. The values are set at
+// link time, e.g.
+//
+//	go build -ldflags "-X github.com/rahulthapaofficial/expose-local/internal/version.Version=v1.4.0 \
+//		-X github.com/rahulthapaofficial/expose-local/internal/version.Commit=$(git rev-parse --short HEAD) \
+//		-X github.com/rahulthapaofficial/expose-local/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/server
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, overridden with -ldflags -X.
+var (
+	Version = "dev"
+	Commit  = "" // Short git revision
+	Date    = "" // Build time, RFC 3339
+)
+
+// Info returns the commit and build date, falling back to the VCS stamp Go
+// embeds when they were not set with -ldflags.
+func Info() (commit, date string) {
+	commit, date = Commit, Date
+	if commit != "" && date != "" {
+		return commit, date
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+				if len(commit) > 12 {
+					commit = commit[:12]
+				}
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return commit, date
+}
+
+// String describes the build for -version output.
+func String(program string) string {
+	commit, date := Info()
+	return fmt.Sprintf("%s %s (commit %s, built %s, %s)", program, Version, commit, date, runtime.Version())
+}
+
+// LogAttrs returns the build as slog key-value pairs.
+func LogAttrs() []any {
+	commit, date := Info()
+	return []any{"version", Version, "commit", commit, "built", date}
+}
@@ -0,0 +1,112 @@
+package wsmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FrameType identifies what a frame carries.
+type FrameType uint8
+
+const (
+	// FrameOpen asks the peer to open a new stream. Its payload, if any,
+	// names the stream's target: see Session.OpenTarget.
+	FrameOpen FrameType = iota + 1
+	// FrameData carries stream payload bytes.
+	FrameData
+	// FrameClose tears down a stream in both directions.
+	FrameClose
+	// FrameCloseWrite says the sender will send no more data on a stream,
+	// while it may still receive. Peers that predate it ignore it.
+	FrameCloseWrite
+	// FrameControl carries a message about the session itself rather than
+	// any stream, such as an agent heartbeat. Its stream ID is always 0.
+	FrameControl
+	// FrameAck tells the peer how many frames have arrived, as a big-endian
+	// uint64, so it can drop them from its replay buffer. Only resumable
+	// sessions (ProtocolV2) send it; it is not counted itself.
+	FrameAck
+	// FrameWindow lets the peer send that many more bytes, a big-endian
+	// uint32, on a stream. Every session sends one on stream 0 with no
+	// payload first, to say it does; a peer keeps to the window of each
+	// stream only once it has seen that. Peers that predate it ignore it.
+	FrameWindow
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameOpen:
+		return "OPEN"
+	case FrameData:
+		return "DATA"
+	case FrameClose:
+		return "CLOSE"
+	case FrameCloseWrite:
+		return "CLOSE_WRITE"
+	case FrameControl:
+		return "CONTROL"
+	case FrameAck:
+		return "ACK"
+	case FrameWindow:
+		return "WINDOW"
+	default:
+		return fmt.Sprintf("FrameType(%d)", uint8(t))
+	}
+}
+
+// carriesStream reports whether frames of type t move stream traffic, as
+// opposed to keeping the session itself going.
+func (t FrameType) carriesStream() bool {
+	switch t {
+	case FrameOpen, FrameData, FrameClose, FrameCloseWrite:
+		return true
+	default:
+		return false
+	}
+}
+
+// headerSize is type (1) + stream ID (4) + payload length (4).
+const headerSize = 9
+
+// MaxPayload bounds the payload of a single DATA frame.
+const MaxPayload = 32 * 1024
+
+// MaxFrameSize is the largest WebSocket message a session sends, so read
+// limits must be at least this.
+const MaxFrameSize = headerSize + MaxPayload
+
+var errShortFrame = errors.New("wsmux: short frame")
+
+// Frame is the unit exchanged over the WebSocket. Each binary WebSocket
+// message holds exactly one frame.
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+// MarshalBinary encodes the frame as type | stream ID | length | payload.
+func (f Frame) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, headerSize+len(f.Payload))
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:5], f.StreamID)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(f.Payload)))
+	copy(buf[headerSize:], f.Payload)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a frame produced by MarshalBinary.
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return errShortFrame
+	}
+	n := binary.BigEndian.Uint32(data[5:9])
+	if int(n) != len(data)-headerSize {
+		return fmt.Errorf("wsmux: length prefix %d does not match payload size %d", n, len(data)-headerSize)
+	}
+	f.Type = FrameType(data[0])
+	f.StreamID = binary.BigEndian.Uint32(data[1:5])
+	f.Payload = data[headerSize:]
+	return nil
+}
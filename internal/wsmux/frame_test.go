@@ -0,0 +1,74 @@
+package wsmux
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Frame{
+		{Type: FrameOpen, StreamID: 1},
+		{Type: FrameOpen, StreamID: 3, Payload: []byte("8000")},
+		{Type: FrameData, StreamID: 2, Payload: []byte("hello")},
+		{Type: FrameData, StreamID: 0xffffffff, Payload: bytes.Repeat([]byte{0xab}, MaxPayload)},
+		{Type: FrameClose, StreamID: 5},
+		{Type: FrameCloseWrite, StreamID: 7},
+		{Type: FrameControl, Payload: []byte(`{"type":"heartbeat"}`)},
+		{Type: FrameAck, Payload: []byte{0, 0, 0, 0, 0, 0, 0, 42}},
+		{Type: FrameWindow, StreamID: 9, Payload: []byte{0, 16, 0, 0}},
+	}
+	for _, want := range tests {
+		t.Run(want.Type.String(), func(t *testing.T) {
+			data, err := want.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != headerSize+len(want.Payload) || len(data) > MaxFrameSize {
+				t.Fatalf("encoded to %d bytes, want %d and at most MaxFrameSize", len(data), headerSize+len(want.Payload))
+			}
+			var got Frame
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != want.Type || got.StreamID != want.StreamID || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("got %v stream %d with %d bytes, want %v stream %d with %d bytes",
+					got.Type, got.StreamID, len(got.Payload), want.Type, want.StreamID, len(want.Payload))
+			}
+		})
+	}
+}
+
+func TestFrameUnmarshalRejectsMalformed(t *testing.T) {
+	valid, _ := Frame{Type: FrameData, StreamID: 1, Payload: []byte("hello")}.MarshalBinary()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", valid[:headerSize-1]},
+		{"truncated payload", valid[:len(valid)-1]},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Frame
+			err := f.UnmarshalBinary(tt.data)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if len(tt.data) < headerSize && !errors.Is(err, errShortFrame) {
+				t.Errorf("got %v, want errShortFrame", err)
+			}
+		})
+	}
+}
+
+func TestFrameTypeString(t *testing.T) {
+	if got := FrameWindow.String(); got != "WINDOW" {
+		t.Errorf("FrameWindow = %q", got)
+	}
+	if got := FrameType(99).String(); got != "FrameType(99)" {
+		t.Errorf("unknown type = %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package wsmux
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Protocol versions, named as the WebSocket subprotocols agents and servers
+// negotiate.
+const (
+	// ProtocolV1 is the framing protocol as described in frame.go.
+	ProtocolV1 = "tunnel.v1"
+	// ProtocolV2 adds FrameAck, so that a session can outlive its
+	// WebSocket: see NewResumableSession.
+	ProtocolV2 = "tunnel.v2"
+)
+
+// Protocols lists the protocol versions this package speaks, newest first.
+var Protocols = []string{ProtocolV2, ProtocolV1}
+
+// Handshake headers for resuming a session. The server names a resumable
+// session in its upgrade response; to resume it, the agent sends the name
+// back along with how many frames it received, and the server answers with
+// its own count.
+const (
+	HeaderSession  = "X-Tunnel-Session"
+	HeaderReceived = "X-Tunnel-Received"
+)
+
+// NegotiateProtocol returns the newest version in Protocols that the peer
+// also offered, or "" when there is none.
+func NegotiateProtocol(offered []string) string {
+	for _, p := range Protocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// OffersDeflate reports whether a handshake's Sec-WebSocket-Extensions
+// header lists permessage-deflate: offered, in a request, or accepted, in
+// a response. Compression is only used when both sides enable it; either
+// one alone falls back to uncompressed frames.
+func OffersDeflate(h http.Header) bool {
+	for _, value := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
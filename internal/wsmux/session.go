@@ -0,0 +1,704 @@
+package wsmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrSessionClosed is returned once the underlying WebSocket is gone.
+	ErrSessionClosed = errors.New("wsmux: session closed")
+	// ErrStreamClosed is returned when using a stream after Close.
+	ErrStreamClosed = errors.New("wsmux: stream closed")
+	// ErrTooManyStreams is returned by Open once the stream limit is reached.
+	ErrTooManyStreams = errors.New("wsmux: too many streams")
+	// ErrResumeMismatch is returned by Resume when the peer's count of
+	// received frames does not fit what was sent, so the streams cannot be
+	// continued; the session is closed.
+	ErrResumeMismatch = errors.New("wsmux: cannot resume session, frame counts differ")
+)
+
+// acceptBacklog is how many peer-opened streams may wait for Accept.
+const acceptBacklog = 64
+
+// controlBacklog is how many control messages may wait for a reader before
+// further ones are dropped.
+const controlBacklog = 16
+
+// A resumable session keeps every frame it sent until the peer acknowledges
+// it, up to maxReplayBytes; past that, writes wait for an acknowledgement.
+// The peer acknowledges after ackEvery frames or, for a trickle, every
+// ackInterval.
+const (
+	maxReplayBytes = 4 << 20
+	ackEvery       = 32
+	ackInterval    = 500 * time.Millisecond
+)
+
+// writeRequest is one encoded frame queued for the writer goroutine.
+type writeRequest struct {
+	data   []byte
+	result chan error
+}
+
+// sentFrame is an encoded frame kept for replay, numbered from 1.
+type sentFrame struct {
+	seq  uint64
+	data []byte
+}
+
+// resumeRequest hands writeLoop a new connection to replay onto.
+type resumeRequest struct {
+	conn         *websocket.Conn
+	peerReceived uint64
+	result       chan error
+}
+
+// Session multiplexes many streams over a single WebSocket connection.
+type Session struct {
+	// writeCh feeds writeLoop, the only goroutine that writes data
+	// messages, since gorilla/websocket allows just one concurrent writer.
+	writeCh chan writeRequest
+
+	mu         sync.Mutex
+	conn       *websocket.Conn // The latest connection, even while suspended
+	streams    map[uint32]*Stream
+	nextID     uint32
+	maxStreams int // 0 means unlimited
+
+	// Resumption state; grace is 0 for sessions that cannot resume. The
+	// fields below it are guarded by mu.
+	grace     time.Duration
+	suspended bool          // The connection is gone and a new one is awaited
+	lost      chan struct{} // Closed when the current connection goes
+	readDone  chan struct{} // Closed when the current connection's readLoop returns
+	epoch     int           // Counts connections, so a stale grace timer can tell
+	sent      []sentFrame   // Unacknowledged frames, oldest first
+	sentBytes int
+	sentSeq   uint64
+
+	recvSeq  atomic.Uint64 // Frames received, as reported to the peer
+	resumeCh chan resumeRequest
+	ackCh    chan struct{} // readLoop tells writeLoop a frame arrived
+	space    chan struct{} // readLoop tells writeLoop an ack freed replay space
+
+	lastActivity atomic.Int64 // Unix nanoseconds of the last stream frame sent or received
+	peerWindows  atomic.Bool  // The peer sent FrameWindow, so keeps to stream windows
+
+	acceptCh  chan *Stream
+	controlCh chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// NewSession starts demultiplexing frames read from conn. The server side
+// allocates odd stream IDs and the agent side even ones so that both ends
+// may open streams without colliding.
+func NewSession(conn *websocket.Conn, server bool) *Session {
+	return newSession(conn, server, 0)
+}
+
+// NewResumableSession is NewSession for connections that negotiated
+// ProtocolV2. When conn drops the session is suspended rather than
+// closed: streams stay open and writes are buffered while Suspend and
+// Resume move the session onto a new connection, replaying whatever the
+// peer missed. A session not resumed within grace is closed.
+func NewResumableSession(conn *websocket.Conn, server bool, grace time.Duration) *Session {
+	return newSession(conn, server, grace)
+}
+
+func newSession(conn *websocket.Conn, server bool, grace time.Duration) *Session {
+	s := &Session{
+		conn:      conn,
+		writeCh:   make(chan writeRequest),
+		streams:   make(map[uint32]*Stream),
+		grace:     grace,
+		lost:      make(chan struct{}),
+		readDone:  make(chan struct{}),
+		resumeCh:  make(chan resumeRequest),
+		ackCh:     make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+		acceptCh:  make(chan *Stream, acceptBacklog),
+		controlCh: make(chan []byte, controlBacklog),
+		done:      make(chan struct{}),
+	}
+	s.touch()
+	if server {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.readLoop(conn, s.readDone)
+	go s.writeLoop()
+	// Tell the peer we grant stream windows, so it may keep to them.
+	go s.writeFrame(Frame{Type: FrameWindow})
+	return s
+}
+
+// Resumable reports whether the session survives its connection dropping.
+func (s *Session) Resumable() bool {
+	return s.grace > 0
+}
+
+// Lost is closed when the current connection goes: for a resumable
+// session, the cue to Suspend and reconnect. Each Resume starts a new
+// channel. It is also closed when the session ends.
+func (s *Session) Lost() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lost
+}
+
+// Suspend drops the current connection, if the session still has one, and
+// waits for it to stop delivering frames. It returns how many frames the
+// session has received in all, which the peer needs for Resume.
+func (s *Session) Suspend() uint64 {
+	s.mu.Lock()
+	conn, readDone := s.conn, s.readDone
+	s.mu.Unlock()
+	s.connLost(conn, ErrSessionClosed)
+	select {
+	case <-readDone:
+	case <-s.done:
+	}
+	return s.recvSeq.Load()
+}
+
+// Resume carries a suspended session on over conn, first resending every
+// frame after the peerReceived the peer reported. If that write fails the
+// session stays suspended and Resume may be tried again.
+func (s *Session) Resume(conn *websocket.Conn, peerReceived uint64) error {
+	req := resumeRequest{conn: conn, peerReceived: peerReceived, result: make(chan error, 1)}
+	select {
+	case s.resumeCh <- req:
+	case <-s.done:
+		return ErrSessionClosed
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-s.done:
+		// A mismatch closes the session before its result is handed back.
+		if errors.Is(s.err, ErrResumeMismatch) {
+			return ErrResumeMismatch
+		}
+		return ErrSessionClosed
+	}
+}
+
+// Open creates a new stream and announces it to the peer.
+func (s *Session) Open() (*Stream, error) {
+	return s.OpenTarget("")
+}
+
+// OpenTarget is Open for a stream meant for something other than the
+// peer's default, such as one of several local services; the peer reads it
+// from Stream.Target. Peers that predate targets ignore it.
+func (s *Session) OpenTarget(target string) (*Stream, error) {
+	if len(target) > MaxPayload {
+		return nil, errors.New("wsmux: stream target too long")
+	}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+		s.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s, target)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(Frame{Type: FrameOpen, StreamID: id, Payload: []byte(target)}); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// SetMaxStreams makes Open fail with ErrTooManyStreams while n streams are
+// open. Zero removes the limit.
+func (s *Session) SetMaxStreams(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxStreams = n
+}
+
+// NumStreams returns how many streams are currently open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Accept waits for the peer to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// SendControl sends msg to the peer outside of any stream.
+func (s *Session) SendControl(msg []byte) error {
+	if len(msg) > MaxPayload {
+		return errors.New("wsmux: control message too large")
+	}
+	return s.writeFrame(Frame{Type: FrameControl, Payload: msg})
+}
+
+// Control delivers control messages from the peer. Messages arriving while
+// the backlog is full are dropped rather than stalling the streams, so
+// they should be ones that are resent periodically.
+func (s *Session) Control() <-chan []byte {
+	return s.controlCh
+}
+
+// Done is closed when the session terminates.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// NormalClose reports whether err, as returned by Err, means the session
+// was ended on purpose: by Close, or by the peer with a normal closure or
+// going-away close frame. A dropped connection or any other close code is
+// not normal.
+func NormalClose(err error) bool {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return !websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+	}
+	return errors.Is(err, ErrSessionClosed)
+}
+
+// Err reports why the session terminated, if it has.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// LastActivity reports when a stream frame was last sent or received.
+// Heartbeats and other session housekeeping do not count, so a session
+// that only keeps itself alive looks idle.
+func (s *Session) LastActivity() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+func (s *Session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (s *Session) LocalAddr() net.Addr {
+	return s.currentConn().LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.currentConn().RemoteAddr()
+}
+
+func (s *Session) currentConn() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Close tears down the session and every stream on it.
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed, websocket.CloseNormalClosure, "")
+	return nil
+}
+
+// CloseWithCode sends a WebSocket close message before tearing down the
+// session, so the peer can tell a deliberate shutdown from a dropped link.
+func (s *Session) CloseWithCode(code int, text string) error {
+	return s.shutdown(ErrSessionClosed, code, text)
+}
+
+func (s *Session) closeWithError(err error) {
+	s.shutdown(err, websocket.CloseNormalClosure, "")
+}
+
+// shutdown closes the session with err, once. A deliberate close, with
+// ErrSessionClosed, first sends the peer a close message with code and
+// text; the error from sending it is returned.
+func (s *Session) shutdown(err error, code int, text string) (closeErr error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+
+		s.mu.Lock()
+		if err == ErrSessionClosed && !s.suspended {
+			// Say it is deliberate: a resumable peer would take the drop
+			// for a blip and wait out the grace period, and any peer
+			// would log it as one.
+			msg := websocket.FormatCloseMessage(code, text)
+			closeErr = s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		}
+		s.conn.Close()
+		if !s.suspended {
+			s.suspended = true
+			close(s.lost)
+		}
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.sent = nil
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.sessionClosed()
+		}
+	})
+	return closeErr
+}
+
+// connLost handles conn failing. A resumable session is suspended and
+// closed only if it is not resumed within its grace period; any other is
+// closed at once.
+func (s *Session) connLost(conn *websocket.Conn, err error) {
+	if !s.Resumable() {
+		s.closeWithError(err)
+		return
+	}
+	s.mu.Lock()
+	if conn != s.conn || s.suspended {
+		s.mu.Unlock()
+		return
+	}
+	s.suspended = true
+	close(s.lost)
+	epoch := s.epoch
+	s.mu.Unlock()
+	conn.Close()
+
+	time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		expired := s.suspended && s.epoch == epoch
+		s.mu.Unlock()
+		if expired {
+			s.closeWithError(err)
+		}
+	})
+}
+
+func (s *Session) readLoop(conn *websocket.Conn, done chan struct{}) {
+	defer close(done)
+	for {
+		_, msg, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+			// The peer ended the session on purpose.
+			s.closeWithError(err)
+			return
+		}
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// Not a blip: the peer would only send it again.
+			s.closeWithError(err)
+			return
+		}
+		if err != nil {
+			s.connLost(conn, err)
+			return
+		}
+
+		var f Frame
+		if err := f.UnmarshalBinary(msg); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if f.Type.carriesStream() {
+			s.touch()
+		}
+		if f.Type == FrameAck {
+			s.acknowledged(f.Payload)
+			continue
+		}
+		if s.Resumable() {
+			s.recvSeq.Add(1)
+			signal(s.ackCh)
+		}
+		s.handleFrame(f)
+	}
+}
+
+// acknowledged drops the frames the peer reports having received from the
+// replay buffer.
+func (s *Session) acknowledged(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	n := binary.BigEndian.Uint64(payload)
+	s.mu.Lock()
+	s.trimSent(n)
+	s.mu.Unlock()
+	signal(s.space)
+}
+
+// trimSent drops frames up to and including seq n. s.mu must be held.
+func (s *Session) trimSent(n uint64) {
+	i := 0
+	for i < len(s.sent) && s.sent[i].seq <= n {
+		s.sentBytes -= len(s.sent[i].data)
+		i++
+	}
+	s.sent = s.sent[i:]
+}
+
+// signal wakes whoever waits on ch without blocking if it is already due.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) handleFrame(f Frame) {
+	switch f.Type {
+	case FrameOpen:
+		s.mu.Lock()
+		if _, exists := s.streams[f.StreamID]; exists {
+			s.mu.Unlock()
+			return
+		}
+		st := newStream(f.StreamID, s, string(f.Payload))
+		s.streams[f.StreamID] = st
+		s.mu.Unlock()
+
+		select {
+		case s.acceptCh <- st:
+		case <-s.done:
+		}
+
+	case FrameData:
+		s.mu.Lock()
+		st, exists := s.streams[f.StreamID]
+		s.mu.Unlock()
+		if !exists {
+			// The stream is already gone locally; tell the peer. Not
+			// inline: writeLoop may be waiting for an ack only we can read.
+			go s.writeFrame(Frame{Type: FrameClose, StreamID: f.StreamID})
+			return
+		}
+		st.push(f.Payload)
+
+	case FrameClose:
+		if st := s.removeStream(f.StreamID); st != nil {
+			st.remoteClose()
+		}
+
+	case FrameCloseWrite:
+		s.mu.Lock()
+		st, exists := s.streams[f.StreamID]
+		s.mu.Unlock()
+		if exists && st.remoteCloseWrite() {
+			s.removeStream(f.StreamID)
+		}
+
+	case FrameControl:
+		select {
+		case s.controlCh <- f.Payload:
+		default:
+		}
+
+	case FrameWindow:
+		s.peerWindows.Store(true)
+		if len(f.Payload) != 4 {
+			return
+		}
+		s.mu.Lock()
+		st, exists := s.streams[f.StreamID]
+		s.mu.Unlock()
+		if exists {
+			st.grant(int(binary.BigEndian.Uint32(f.Payload)))
+		}
+	}
+}
+
+func (s *Session) removeStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, exists := s.streams[id]
+	if !exists {
+		return nil
+	}
+	delete(s.streams, id)
+	return st
+}
+
+// writeFrame queues f for writeLoop and waits until it has been written.
+func (s *Session) writeFrame(f Frame) error {
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	req := writeRequest{data: data, result: make(chan error, 1)}
+	select {
+	case s.writeCh <- req:
+	case <-s.done:
+		return ErrSessionClosed
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-s.done:
+		return ErrSessionClosed
+	}
+}
+
+// writeLoop serializes every frame onto the WebSocket.
+func (s *Session) writeLoop() {
+	if !s.Resumable() {
+		for {
+			select {
+			case req := <-s.writeCh:
+				err := s.conn.WriteMessage(websocket.BinaryMessage, req.data)
+				req.result <- err
+				if err != nil {
+					s.closeWithError(err)
+					return
+				}
+				if FrameType(req.data[0]).carriesStream() {
+					s.touch()
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	var acked uint64 // The recvSeq last acknowledged
+	for {
+		writeCh := s.writeCh
+		s.mu.Lock()
+		if s.sentBytes >= maxReplayBytes {
+			writeCh = nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case req := <-writeCh:
+			// Queued for replay first, so a frame lost with the
+			// connection is sent again after Resume.
+			s.mu.Lock()
+			s.sentSeq++
+			s.sent = append(s.sent, sentFrame{seq: s.sentSeq, data: req.data})
+			s.sentBytes += len(req.data)
+			conn, suspended := s.conn, s.suspended
+			s.mu.Unlock()
+			if !suspended {
+				if err := conn.WriteMessage(websocket.BinaryMessage, req.data); err != nil {
+					s.connLost(conn, err)
+				}
+			}
+			req.result <- nil
+			if FrameType(req.data[0]).carriesStream() {
+				s.touch()
+			}
+		case <-s.ackCh:
+			if n := s.recvSeq.Load(); n-acked >= ackEvery {
+				acked = s.sendAck(n, acked)
+			}
+		case <-ticker.C:
+			if n := s.recvSeq.Load(); n > acked {
+				acked = s.sendAck(n, acked)
+			}
+		case <-s.space:
+		case req := <-s.resumeCh:
+			err := s.replay(req.conn, req.peerReceived)
+			if err == nil {
+				acked = 0 // Acknowledge afresh on the new connection
+			}
+			req.result <- err
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sendAck tells the peer n frames have arrived and returns the count now
+// acknowledged, which stays prev if the connection is down.
+func (s *Session) sendAck(n, prev uint64) uint64 {
+	s.mu.Lock()
+	conn, suspended := s.conn, s.suspended
+	s.mu.Unlock()
+	if suspended {
+		return prev
+	}
+	data, _ := Frame{Type: FrameAck, Payload: binary.BigEndian.AppendUint64(nil, n)}.MarshalBinary()
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		s.connLost(conn, err)
+		return prev
+	}
+	return n
+}
+
+// replay writes the frames the peer has not received onto conn and makes
+// it the session's connection. Only writeLoop calls it.
+func (s *Session) replay(conn *websocket.Conn, peerReceived uint64) error {
+	s.mu.Lock()
+	if !s.suspended {
+		s.mu.Unlock()
+		return errors.New("wsmux: session is not suspended")
+	}
+	oldest := s.sentSeq + 1
+	if len(s.sent) > 0 {
+		oldest = s.sent[0].seq
+	}
+	if peerReceived+1 < oldest || peerReceived > s.sentSeq {
+		s.mu.Unlock()
+		s.closeWithError(ErrResumeMismatch)
+		return ErrResumeMismatch
+	}
+	s.trimSent(peerReceived)
+	frames := append([]sentFrame(nil), s.sent...)
+	s.mu.Unlock()
+
+	for _, f := range frames {
+		if err := conn.WriteMessage(websocket.BinaryMessage, f.data); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		// The grace period ran out meanwhile.
+		s.mu.Unlock()
+		conn.Close()
+		return ErrSessionClosed
+	default:
+	}
+	s.conn = conn
+	s.suspended = false
+	s.epoch++
+	s.lost = make(chan struct{})
+	s.readDone = make(chan struct{})
+	readDone := s.readDone
+	s.mu.Unlock()
+	go s.readLoop(conn, readDone)
+	s.touch()
+	return nil
+}
@@ -0,0 +1,373 @@
+package wsmux
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialer connects the two ends of WebSocket connections for tests.
+type dialer struct {
+	url      string
+	accepted chan *websocket.Conn
+}
+
+func newDialer(t *testing.T) *dialer {
+	t.Helper()
+	d := &dialer{accepted: make(chan *websocket.Conn, 1)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		d.accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+	d.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return d
+}
+
+// dial returns both ends of a new connection.
+func (d *dialer) dial(t *testing.T) (server, agent *websocket.Conn) {
+	t.Helper()
+	agent, _, err := websocket.DefaultDialer.Dial(d.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-d.accepted, agent
+}
+
+// sessionPair connects a server and an agent session; a grace above zero
+// makes them resumable.
+func sessionPair(t *testing.T, grace time.Duration) (server, agent *Session, d *dialer) {
+	t.Helper()
+	d = newDialer(t)
+	serverConn, agentConn := d.dial(t)
+	server = newSession(serverConn, true, grace)
+	agent = newSession(agentConn, false, grace)
+	t.Cleanup(func() {
+		agent.Close()
+		server.Close()
+	})
+	return server, agent, d
+}
+
+// streamPair opens a stream from server and accepts it on agent, with a
+// round trip so both window announcements have arrived.
+func streamPair(t *testing.T, server, agent *Session) (st, peer *Stream) {
+	t.Helper()
+	st, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err = agent.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Write([]byte("x"))
+	if _, err := io.ReadFull(st, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return st, peer
+}
+
+// waitDone fails the test unless s ends within a few seconds.
+func waitDone(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open")
+	}
+}
+
+// A writer gets ahead of a stream's reader by one window at most, instead
+// of the reader buffering whatever is sent.
+func TestStreamWindowHoldsUpWriter(t *testing.T) {
+	server, agent, _ := sessionPair(t, 0)
+	st, peer := streamPair(t, server, agent)
+
+	st.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := st.Write(make([]byte, 4*streamWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != streamWindow {
+		t.Fatalf("write to a stream nobody reads: wrote %d, %v; want %d, deadline exceeded", n, err, streamWindow)
+	}
+
+	// Reading lets the writer carry on.
+	st.SetWriteDeadline(time.Time{})
+	read := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyN(io.Discard, peer, 5*streamWindow)
+		read <- n
+	}()
+	if _, err := st.Write(make([]byte, 4*streamWindow)); err != nil {
+		t.Fatalf("write with a reader: %v", err)
+	}
+	if n := <-read; n != 5*streamWindow {
+		t.Errorf("read %d bytes, want %d", n, 5*streamWindow)
+	}
+}
+
+// After CloseWrite the peer reads to EOF but can still answer, and the
+// stream is gone from both sessions once both sides have closed.
+func TestStreamHalfClose(t *testing.T) {
+	server, agent, _ := sessionPair(t, 0)
+	st, peer := streamPair(t, server, agent)
+
+	st.Write([]byte("request"))
+	if err := st.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Writable() {
+		t.Error("stream writable after CloseWrite")
+	}
+	if _, err := st.Write([]byte("more")); err == nil {
+		t.Error("write after CloseWrite succeeded")
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("peer read %q, %v; want the request then EOF", got, err)
+	}
+	if !peer.Writable() {
+		t.Fatal("peer cannot answer after a half-close")
+	}
+
+	peer.Write([]byte("response"))
+	if err := peer.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(st)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("read %q, %v; want the response then EOF", got, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.NumStreams() != 0 || agent.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d server and %d agent streams left after both sides closed", server.NumStreams(), agent.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The largest DATA frame fits a MaxFrameSize read limit, and a message
+// over it ends the session, resumable or not, rather than suspending it.
+func TestSessionMaxFrameSize(t *testing.T) {
+	d := newDialer(t)
+	peer, conn := d.dial(t)
+	conn.SetReadLimit(MaxFrameSize)
+	agent := NewResumableSession(conn, false, time.Minute)
+	defer agent.Close()
+
+	write := func(f Frame) {
+		t.Helper()
+		data, _ := f.MarshalBinary()
+		if err := peer.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(Frame{Type: FrameOpen, StreamID: 1})
+	write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, MaxPayload)})
+	st, err := agent.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(st, make([]byte, MaxPayload)); err != nil {
+		t.Fatalf("full frame: %v", err)
+	}
+
+	if err := peer.WriteMessage(websocket.BinaryMessage, make([]byte, MaxFrameSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, agent)
+	if !errors.Is(agent.Err(), websocket.ErrReadLimit) {
+		t.Errorf("agent ended with %v, want the read limit", agent.Err())
+	}
+}
+
+// A deliberate close reaches the peer with the code it was given, not the
+// normal closure Close would send.
+func TestSessionCloseWithCode(t *testing.T) {
+	server, agent, _ := sessionPair(t, 0)
+	if err := server.CloseWithCode(websocket.CloseGoingAway, "restarting"); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, agent)
+	var closeErr *websocket.CloseError
+	if !errors.As(agent.Err(), &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "restarting" {
+		t.Errorf("agent saw %v, want going away: restarting", agent.Err())
+	}
+	if !NormalClose(agent.Err()) {
+		t.Errorf("NormalClose(%v) = false", agent.Err())
+	}
+}
+
+// suspend drops both ends' connection and returns how many frames each
+// has received, as Resume on the other end needs.
+func suspend(server, agent *Session) (serverReceived, agentReceived uint64) {
+	return server.Suspend(), agent.Suspend()
+}
+
+// resume carries both ends on over a new connection.
+func resume(t *testing.T, d *dialer, server, agent *Session, serverReceived, agentReceived uint64) {
+	t.Helper()
+	serverConn, agentConn := d.dial(t)
+	// Replay may not fit the socket buffers before the peer reads, so
+	// both ends resume at once.
+	result := make(chan error, 1)
+	go func() { result <- server.Resume(serverConn, agentReceived) }()
+	if err := agent.Resume(agentConn, serverReceived); err != nil {
+		t.Fatalf("agent resume: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("server resume: %v", err)
+	}
+}
+
+// Frames written while the connection is down reach the peer after Resume,
+// and the stream carries on.
+func TestSessionResumeReplaysUnacked(t *testing.T) {
+	server, agent, d := sessionPair(t, time.Minute)
+	st, peer := streamPair(t, server, agent)
+
+	serverReceived, agentReceived := suspend(server, agent)
+	if _, err := st.Write([]byte("while away")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	resume(t, d, server, agent, serverReceived, agentReceived)
+
+	got := make([]byte, len("while away"))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "while away" {
+		t.Errorf("agent read %q, %v", got, err)
+	}
+	got = make([]byte, len("back"))
+	if _, err := io.ReadFull(st, got); err != nil || string(got) != "back" {
+		t.Errorf("server read %q, %v", got, err)
+	}
+
+	// And after the replay, as before.
+	st.Write([]byte("again"))
+	got = make([]byte, len("again"))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "again" {
+		t.Errorf("agent read %q, %v after resuming", got, err)
+	}
+}
+
+// A peer claiming more frames than were sent, or fewer than the replay
+// buffer still holds, cannot be resumed: frames would be lost or doubled.
+func TestSessionResumeRejectsMismatchedCount(t *testing.T) {
+	tests := []struct {
+		name         string
+		peerReceived func(s *Session) uint64
+	}{
+		{"ahead of sent", func(s *Session) uint64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.sentSeq + 1
+		}},
+		{"behind acknowledged", func(s *Session) uint64 { return 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, agent, d := sessionPair(t, time.Minute)
+
+			// Enough frames for the agent to acknowledge, so the oldest
+			// ones leave the server's replay buffer.
+			for range ackEvery + 1 {
+				if err := server.SendControl([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				server.mu.Lock()
+				trimmed := len(server.sent) == 0 || server.sent[0].seq > 1
+				server.mu.Unlock()
+				if trimmed {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("agent never acknowledged")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			suspend(server, agent)
+			conn, _ := d.dial(t)
+			if err := server.Resume(conn, tt.peerReceived(server)); !errors.Is(err, ErrResumeMismatch) {
+				t.Fatalf("got %v, want ErrResumeMismatch", err)
+			}
+			waitDone(t, server)
+		})
+	}
+}
+
+// A session not resumed within its grace period ends, and so do its
+// streams.
+func TestSessionGraceExpires(t *testing.T) {
+	server, agent, d := sessionPair(t, 100*time.Millisecond)
+	st, _ := streamPair(t, server, agent)
+
+	suspend(server, agent)
+	waitDone(t, server)
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("read after expiry: %v, want ErrSessionClosed", err)
+	}
+	conn, _ := d.dial(t)
+	if err := server.Resume(conn, 0); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("resume after expiry: %v, want ErrSessionClosed", err)
+	}
+}
+
+// Writes wait once maxReplayBytes are unacknowledged, and go on when the
+// peer catches up.
+func TestSessionReplayBufferFull(t *testing.T) {
+	server, agent, d := sessionPair(t, time.Minute)
+	serverReceived, agentReceived := suspend(server, agent)
+
+	msg := make([]byte, MaxPayload)
+	frameSize := headerSize + len(msg)
+	fits := (maxReplayBytes + frameSize - 1) / frameSize
+	sent := make(chan int, fits+10)
+	go func() {
+		for i := range fits + 10 {
+			if server.SendControl(msg) != nil {
+				return
+			}
+			sent <- i + 1
+		}
+	}()
+
+	count := 0
+	for count < fits {
+		select {
+		case count = <-sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d frames buffered", count, fits)
+		}
+	}
+	select {
+	case n := <-sent:
+		t.Fatalf("frame %d sent with the replay buffer full", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resume(t, d, server, agent, serverReceived, agentReceived)
+	for count < fits+10 {
+		select {
+		case count = <-sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("writes still held up after resuming: %d of %d sent", count, fits+10)
+		}
+	}
+}
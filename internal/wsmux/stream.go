@@ -0,0 +1,342 @@
+package wsmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// streamWindow is how much of what the peer sends a stream buffers before
+// it is read. The peer may send that much ahead; Read grants more as it
+// makes room, half a window at a time.
+const streamWindow = 1 << 20
+
+// Stream is one logical connection carried by a Session. It implements
+// net.Conn so it can be handed to anything that expects a socket.
+type Stream struct {
+	id     uint32
+	sess   *Session
+	target string
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	readable      chan struct{}
+	sendable      chan struct{} // The peer granted more window
+	drained       chan struct{} // Read made room in buf
+	sendWindow    int           // Bytes the peer still has room for
+	unacked       int           // Bytes read that the peer has not been granted back
+	closed        bool
+	remoteClosed  bool
+	readClosed    bool // The peer sent CLOSE_WRITE
+	writeClosed   bool // We sent CLOSE_WRITE
+	sessionGone   bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(id uint32, sess *Session, target string) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		target:     target,
+		readable:   make(chan struct{}, 1),
+		sendable:   make(chan struct{}, 1),
+		drained:    make(chan struct{}, 1),
+		sendWindow: streamWindow,
+	}
+}
+
+// ID returns the stream identifier used on the wire.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Target returns what the opener asked the stream to reach, or "" for the
+// default.
+func (st *Stream) Target() string {
+	return st.target
+}
+
+// Read reads data sent by the peer. It returns io.EOF once the peer has
+// closed the stream, or its side of it, and all buffered data has been
+// consumed.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			grant := st.consumed(n)
+			st.mu.Unlock()
+			st.signal()
+			if grant > 0 {
+				st.sess.writeFrame(Frame{Type: FrameWindow, StreamID: st.id, Payload: binary.BigEndian.AppendUint32(nil, uint32(grant))})
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case st.remoteClosed || st.readClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.sessionGone:
+			st.mu.Unlock()
+			return 0, ErrSessionClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// consumed records n bytes read and returns how much window to grant the
+// peer back, if it is time to. st.mu must be held.
+func (st *Stream) consumed(n int) int {
+	st.unacked += n
+	if st.unacked < streamWindow/2 || !st.sess.peerWindows.Load() || st.remoteClosed || st.readClosed {
+		return 0
+	}
+	grant := st.unacked
+	st.unacked = 0
+	return grant
+}
+
+// wait blocks until ch is signalled or deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends p to the peer, splitting it into DATA frames as needed.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		closed, remoteClosed, deadline := st.closed || st.writeClosed, st.remoteClosed, st.writeDeadline
+		st.mu.Unlock()
+		if closed || remoteClosed {
+			return written, ErrStreamClosed
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		chunk := p
+		if len(chunk) > MaxPayload {
+			chunk = chunk[:MaxPayload]
+		}
+		if st.sess.peerWindows.Load() {
+			n, err := st.reserve(len(chunk))
+			if err != nil {
+				return written, err
+			}
+			chunk = chunk[:n]
+		}
+		if err := st.sess.writeFrame(Frame{Type: FrameData, StreamID: st.id, Payload: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// reserve waits until the peer has room on the stream and takes up to max
+// bytes of it.
+func (st *Stream) reserve(max int) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.writeClosed || st.remoteClosed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case st.sessionGone:
+			st.mu.Unlock()
+			return 0, ErrSessionClosed
+		case st.sendWindow > 0:
+			n := min(max, st.sendWindow)
+			st.sendWindow -= n
+			st.mu.Unlock()
+			return n, nil
+		}
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.sendable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// grant adds n bytes the peer made room for to the stream's window.
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	st.signal()
+}
+
+// Close closes the stream in both directions and notifies the peer.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	notifyPeer := !st.remoteClosed && !st.sessionGone && !(st.readClosed && st.writeClosed)
+	st.mu.Unlock()
+	st.signal()
+
+	st.sess.removeStream(st.id)
+	if notifyPeer {
+		return st.sess.writeFrame(Frame{Type: FrameClose, StreamID: st.id})
+	}
+	return nil
+}
+
+// CloseWrite tells the peer no more data will be sent, like a TCP FIN,
+// while data from the peer can still be read. Once both sides have done
+// so the stream is finished, though Close should still be called.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.writeClosed || st.remoteClosed || st.sessionGone {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	finished := st.readClosed
+	st.mu.Unlock()
+
+	err := st.sess.writeFrame(Frame{Type: FrameCloseWrite, StreamID: st.id})
+	if finished {
+		st.sess.removeStream(st.id)
+	}
+	return err
+}
+
+// Writable reports whether data can still be sent, which after io.EOF
+// from Read tells a half-close by the peer apart from a full one.
+func (st *Stream) Writable() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return !st.closed && !st.writeClosed && !st.remoteClosed && !st.sessionGone
+}
+
+// push buffers data from the peer. A peer sending beyond the stream's
+// window, as those predating FrameWindow do, is held up here until Read
+// makes room, which stalls every stream on the session: slower, but the
+// buffer stays bounded.
+func (st *Stream) push(p []byte) {
+	st.mu.Lock()
+	for st.buf.Len() >= streamWindow && !st.closed {
+		st.mu.Unlock()
+		select {
+		case <-st.drained:
+		case <-st.sess.done:
+			return
+		}
+		st.mu.Lock()
+	}
+	if !st.closed {
+		st.buf.Write(p)
+	}
+	st.mu.Unlock()
+	st.signal()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	st.signal()
+}
+
+// remoteCloseWrite records the peer's CLOSE_WRITE and reports whether both
+// directions are now finished.
+func (st *Stream) remoteCloseWrite() bool {
+	st.mu.Lock()
+	st.readClosed = true
+	finished := st.writeClosed
+	st.mu.Unlock()
+	st.signal()
+	return finished
+}
+
+func (st *Stream) sessionClosed() {
+	st.mu.Lock()
+	st.sessionGone = true
+	st.mu.Unlock()
+	st.signal()
+}
+
+// signal wakes a blocked Read, Write or push without ever blocking the
+// caller; each checks again whether it can go on.
+func (st *Stream) signal() {
+	signal(st.readable)
+	signal(st.sendable)
+	signal(st.drained)
+}
+
+// LocalAddr returns the local address of the underlying WebSocket.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying WebSocket.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bounds future and pending Read calls.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.signal()
+	return nil
+}
+
+// SetWriteDeadline bounds future Write calls.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.signal()
+	return nil
+}
+
+func (st *Stream) String() string {
+	return fmt.Sprintf("stream-%d", st.id)
+}
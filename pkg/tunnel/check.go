@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// checkTimeout bounds a whole Check.
+const checkTimeout = 30 * time.Second
+
+// Check verifies that the tunnel could be established without serving it:
+// it resolves the proxy host, connects (completing the TLS handshake for
+// wss), registers the subdomain and releases it again. Progress is logged;
+// the first failing step is returned.
+func (c *Client) Check(ctx context.Context) error {
+	// register retries network errors forever; a check should not.
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	u, err := url.Parse(c.cfg.TunnelURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", host, err)
+	}
+	c.logger.Info("Resolved proxy", "host", host, "addrs", addrs)
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+	c.logger.Info("Connected", "addr", conn.RemoteAddr().String())
+
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if c.cfg.TLSConfig != nil {
+			cfg = c.cfg.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		state := tlsConn.ConnectionState()
+		c.logger.Info("TLS handshake complete", "version", tls.VersionName(state.Version),
+			"server", state.PeerCertificates[0].Subject.CommonName)
+	}
+
+	if err := c.register(ctx); err != nil {
+		return err
+	}
+	// A check that leaves the name registered has not passed.
+	if err := c.deregister(); err != nil {
+		return fmt.Errorf("deregister %s: %w", c.Subdomain(), err)
+	}
+	return nil
+}
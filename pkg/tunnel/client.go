@@ -0,0 +1,626 @@
+// Package tunnel is the agent side of expose-local. It registers a
+// subdomain with the server, keeps a WebSocket open to it, and forwards
+// every stream the server opens to a local service. It never listens on a
+// port itself: both connections are dialed out, so nothing the agent runs
+// is reachable from the local network.
+//
+//	client := tunnel.New(tunnel.Config{
+//		TunnelURL: "wss://exposelocal.dev:8081/tunnel",
+//		APIKey:    "secret",
+//		Subdomain: "myapp",
+//		LocalPort: "3000",
+//	})
+//	err := client.Start(ctx) // Runs until ctx is cancelled
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rahulthapaofficial/expose-local/internal/bufpool"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// Config describes a single tunnel.
+type Config struct {
+	TunnelURL       string            // WebSocket endpoint, e.g. wss://exposelocal.dev:8081/tunnel
+	RegisterURL     string            // Registration endpoint; derived from TunnelURL when empty
+	APIKey          string            // Authentication key
+	APIKeyFile      string            // Read for the key before each registration and connection, so short-lived tokens can be rotated; overrides APIKey
+	Subdomain       string            // Requested subdomain
+	LocalPort       string            // Local port to expose
+	LocalHost       string            // Host running the local service; defaults to localhost
+	Routes          map[string]string // Path prefix to another local port on LocalHost, e.g. {"/api": "8000"}; the longest match wins
+	Type            string            // "http" (default) or "tcp"
+	BasicAuth       string            // Optional "user:pass" required from visitors
+	Domain          string            // Optional custom domain CNAMEd at the server
+	BaseDomain      string            // Zone the server serves subdomains under, for servers that do not report the URL; defaults to exposelocal.dev
+	MaxBytesPerSec  int64             // Optional throughput cap, both directions; the server may lower it
+	MaxInFlight     int               // Optional limit on concurrent HTTP requests; the server may lower it
+	MaxQueued       int               // Requests that may wait for a slot before the server answers 503
+	AllowCIDRs      []string          // Visitor IPs or CIDRs admitted; empty admits everyone not denied
+	DenyCIDRs       []string          // Visitor IPs or CIDRs refused with 403
+	Wildcard        bool              // Also route every name below the subdomain, e.g. api.foo.exposelocal.dev
+	CacheBytes      int64             // Memory the server may use to cache cacheable GET responses; 0 disables, and the server may lower it
+	Fallback        string            // How the server varies a taken subdomain: "random" (default) or "sequential"
+	RespHeaders     map[string]string // Set by the server on every response from the local service
+	RemoveHeaders   []string          // Removed by the server from every response
+	Compression     bool              // Offer permessage-deflate on the WebSocket
+	WSReadBuffer    int               // WebSocket read buffer in bytes; 0 is gorilla's 4KB
+	WSWriteBuffer   int               // WebSocket write buffer in bytes; 0 is gorilla's 4KB
+	MaxMessageBytes int64             // Largest WebSocket message read from the server; 0 means 4MB, and it is never below wsmux.MaxFrameSize
+	HostHeader      string            // Host sent to the local app: "preserve", "target" or a literal value
+	BufferSize      int               // Bytes per copy buffer; defaults to bufpool.DefaultSize
+	Keepalive       time.Duration     // Interval between WebSocket pings; 0 disables
+	Heartbeat       time.Duration     // Interval between status reports to the server; 0 disables
+	DialTimeout     time.Duration     // Limit on connecting to the local service; defaults to 10s
+	IdleTimeout     time.Duration     // Close local connections idle in both directions for this long; 0 disables
+	WaitForPort     time.Duration     // Before registering, wait up to this long for the local service to accept connections; 0 does not wait
+	OneShot         bool              // Return from Start when the server drains the tunnel instead of reconnecting
+	TLSConfig       *tls.Config       // Client certificate and trusted roots for mutual TLS; nil uses the defaults
+	RetryDelay      time.Duration     // First reconnect delay before jitter; defaults to 2s
+	MaxRetryDelay   time.Duration     // Reconnect delay ceiling; defaults to 60s
+	MaxAttempts     int               // Registration attempts before giving up on a failing server; 0 retries forever
+	Logger          *slog.Logger      // Defaults to slog.Default()
+}
+
+// Client maintains one tunnel.
+type Client struct {
+	cfg     Config
+	logger  *slog.Logger
+	buffers *bufpool.Pool
+	dialer  *websocket.Dialer
+	http    *http.Client
+
+	mu         sync.Mutex
+	subdomain  string
+	publicPort int
+	publicURL  string // As reported by the server; empty for older servers
+	resumeWith string // Reconnect token from the last registration
+}
+
+// New returns a client for the given configuration. Nothing happens until
+// Start is called.
+func New(cfg Config) *Client {
+	if cfg.Type == "" {
+		cfg.Type = "http"
+	}
+	if cfg.LocalHost == "" {
+		cfg.LocalHost = "localhost"
+	}
+	if cfg.BaseDomain == "" {
+		cfg.BaseDomain = "exposelocal.dev"
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 2 * time.Second
+	}
+	if cfg.MaxMessageBytes <= 0 {
+		cfg.MaxMessageBytes = 4 << 20
+	}
+	cfg.MaxMessageBytes = max(cfg.MaxMessageBytes, wsmux.MaxFrameSize)
+	if cfg.MaxRetryDelay < cfg.RetryDelay {
+		cfg.MaxRetryDelay = max(60*time.Second, cfg.RetryDelay)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = cfg.Compression
+	dialer.ReadBufferSize = cfg.WSReadBuffer
+	dialer.WriteBufferSize = cfg.WSWriteBuffer
+	dialer.Subprotocols = wsmux.Protocols
+	httpClient := http.DefaultClient
+	if cfg.TLSConfig != nil {
+		// Separate copies: the HTTP transport adds h2 to NextProtos, which
+		// the WebSocket handshake cannot speak.
+		dialer.TLSClientConfig = cfg.TLSConfig.Clone()
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLSConfig.Clone()
+		httpClient = &http.Client{Transport: transport}
+	}
+	return &Client{
+		cfg:       cfg,
+		logger:    logger,
+		buffers:   bufpool.New(cfg.BufferSize),
+		dialer:    &dialer,
+		http:      httpClient,
+		subdomain: cfg.Subdomain,
+	}
+}
+
+// Subdomain returns the subdomain the server granted, which may differ
+// from the requested one after a conflict.
+func (c *Client) Subdomain() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subdomain
+}
+
+// PublicURL returns where visitors reach the tunnel.
+func (c *Client) PublicURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.publicURL != "" {
+		return c.publicURL
+	}
+	if c.publicPort != 0 {
+		return fmt.Sprintf("tcp://%s:%d", c.cfg.BaseDomain, c.publicPort)
+	}
+	return "https://" + c.subdomain + "." + c.cfg.BaseDomain
+}
+
+// stableSession is how long a session must stay up for its drop to count
+// as a fresh failure. Shorter ones keep backing off, so a server that
+// takes agents and drops them at once is not hammered.
+const stableSession = 30 * time.Second
+
+// Start registers the tunnel and serves it until ctx is cancelled, then
+// releases the subdomain. It reconnects with backoff whenever the
+// WebSocket drops and only returns early if registration is rejected.
+func (c *Client) Start(ctx context.Context) error {
+	if c.cfg.WaitForPort > 0 {
+		c.waitForLocal(ctx, c.cfg.WaitForPort)
+	}
+	if err := c.register(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		if err := c.deregister(); err != nil {
+			c.logger.Error("Deregistration failed", "subdomain", c.Subdomain(), "err", err)
+		}
+	}()
+
+	retryDelay := c.cfg.RetryDelay
+	maxRetryDelay := c.cfg.MaxRetryDelay
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.logger.Info("Shutting down agent")
+			return nil
+		default:
+		}
+
+		headers := http.Header{}
+		headers.Set("X-API-Key", c.apiKey())
+		headers.Set("X-Subdomain", c.Subdomain())
+
+		c.logger.Info("Connecting to WebSocket", "url", c.cfg.TunnelURL)
+		conn, resp, err := c.dialer.DialContext(ctx, c.cfg.TunnelURL, headers)
+		if err != nil && resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			// Retrying cannot help until one side is upgraded.
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("server refused the tunnel protocol: %s", strings.TrimSpace(string(body)))
+		}
+		if err != nil {
+			wait := jitter(retryDelay)
+			c.logger.Warn("WebSocket connection failed", "err", err, "retry_in", wait)
+			sleep(ctx, wait)
+			retryDelay = increaseDelay(retryDelay, maxRetryDelay)
+			continue
+		}
+
+		// Servers that predate negotiation choose nothing and speak v1.
+		if p := conn.Subprotocol(); p != "" && wsmux.NegotiateProtocol([]string{p}) == "" {
+			conn.Close()
+			return fmt.Errorf("server chose unknown tunnel protocol %q", p)
+		}
+
+		// Servers with compression off ignore the offer; frames then go
+		// uncompressed both ways.
+		compressed := c.cfg.Compression && wsmux.OffersDeflate(resp.Header)
+		if c.cfg.Compression && !compressed {
+			c.logger.Info("Server declined WebSocket compression, sending frames uncompressed")
+		}
+		c.logger.Info("Tunnel active", "subdomain", c.Subdomain(), "url", c.PublicURL(), "target", c.localAddr(), "compression", compressed)
+		connectedAt := time.Now()
+
+		// Serve streams until the tunnel drops or we are interrupted. On
+		// v2 the server names the session so a dropped WebSocket can be
+		// resumed rather than the streams on it lost.
+		resumeID := ""
+		if conn.Subprotocol() == wsmux.ProtocolV2 {
+			resumeID = resp.Header.Get(wsmux.HeaderSession)
+		}
+		drained, closeErr := c.handleConnection(ctx, conn, resumeID)
+		if ctx.Err() != nil {
+			continue
+		}
+		if drained == nil {
+			// Whether the server hung up on purpose, e.g. while shutting
+			// down, or the connection broke, coming straight back would
+			// likely find the same trouble.
+			if time.Since(connectedAt) >= stableSession {
+				retryDelay = c.cfg.RetryDelay
+			}
+			wait := jitter(retryDelay)
+			if websocket.IsCloseError(closeErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Info("Server closed the tunnel", "reason", closeErr, "reconnect_in", wait)
+			} else {
+				c.logger.Info("Reconnecting", "reconnect_in", wait)
+			}
+			sleep(ctx, wait)
+			retryDelay = increaseDelay(retryDelay, maxRetryDelay)
+			if ctx.Err() != nil {
+				continue
+			}
+		}
+		if drained != nil {
+			if c.cfg.OneShot {
+				c.logger.Info("Tunnel drained by the server, exiting")
+				return nil
+			}
+			wait := time.Duration(drained.ReconnectAfter) * time.Second
+			c.logger.Info("Tunnel drained by the server", "reconnect_in", wait)
+			sleep(ctx, wait)
+			if ctx.Err() != nil {
+				continue
+			}
+		}
+
+		// Register again before reconnecting in case the server expired the
+		// tunnel meanwhile; the reconnect token keeps the same subdomain even
+		// if the server has not yet noticed the old connection is gone.
+		if err := c.register(ctx); err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// Register claims the subdomain without connecting, so it stays reserved
+// until an agent serves it or the server expires it. Start registers by
+// itself; Register is for setting a tunnel up ahead of time.
+func (c *Client) Register(ctx context.Context) error {
+	return c.register(ctx)
+}
+
+// apiKey returns the key from APIKeyFile as it is now, falling back to
+// APIKey if the file cannot be read.
+func (c *Client) apiKey() string {
+	if c.cfg.APIKeyFile != "" {
+		data, err := os.ReadFile(c.cfg.APIKeyFile)
+		if key := strings.TrimSpace(string(data)); err == nil && key != "" {
+			return key
+		}
+		c.logger.Warn("Failed to read API key file, using the key read at startup", "path", c.cfg.APIKeyFile, "err", err)
+	}
+	return c.cfg.APIKey
+}
+
+// localAddr is the address of the service being exposed.
+func (c *Client) localAddr() string {
+	return net.JoinHostPort(c.cfg.LocalHost, c.cfg.LocalPort)
+}
+
+// registerURL returns the registration endpoint, deriving it from the
+// tunnel URL (wss://host/tunnel → https://host/register) when unset.
+func (c *Client) registerURL() (string, error) {
+	if c.cfg.RegisterURL != "" {
+		return c.cfg.RegisterURL, nil
+	}
+	u, err := url.Parse(c.cfg.TunnelURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/tunnel") + "/register"
+	return u.String(), nil
+}
+
+// Codes the server gives for refusing a registration, in
+// RegistrationError.Code.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeRequestTooLarge    = "request_too_large"
+	CodeUnauthorized       = "unauthorized"
+	CodeAuthUnavailable    = "auth_unavailable"
+	CodeRateLimited        = "rate_limited"
+	CodeInvalidSubdomain   = "invalid_subdomain"
+	CodeInvalidDomain      = "invalid_custom_domain"
+	CodeSubdomainForbidden = "subdomain_not_permitted"
+	CodePortInvalid        = "port_invalid"
+	CodeSubdomainTaken     = "subdomain_taken"
+	CodeDomainTaken        = "domain_taken"
+	CodeTooManyForIP       = "too_many_tunnels_for_ip"
+	CodeTunnelLimit        = "tunnel_limit_reached"
+	CodeNoTCPPorts         = "no_tcp_ports"
+	CodeInternal           = "internal_error"
+)
+
+// RegistrationError is a registration the server refused.
+type RegistrationError struct {
+	Status  int    // HTTP status
+	Code    string // One of the Code constants; empty from servers that answer in plain text
+	Message string
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("registration failed: %d %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("registration failed: %s (%s)", e.Message, e.Code)
+}
+
+// Temporary reports whether the same registration may succeed later.
+func (e *RegistrationError) Temporary() bool {
+	switch e.Code {
+	case CodeAuthUnavailable, CodeRateLimited, CodeTooManyForIP, CodeTunnelLimit, CodeNoTCPPorts, CodeInternal:
+		return true
+	}
+	// Without a code we know, all we have is the status: the server, or a
+	// proxy in front of it, may be restarting or overloaded.
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// parseRegistrationError reads the server's {"error": ..., "code": ...}
+// answer, or takes the body as the message from servers without codes.
+func parseRegistrationError(status int, body []byte) *RegistrationError {
+	e := &RegistrationError{Status: status}
+	var reply struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if json.Unmarshal(body, &reply) == nil && reply.Code != "" {
+		e.Code, e.Message = reply.Code, reply.Error
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// register claims a subdomain, picking a random suffix when the name is
+// taken. Network errors and temporary refusals are retried with jittered
+// exponential backoff, up to MaxAttempts; any other refusal, such as a bad
+// key or subdomain, is returned at once as a *RegistrationError.
+func (c *Client) register(ctx context.Context) error {
+	registerURL, err := c.registerURL()
+	if err != nil {
+		return fmt.Errorf("invalid register URL: %w", err)
+	}
+
+	retryDelay := c.cfg.RetryDelay
+	attempts, conflicts := 0, 0
+	retry := func(err error) error {
+		attempts++
+		if c.cfg.MaxAttempts > 0 && attempts >= c.cfg.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+		wait := jitter(retryDelay)
+		c.logger.Warn("Registration failed, retrying", "err", err, "attempt", attempts, "retry_in", wait)
+		sleep(ctx, wait)
+		retryDelay = increaseDelay(retryDelay, c.cfg.MaxRetryDelay)
+		return ctx.Err()
+	}
+
+	// Variants are built on the configured name or, without one, on the
+	// name the server granted last time.
+	base := c.cfg.Subdomain
+	if base == "" {
+		base = c.Subdomain()
+	}
+
+	for {
+		subdomain := c.Subdomain()
+		registerData := map[string]any{
+			"subdomain":   subdomain,
+			"target_port": c.cfg.LocalPort,
+			"target_host": c.cfg.LocalHost,
+			"api_key":     c.apiKey(),
+			"type":        c.cfg.Type,
+			// Let the server pick a free variant of the name atomically
+			// rather than racing other agents through 409 retries.
+			"random_subdomain": true,
+		}
+		if user, pass, ok := strings.Cut(c.cfg.BasicAuth, ":"); ok {
+			registerData["basic_auth_user"] = user
+			registerData["basic_auth_pass"] = pass
+		}
+		if c.cfg.Domain != "" {
+			registerData["custom_domain"] = c.cfg.Domain
+		}
+		if c.cfg.HostHeader != "" {
+			registerData["host_header"] = c.cfg.HostHeader
+		}
+		if c.cfg.MaxBytesPerSec > 0 {
+			registerData["max_bytes_per_sec"] = c.cfg.MaxBytesPerSec
+		}
+		if c.cfg.MaxInFlight > 0 {
+			registerData["max_in_flight"] = c.cfg.MaxInFlight
+		}
+		if c.cfg.MaxQueued > 0 {
+			registerData["max_queued"] = c.cfg.MaxQueued
+		}
+		if c.cfg.Wildcard {
+			registerData["wildcard"] = true
+		}
+		if c.cfg.CacheBytes > 0 {
+			registerData["cache_bytes"] = c.cfg.CacheBytes
+		}
+		if c.cfg.Fallback != "" {
+			registerData["fallback"] = c.cfg.Fallback
+		}
+		if len(c.cfg.Routes) > 0 {
+			registerData["routes"] = c.cfg.Routes
+		}
+		if len(c.cfg.RespHeaders) > 0 {
+			registerData["response_headers"] = c.cfg.RespHeaders
+		}
+		if len(c.cfg.RemoveHeaders) > 0 {
+			registerData["remove_response_headers"] = c.cfg.RemoveHeaders
+		}
+		if len(c.cfg.AllowCIDRs) > 0 {
+			registerData["allow_cidrs"] = c.cfg.AllowCIDRs
+		}
+		if len(c.cfg.DenyCIDRs) > 0 {
+			registerData["deny_cidrs"] = c.cfg.DenyCIDRs
+		}
+
+		jsonData, err := json.Marshal(registerData)
+		if err != nil {
+			return fmt.Errorf("JSON encoding failed: %w", err)
+		}
+
+		c.logger.Info("Registering subdomain", "subdomain", subdomain)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, registerURL, bytes.NewReader(jsonData))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		c.mu.Lock()
+		if c.resumeWith != "" {
+			req.Header.Set("X-Reconnect-Token", c.resumeWith)
+		}
+		c.mu.Unlock()
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := retry(err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.logger.Debug("Registration response", "status", resp.StatusCode, "body", string(body))
+
+		if resp.StatusCode == http.StatusCreated {
+			var registered struct {
+				Subdomain string `json:"subdomain"`
+				URL       string `json:"url"`
+				Port      int    `json:"port"`
+				Token     string `json:"reconnect_token"`
+			}
+			json.Unmarshal(body, &registered)
+
+			// The server has the final say on the name.
+			c.mu.Lock()
+			if registered.Subdomain != "" {
+				c.subdomain = registered.Subdomain
+			}
+			c.publicURL = registered.URL
+			c.publicPort = registered.Port
+			c.resumeWith = registered.Token
+			c.mu.Unlock()
+			c.logger.Info("Successfully registered", "subdomain", c.Subdomain(), "url", c.PublicURL())
+			return nil
+		}
+
+		// Servers without random_subdomain report a conflict instead; try a
+		// suffix ourselves. A different subdomain will not free somebody
+		// else's domain. Servers without codes only say so in the message.
+		regErr := parseRegistrationError(resp.StatusCode, body)
+		taken := regErr.Code == CodeSubdomainTaken ||
+			regErr.Code == "" && resp.StatusCode == http.StatusConflict && !strings.Contains(regErr.Message, "Custom domain")
+		if taken && base != "" {
+			conflicts++
+			c.mu.Lock()
+			if c.cfg.Fallback == "sequential" {
+				c.subdomain = fmt.Sprintf("%s-%d", base, conflicts+1)
+			} else {
+				c.subdomain = fmt.Sprintf("%s-%d", base, rand.Intn(1000))
+			}
+			c.mu.Unlock()
+			c.logger.Warn("Subdomain taken, retrying", "subdomain", c.Subdomain())
+			continue
+		}
+
+		// Only a refusal of the request itself is final.
+		if regErr.Temporary() {
+			if err := retry(regErr); err != nil {
+				return err
+			}
+			continue
+		}
+		return regErr
+	}
+}
+
+// deregister releases the subdomain so it can be claimed again right away.
+func (c *Client) deregister() error {
+	subdomain := c.Subdomain()
+	registerURL, err := c.registerURL()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, registerURL+"/"+subdomain, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", c.apiKey())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	c.logger.Info("Subdomain deregistered", "subdomain", subdomain)
+	return nil
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// jitter picks a delay uniformly between 0 and d ("full jitter"), so agents
+// that lost the server at the same moment do not all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func increaseDelay(currentDelay, max time.Duration) time.Duration {
+	next := currentDelay * 2
+	if next > max {
+		return max
+	}
+	return next
+}
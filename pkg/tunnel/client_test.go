@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe for a logger and a test to share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// After the server closes the tunnel on purpose the agent says so at info
+// level and waits out a backoff before connecting again.
+func TestStartWaitsAfterDeliberateClose(t *testing.T) {
+	for _, code := range []int{websocket.CloseNormalClosure, websocket.CloseGoingAway} {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			sessions := make(chan time.Time, 2)
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /register", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"subdomain":"foo","url":"https://foo.example.com"}`)
+			})
+			mux.HandleFunc("DELETE /register/foo", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+			mux.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				select {
+				case sessions <- time.Now():
+				default:
+				}
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, "bye"), time.Now().Add(time.Second))
+				conn.Close()
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			var logs syncBuffer
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				New(Config{
+					TunnelURL:  "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+					APIKey:     "key",
+					Subdomain:  "foo",
+					LocalPort:  "1",
+					RetryDelay: 200 * time.Millisecond,
+					Logger:     slog.New(slog.NewJSONHandler(&logs, nil)),
+				}).Start(ctx)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			var first, second time.Time
+			for i, at := range []*time.Time{&first, &second} {
+				select {
+				case *at = <-sessions:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("session %d not started", i+1)
+				}
+			}
+
+			var closed struct {
+				Level       string        `json:"level"`
+				ReconnectIn time.Duration `json:"reconnect_in"`
+			}
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, `"msg":"Server closed the tunnel"`) {
+					json.Unmarshal([]byte(line), &closed)
+					break
+				}
+			}
+			if closed.Level != "INFO" {
+				t.Fatalf("no info record of the server closing the tunnel in:\n%s", logs.String())
+			}
+			if strings.Contains(logs.String(), `"level":"WARN"`) {
+				t.Errorf("deliberate close logged as a warning:\n%s", logs.String())
+			}
+			if gap := second.Sub(first); closed.ReconnectIn <= 0 || gap < closed.ReconnectIn {
+				t.Errorf("reconnected after %v, want a backoff of %v first", gap, closed.ReconnectIn)
+			}
+		})
+	}
+}
+
+// A taken name is varied from the configured name or, without one, from the
+// name the server granted; there is nothing to vary before either exists.
+func TestRegisterVariesGrantedName(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	taken := map[string]bool{"": true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Subdomain string `json:"subdomain"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, req.Subdomain)
+		if taken[req.Subdomain] {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"error":"taken","code":%q}`, CodeSubdomainTaken)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"subdomain":%q}`, req.Subdomain)
+	}))
+	defer srv.Close()
+
+	c := New(Config{
+		TunnelURL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel",
+		APIKey:    "key",
+		LocalPort: "1",
+		Fallback:  "sequential",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := c.register(context.Background()); err == nil {
+		t.Fatal("registered a taken empty name")
+	}
+	if len(asked) != 1 {
+		t.Fatalf("asked for %q, want one attempt", asked)
+	}
+
+	// As if an earlier registration had been granted "abc" and lost it.
+	asked = nil
+	c.subdomain = "abc"
+	taken["abc"] = true
+	if err := c.register(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"abc", "abc-2"}; !slices.Equal(asked, want) {
+		t.Errorf("asked for %q, want %q", asked, want)
+	}
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// drain is the control message a server sends to move the agent off it,
+// e.g. before maintenance. It stops opening streams on the session first.
+type drain struct {
+	Type           string `json:"type"`            // Always "drain"
+	ReconnectAfter int    `json:"reconnect_after"` // Seconds to wait before reconnecting
+	Timeout        int    `json:"timeout"`         // Seconds in-flight streams get to finish
+}
+
+// watchControl handles the server's control messages until the session
+// ends. On a drain it lets open streams finish, for at most the drain's
+// timeout, then closes the session and hands the drain to handleConnection.
+func (c *Client) watchControl(session *wsmux.Session, drained chan<- drain) {
+	for {
+		var msg drain
+		select {
+		case data := <-session.Control():
+			if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "drain" {
+				continue
+			}
+		case <-session.Done():
+			return
+		}
+
+		c.logger.Info("Server is draining the tunnel", "streams", session.NumStreams(),
+			"timeout", time.Duration(msg.Timeout)*time.Second)
+		deadline := time.Now().Add(time.Duration(msg.Timeout) * time.Second)
+		for session.NumStreams() > 0 && time.Now().Before(deadline) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-session.Done():
+				return
+			}
+		}
+		drained <- msg
+		session.Close()
+		return
+	}
+}
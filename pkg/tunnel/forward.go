@@ -0,0 +1,247 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// handleConnection serves streams opened by the server until the
+// WebSocket drops or ctx is cancelled. A session the server named with
+// resumeID survives the WebSocket dropping: see keepSession. It returns the
+// server's drain request if that is why the session ended, and otherwise
+// why it did.
+func (c *Client) handleConnection(ctx context.Context, conn *websocket.Conn, resumeID string) (*drain, error) {
+	c.prepareConn(conn)
+	var session *wsmux.Session
+	if resumeID != "" {
+		session = wsmux.NewResumableSession(conn, false, resumeGrace)
+	} else {
+		session = wsmux.NewSession(conn, false)
+	}
+	defer session.Close()
+
+	// Servers that predate control messages ignore them.
+	if c.cfg.Heartbeat > 0 {
+		go c.sendHeartbeats(ctx, session, c.cfg.Heartbeat)
+	}
+	drained := make(chan drain, 1)
+	go c.watchControl(session, drained)
+	go c.keepSession(ctx, session, conn, resumeID)
+
+	// Every bridge is torn down before returning, so nothing from this
+	// session is still running when the caller reconnects.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			select {
+			case d := <-drained:
+				return &d, nil
+			default:
+			}
+			if err := session.Err(); wsmux.NormalClose(err) {
+				c.logger.Info("Tunnel closed", "err", err)
+			} else {
+				c.logger.Warn("Tunnel connection lost", "err", err)
+			}
+			return nil, session.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.forwardTraffic(ctx, stream)
+		}()
+	}
+}
+
+// streamAddr returns the local address a stream is for: the port of one of
+// the configured routes when the server names one, else the local service.
+// The server may only pick among the ports this agent registered.
+func (c *Client) streamAddr(stream *wsmux.Stream) (string, error) {
+	target := stream.Target()
+	if target == "" {
+		return c.localAddr(), nil
+	}
+	for _, port := range c.cfg.Routes {
+		if port == target {
+			return net.JoinHostPort(c.cfg.LocalHost, port), nil
+		}
+	}
+	return "", fmt.Errorf("server asked for port %s, which is not a configured route", target)
+}
+
+// forwardTraffic bridges one tunnel stream to a fresh connection to the
+// local service. EOF in one direction is passed on as a half-close while
+// the other keeps flowing. Both are closed once ctx is cancelled or, with
+// an idle timeout set, once neither side has sent anything for that long.
+func (c *Client) forwardTraffic(ctx context.Context, stream *wsmux.Stream) {
+	defer stream.Close()
+	logger := c.logger.With("stream_id", stream.ID())
+
+	addr, err := c.streamAddr(stream)
+	if err != nil {
+		logger.Warn("Refusing stream", "err", err)
+		if c.cfg.Type == "http" {
+			writeDialError(stream, err)
+		}
+		return
+	}
+	dialer := net.Dialer{Timeout: c.cfg.DialTimeout}
+	localConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		logger.Error("Local dial error", "err", err)
+		if c.cfg.Type == "http" {
+			writeDialError(stream, err)
+		}
+		return
+	}
+	logger.Debug("Stream opened", "target", localConn.RemoteAddr().String())
+
+	// Blocked reads do not notice ctx; closing both ends unblocks them.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			localConn.Close()
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	idle := newIdleTracker(c.cfg.IdleTimeout)
+
+	// Local → Tunnel. Closing localConn ends it; wait for that so the
+	// caller knows the bridge is gone once this returns.
+	copied := make(chan struct{})
+	defer func() {
+		localConn.Close()
+		<-copied
+	}()
+	go func() {
+		defer close(copied)
+		buf := c.buffers.Get()
+		defer c.buffers.Put(buf)
+		for {
+			idle.arm(localConn.SetReadDeadline)
+			n, err := localConn.Read(buf)
+			if err != nil {
+				if idle.extend(err) {
+					continue
+				}
+				if err == io.EOF {
+					stream.CloseWrite()
+					return
+				}
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Warn("Local read error", "err", err)
+				}
+				stream.Close()
+				return
+			}
+			idle.touch()
+
+			idle.arm(stream.SetWriteDeadline)
+			if _, err := stream.Write(buf[:n]); err != nil {
+				logger.Warn("Tunnel write error", "err", err)
+				stream.Close()
+				return
+			}
+		}
+	}()
+
+	// Tunnel → Local
+	buf := c.buffers.Get()
+	defer c.buffers.Put(buf)
+	for {
+		idle.arm(stream.SetReadDeadline)
+		n, err := stream.Read(buf)
+		if err != nil {
+			if idle.extend(err) {
+				continue
+			}
+			// The server is done sending but still listening; let the
+			// local service finish its reply before tearing down.
+			if err == io.EOF && stream.Writable() {
+				if cw, ok := localConn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+					<-copied
+				}
+				return
+			}
+			// The local side closing the stream first is a normal end.
+			if !errors.Is(err, wsmux.ErrStreamClosed) {
+				logger.Warn("Tunnel read error", "err", err)
+			}
+			return
+		}
+		idle.touch()
+
+		idle.arm(localConn.SetWriteDeadline)
+		if _, err := localConn.Write(buf[:n]); err != nil {
+			logger.Warn("Local write error", "err", err)
+			return
+		}
+	}
+}
+
+// idleTracker times out a bridged pair of connections once neither
+// direction has carried data for timeout. A zero timeout disables it.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // Unix nanoseconds of the last data in either direction
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// arm sets a deadline one timeout from now.
+func (t *idleTracker) arm(setDeadline func(time.Time) error) {
+	if t.timeout > 0 {
+		setDeadline(time.Now().Add(t.timeout))
+	}
+}
+
+// extend reports whether err is a deadline that passed while the other
+// direction was still busy, in which case the caller should carry on.
+func (t *idleTracker) extend(err error) bool {
+	if t.timeout <= 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return time.Since(time.Unix(0, t.last.Load())) < t.timeout
+}
+
+// writeDialError answers an HTTP stream whose backend could not be reached,
+// so visitors get 504 for a dial timeout rather than a bare 502 from the
+// server seeing the stream close. X-Tunnel-Error tells the server the local
+// service is down, for its circuit breaker; it is not passed on to visitors.
+func writeDialError(stream *wsmux.Stream, err error) {
+	code := http.StatusBadGateway
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		code = http.StatusGatewayTimeout
+	}
+	body := "Local service unreachable\n"
+	fmt.Fprintf(stream, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nX-Tunnel-Error: dial\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
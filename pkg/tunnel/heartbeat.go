@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/rahulthapaofficial/expose-local/internal/version"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// heartbeat is the control message the agent sends the server
+// periodically, shown by the server's GET /tunnels.
+type heartbeat struct {
+	Type         string `json:"type"` // Always "heartbeat"
+	Version      string `json:"version"`
+	Commit       string `json:"commit,omitempty"`
+	OS           string `json:"os"`
+	Arch         string `json:"arch"`
+	LocalHealthy bool   `json:"local_healthy"`         // Whether the local service accepted a connection
+	LocalError   string `json:"local_error,omitempty"` // Why it did not
+}
+
+// sendHeartbeats reports the agent's build and the local service's health
+// right away and then every interval, until the session ends.
+func (c *Client) sendHeartbeats(ctx context.Context, session *wsmux.Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	commit, _ := version.Info()
+	for {
+		msg := heartbeat{
+			Type:    "heartbeat",
+			Version: version.Version,
+			Commit:  commit,
+			OS:      runtime.GOOS,
+			Arch:    runtime.GOARCH,
+		}
+		if err := c.checkLocal(ctx); err != nil {
+			msg.LocalError = err.Error()
+		} else {
+			msg.LocalHealthy = true
+		}
+		data, _ := json.Marshal(msg)
+		if err := session.SendControl(data); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitForLocal polls the local service until it accepts a connection, for
+// at most timeout. A service that is still down by then gets a warning; the
+// tunnel starts anyway and works once it comes up.
+func (c *Client) waitForLocal(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for logged := false; ; logged = true {
+		err := c.checkLocal(ctx)
+		if err == nil {
+			if logged {
+				c.logger.Info("Local service is up", "target", c.localAddr())
+			}
+			return
+		}
+		if !logged {
+			c.logger.Info("Waiting for local service", "target", c.localAddr(), "timeout", timeout)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				c.logger.Warn("Local service still unreachable, starting the tunnel anyway", "target", c.localAddr(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// checkLocal connects to the local service and hangs up again.
+func (c *Client) checkLocal(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: c.cfg.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.localAddr())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
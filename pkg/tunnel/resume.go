@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rahulthapaofficial/expose-local/internal/wsmux"
+)
+
+// resumeGrace is how long a dropped session waits to be resumed before its
+// streams are given up. The server keeps its end for about as long.
+const resumeGrace = 30 * time.Second
+
+// keepSession pings the server over conn and, whenever conn drops, moves a
+// resumable session onto a new WebSocket so that its streams, and the
+// local connections behind them, carry on. It closes the session once ctx
+// is cancelled or the session cannot be resumed.
+func (c *Client) keepSession(ctx context.Context, session *wsmux.Session, conn *websocket.Conn, resumeID string) {
+	for {
+		if !c.keepalive(ctx, session, conn) || !session.Resumable() {
+			return
+		}
+		c.logger.Warn("Tunnel connection lost, resuming", "streams", session.NumStreams())
+		if conn = c.resume(ctx, session, resumeID); conn == nil {
+			session.Close()
+			return
+		}
+		c.logger.Info("Tunnel resumed", "streams", session.NumStreams())
+	}
+}
+
+// prepareConn applies the connection settings to conn. gorilla does not
+// allow changing them while a read is in progress, so it must run before
+// a session starts reading from conn.
+func (c *Client) prepareConn(conn *websocket.Conn) {
+	// Only takes effect if the server agreed to permessage-deflate.
+	conn.EnableWriteCompression(c.cfg.Compression)
+	conn.SetReadLimit(c.cfg.MaxMessageBytes)
+
+	// A missed pong means the server or the path to it is gone.
+	if keepalive := c.cfg.Keepalive; keepalive > 0 {
+		conn.SetReadDeadline(time.Now().Add(3 * keepalive))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(3 * keepalive))
+			return nil
+		})
+	}
+}
+
+// keepalive pings the server over conn until conn drops, returning true,
+// or until the session ends or ctx is cancelled, returning false.
+func (c *Client) keepalive(ctx context.Context, session *wsmux.Session, conn *websocket.Conn) bool {
+	keepalive := c.cfg.Keepalive
+	var tick <-chan time.Time
+	if keepalive > 0 {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	lost := session.Lost()
+	for {
+		select {
+		case <-ctx.Done():
+			session.Close()
+			return false
+		case <-session.Done():
+			return false
+		case <-lost:
+			return true
+		case <-tick:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepalive)); err != nil {
+				c.logger.Warn("Keepalive ping failed", "err", err)
+				conn.Close()
+			}
+		}
+	}
+}
+
+// resume reconnects with backoff until the server takes the session back,
+// returning the new connection, or until it refuses, the session's grace
+// period runs out or ctx is cancelled, returning nil.
+func (c *Client) resume(ctx context.Context, session *wsmux.Session, resumeID string) *websocket.Conn {
+	received := session.Suspend()
+	retryDelay := c.cfg.RetryDelay
+	for {
+		headers := http.Header{}
+		headers.Set("X-API-Key", c.apiKey())
+		headers.Set("X-Subdomain", c.Subdomain())
+		headers.Set(wsmux.HeaderSession, resumeID)
+		headers.Set(wsmux.HeaderReceived, strconv.FormatUint(received, 10))
+
+		conn, resp, err := c.dialer.DialContext(ctx, c.cfg.TunnelURL, headers)
+		if err == nil {
+			peerReceived, perr := strconv.ParseUint(resp.Header.Get(wsmux.HeaderReceived), 10, 64)
+			if perr != nil {
+				c.logger.Warn("Server did not resume the tunnel session", "err", perr)
+				conn.Close()
+				return nil
+			}
+			c.prepareConn(conn)
+			if err = session.Resume(conn, peerReceived); err == nil {
+				return conn
+			}
+			conn.Close()
+			if session.Err() != nil {
+				c.logger.Warn("Tunnel session could not be resumed", "err", err)
+				return nil
+			}
+		} else if resp != nil {
+			// The server answered but has given up on the session.
+			c.logger.Warn("Server refused to resume the tunnel session", "status", resp.StatusCode)
+			return nil
+		}
+
+		wait := jitter(retryDelay)
+		c.logger.Warn("Tunnel resume failed", "err", err, "retry_in", wait)
+		select {
+		case <-time.After(wait):
+		case <-session.Done():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		retryDelay = increaseDelay(retryDelay, c.cfg.MaxRetryDelay)
+	}
+}